@@ -0,0 +1,104 @@
+package api
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"github.com/labstack/echo"
+	strut "github.com/pintobikez/authentication-service/api/structures"
+	"github.com/pintobikez/authentication-service/ldap"
+	redis "github.com/pintobikez/authentication-service/redis"
+	"net/http"
+)
+
+const (
+	HeaderAdminKey = "Admin-Key"
+	AdminForbidden = "Invalid admin key"
+	RoleInvalid    = "Role %s must have a name and at least one group"
+)
+
+// AdminAuth protects the admin endpoints with the admin key of the security configuration,
+// when no key is configured the admin endpoints are disabled
+func AdminAuth(key string) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			k := c.Request().Header.Get(HeaderAdminKey)
+			if key == "" || subtle.ConstantTimeCompare([]byte(k), []byte(key)) != 1 {
+				return c.JSON(http.StatusForbidden, &ErrContent{http.StatusForbidden, AdminForbidden})
+			}
+			return next(c)
+		}
+	}
+}
+
+// Handler to revoke every session of a user, optionally only of one service
+func (a *API) RevokeSessions() echo.HandlerFunc {
+	return func(c echo.Context) error {
+
+		// the username of the sessions, normalised and qualified with the realm like the logins
+		realm, username, err := a.Ldap.Realm(c.Param("username"), c.QueryParam("realm"))
+		if err != nil {
+			return c.JSON(http.StatusBadRequest, &ErrContent{http.StatusBadRequest, err.Error()})
+		}
+
+		n, err := a.Redis.DeleteSessions(ldap.Qualify(username, realm), c.QueryParam("service"))
+		if err != nil {
+			return c.JSON(http.StatusInternalServerError, &ErrContent{http.StatusInternalServerError, err.Error()})
+		}
+
+		return c.JSON(http.StatusOK, &strut.RevokeResponse{Removed: n})
+	}
+}
+
+// Handler to retrieve the roles of a registered service
+func (a *API) ServiceRoles() echo.HandlerFunc {
+	return func(c echo.Context) error {
+
+		svc, e := a.registeredService(c.Param("service"))
+		if e != nil {
+			return c.JSON(e.Code, e)
+		}
+
+		return c.JSON(http.StatusOK, &strut.ServiceRoles{Service: svc.Name, Roles: svc.Roles})
+	}
+}
+
+// Handler to replace the roles of a registered service
+func (a *API) SaveServiceRoles() echo.HandlerFunc {
+	return func(c echo.Context) error {
+
+		o := new(strut.ServiceRoles)
+		// if is an invalid json format
+		if err := c.Bind(&o); err != nil {
+			return c.JSON(http.StatusBadRequest, &ErrContent{http.StatusBadRequest, err.Error()})
+		}
+		for role, groups := range o.Roles {
+			if role == "" || len(groups) == 0 {
+				return c.JSON(http.StatusBadRequest, &ErrContent{http.StatusBadRequest, fmt.Sprintf(RoleInvalid, role)})
+			}
+		}
+
+		svc, e := a.registeredService(c.Param("service"))
+		if e != nil {
+			return c.JSON(e.Code, e)
+		}
+
+		svc.Roles = o.Roles
+		if err := a.Redis.SaveService(svc); err != nil {
+			return c.JSON(http.StatusInternalServerError, &ErrContent{http.StatusInternalServerError, err.Error()})
+		}
+
+		return c.JSON(http.StatusOK, &strut.ServiceRoles{Service: svc.Name, Roles: svc.Roles})
+	}
+}
+
+// Returns the registration of the service, not found when it has none
+func (a *API) registeredService(name string) (*redis.Service, *ErrContent) {
+	svc, e := a.findService(name)
+	if e != nil {
+		return nil, e
+	}
+	if svc == nil {
+		return nil, &ErrContent{http.StatusNotFound, fmt.Sprintf(ServiceNotRegistered, name)}
+	}
+	return svc, nil
+}
@@ -3,8 +3,11 @@ package api
 import (
 	"fmt"
 	"github.com/labstack/echo"
+	"github.com/labstack/gommon/log"
 	strut "github.com/pintobikez/authentication-service/api/structures"
+	cnf "github.com/pintobikez/authentication-service/config/structures"
 	ldap "github.com/pintobikez/authentication-service/ldap"
+	"github.com/pintobikez/authentication-service/policy"
 	redis "github.com/pintobikez/authentication-service/redis"
 	sec "github.com/pintobikez/authentication-service/secure/structures"
 	"net/http"
@@ -15,11 +18,16 @@ type API struct {
 	Secure sec.TokenManagerI
 	Redis  redis.ClientI
 	Ldap   ldap.ClientI
+	// Attributes of the session cookies of the services in cookie mode
+	Cookies cnf.CookieConfig
+	// Issuer of the tokens, enables OpenID Connect
+	Issuer string
 }
 
 const (
 	HeaderService        = "Requester"
 	ErrorUserNotInGroups = "None of the User Groups are valid"
+	RequirementNotMet    = "The User Groups don't meet the requirement of the service"
 	StatusAvailable      = "Available"
 	StatusUnavailable    = "Unavailable"
 	IsEmpty              = "%s is empty"
@@ -27,6 +35,17 @@ const (
 	TokenNotFound        = "Token not found for service: %s"
 	ServiceNotRegistered = "Service %s is not registered, please contact admin team in order to register"
 	TokenInvalid         = "The provided Token is invalid"
+	SessionRevoked       = "The session of the provided Token expired or was revoked"
+	MachineTokenRejected = "The provided Token was issued to a service and doesn't authenticate a user"
+	InvalidCredentials   = "The username or the password is wrong"
+	UserNotFound         = "The user doesn't exist"
+	AccountDisabled      = "The account is disabled"
+	AccountLocked        = "The account is locked"
+	PasswordExpired      = "The password expired"
+	MustChangePassword   = "The password must be changed before logging in"
+	DirectoryUnavailable = "The directory is unavailable, please try again later"
+	PasswordPolicy       = "The new password doesn't meet the password policy"
+	LoginFailed          = "authentication_failed"
 )
 
 // Handler for Health Status
@@ -42,6 +61,13 @@ func (a *API) HealthStatus() echo.HandlerFunc {
 			resp.Ldap.Status = StatusUnavailable
 			resp.Ldap.Detail = err.Error()
 		}
+		for _, sv := range a.Ldap.Servers() {
+			d := &strut.HealthServerDetail{Realm: sv.Realm, Address: sv.Address, Status: StatusAvailable, Failures: sv.Failures, Reason: sv.Reason, Detail: sv.Detail}
+			if !sv.Available {
+				d.Status = StatusUnavailable
+			}
+			resp.Ldap.Servers = append(resp.Ldap.Servers, d)
+		}
 		if err := a.Redis.Health(); err != nil {
 			resp.Redis.Status = StatusUnavailable
 			resp.Redis.Detail = err.Error()
@@ -55,49 +81,131 @@ func (a *API) HealthStatus() echo.HandlerFunc {
 	}
 }
 
+// Handler that publishes the public keys used to sign the tokens
+func (a *API) JWKS() echo.HandlerFunc {
+	return func(c echo.Context) error {
+		return c.JSON(http.StatusOK, a.Secure.JWKS())
+	}
+}
+
 // Handler to Validate the Token
 func (a *API) Validate() echo.HandlerFunc {
 	return func(c echo.Context) error {
 
-		token := c.Request().Header.Get(echo.HeaderAuthorization)
-		if token == "" {
-			return c.JSON(http.StatusBadRequest, &ErrContent{http.StatusBadRequest, fmt.Sprintf(IsEmpty, echo.HeaderAuthorization)})
-		}
-		service := c.Request().Header.Get(HeaderService)
-		if service == "" {
-			return c.JSON(http.StatusBadRequest, &ErrContent{http.StatusBadRequest, fmt.Sprintf(IsEmpty, HeaderService)})
+		token, service, e := a.requestToken(c)
+		if e != nil {
+			return c.JSON(e.Code, e)
 		}
 
-		//check if the API Key exist
-		k := fmt.Sprintf(a.Redis.GetConfig().APIKey, service)
-		cipherKey, err := a.Redis.FindString(k)
-		if err != nil || cipherKey == "" {
-			return c.JSON(http.StatusForbidden, &ErrContent{http.StatusForbidden, fmt.Sprintf(ServiceNotRegistered, service)})
+		tkObj, e := a.validateSession(token, service)
+		if e != nil {
+			return c.JSON(e.Code, e)
+		}
+		if machineToken(tkObj) {
+			return c.JSON(http.StatusUnauthorized, &ErrContent{http.StatusUnauthorized, MachineTokenRejected})
 		}
 
-		//If found:
-		// 1 - VALIDATE TOKEN
-		tkObj, err := a.Secure.ValidateToken(token, cipherKey)
-		if err != nil {
-			return c.JSON(http.StatusUnauthorized, &ErrContent{http.StatusUnauthorized, err.Error()})
+		return c.NoContent(http.StatusOK)
+	}
+}
+
+// Handler to Logout, revokes the session of the Token
+func (a *API) Logout() echo.HandlerFunc {
+	return func(c echo.Context) error {
+
+		token, service, e := a.requestToken(c)
+		if e != nil {
+			return c.JSON(e.Code, e)
 		}
 
-		//Validate data consistency
-		if tkObj.Service != service {
-			return c.JSON(http.StatusForbidden, &ErrContent{http.StatusForbidden, fmt.Sprintf(TokenInvalid)})
+		tkObj, e := a.validateSession(token, service)
+		if e != nil {
+			return c.JSON(e.Code, e)
 		}
 
-		//2 - Refresh the TTL in Redis
+		// 1 - DELETE THE SESSION FROM REDIS
 		key := fmt.Sprintf(a.Redis.GetConfig().TokenKey, tkObj.Username, service, token)
-		err = a.Redis.CreateKey(key, tkObj)
-		if err != nil {
+		if err := a.Redis.DeleteKey(key); err != nil {
 			return c.JSON(http.StatusInternalServerError, &ErrContent{http.StatusInternalServerError, err.Error()})
 		}
 
+		// 2 - REVOKE THE REFRESH TOKENS OF THE SESSION
+		if f := a.Redis.GetConfig().RefreshFamilyKey; f != "" && tkObj.Session != "" {
+			if err := a.Redis.DeleteKey(fmt.Sprintf(f, tkObj.Username, service, tkObj.Session)); err != nil {
+				return c.JSON(http.StatusInternalServerError, &ErrContent{http.StatusInternalServerError, err.Error()})
+			}
+		}
+
+		// 3 - REMOVE THE BROWSER SESSION COOKIES
+		if a.cookieValue(c, service, "") != "" {
+			a.clearSessionCookies(c, service)
+		}
+
 		return c.NoContent(http.StatusOK)
 	}
 }
 
+// Retrieves the Token and the service calling from the request headers.
+// Browser sessions send the Token in the cookie of the service, guarded by the CSRF check.
+func (a *API) requestToken(c echo.Context) (string, string, *ErrContent) {
+
+	token := c.Request().Header.Get(echo.HeaderAuthorization)
+	service := c.Request().Header.Get(HeaderService)
+
+	if token == "" && service != "" {
+		if token = a.cookieValue(c, service, ""); token != "" {
+			if e := a.checkCSRF(c, service); e != nil {
+				return "", "", e
+			}
+		}
+	}
+
+	if token == "" {
+		return "", "", &ErrContent{http.StatusBadRequest, fmt.Sprintf(IsEmpty, echo.HeaderAuthorization)}
+	}
+	if service == "" {
+		return "", "", &ErrContent{http.StatusBadRequest, fmt.Sprintf(IsEmpty, HeaderService)}
+	}
+
+	return token, service, nil
+}
+
+// Validates the Token of the service and refreshes the TTL of its session.
+// A Token whose session was revoked is not valid anymore.
+func (a *API) validateSession(token string, service string) (*sec.TokenClaims, *ErrContent) {
+
+	//check if the API Key exist
+	k := fmt.Sprintf(a.Redis.GetConfig().APIKey, service)
+	cipherKey, err := a.Redis.FindString(k)
+	if err != nil || cipherKey == "" {
+		return nil, &ErrContent{http.StatusForbidden, fmt.Sprintf(ServiceNotRegistered, service)}
+	}
+
+	//If found:
+	// 1 - VALIDATE TOKEN
+	tkObj, err := a.Secure.ValidateToken(token, cipherKey)
+	if err != nil {
+		return nil, &ErrContent{http.StatusUnauthorized, err.Error()}
+	}
+
+	//Validate data consistency
+	if tkObj.Service != service {
+		return nil, &ErrContent{http.StatusForbidden, fmt.Sprintf(TokenInvalid)}
+	}
+
+	//2 - Refresh the TTL in Redis, the session must still exist
+	key := fmt.Sprintf(a.Redis.GetConfig().TokenKey, tkObj.Username, service, token)
+	found, err := a.Redis.ExpireKey(key, a.Redis.GetConfig().TTL)
+	if err != nil {
+		return nil, &ErrContent{http.StatusInternalServerError, err.Error()}
+	}
+	if !found {
+		return nil, &ErrContent{http.StatusUnauthorized, SessionRevoked}
+	}
+
+	return tkObj, nil
+}
+
 // Handler to Authenticate
 func (a *API) Authenticate() echo.HandlerFunc {
 	return func(c echo.Context) error {
@@ -117,7 +225,17 @@ func (a *API) Authenticate() echo.HandlerFunc {
 		if o.Service == "" {
 			return c.JSON(http.StatusBadRequest, &ErrContent{http.StatusBadRequest, fmt.Sprintf(IsEmpty, "service")})
 		}
-		if len(o.Groups) == 0 {
+
+		// The registered services check their own groups and roles
+		svc, e := a.findService(o.Service)
+		if e != nil {
+			return c.JSON(e.Code, e)
+		}
+		groups := o.Groups
+		if len(groups) == 0 && svc != nil {
+			groups = svc.Groups
+		}
+		if len(groups) == 0 && (svc == nil || !svc.ChecksGroups()) {
 			return c.JSON(http.StatusBadRequest, &ErrContent{http.StatusBadRequest, fmt.Sprintf(IsEmpty, "groups")})
 		}
 
@@ -128,52 +246,135 @@ func (a *API) Authenticate() echo.HandlerFunc {
 			return c.JSON(http.StatusForbidden, &ErrContent{http.StatusForbidden, fmt.Sprintf(ServiceNotRegistered, o.Service)})
 		}
 
-		r := new(strut.AuthenticateResponse)
-
-		// Error Connecting to LDAP server
-		if err := a.Ldap.Connect(); err != nil {
-			return c.JSON(http.StatusInternalServerError, &ErrContent{http.StatusInternalServerError, err.Error()})
+		user, userGroups, l := a.ldapLogin(c, o.Username, o.Realm, o.Password)
+		if l != nil {
+			return c.JSON(l.Code, l)
+		}
+		gr, roles, d := a.authorizeGroups(groups, svc, userGroups)
+		if d != nil {
+			return c.JSON(d.Code, d)
 		}
 
-		// Error performing user authentication
-		name, err := a.Ldap.Authenticate(o.Username, o.Password)
-		if err != nil {
-			return c.JSON(http.StatusForbidden, &ErrContent{http.StatusInternalServerError, err.Error()})
+		r, e := a.createSession(&sec.TokenClaims{Username: user.Username, Service: o.Service, Groups: gr, Roles: roles, Name: user.Name, Email: user.Email, Realm: user.Realm, Claims: user.Claims}, cipherKey)
+		if e != nil {
+			return c.JSON(e.Code, e)
 		}
-		// Close LDAP connection
-		defer a.Ldap.Close()
 
-		groups, err := a.Ldap.GetGroupsOfUser(o.Username)
-		// Error retrieving user groups
-		if err != nil {
-			return c.JSON(http.StatusInternalServerError, &ErrContent{http.StatusInternalServerError, ErrorGroups})
+		// BROWSER SESSIONS KEEP THE TOKENS IN COOKIES
+		if svc != nil && svc.Cookie {
+			if err := a.cookieResponse(c, o.Service, r); err != nil {
+				return c.JSON(http.StatusInternalServerError, &ErrContent{http.StatusInternalServerError, err.Error()})
+			}
 		}
 
-		// Validate if any of the user groups passed in the request exist the LDAP user groups
-		gr := a.validateGroups(o.Groups, groups)
+		return c.JSON(http.StatusOK, r)
+	}
+}
 
-		// User doesn't belong to any group
-		if len(gr) == 0 {
-			return c.JSON(http.StatusForbidden, &ErrContent{http.StatusForbidden, ErrorUserNotInGroups})
-		}
+// Authenticates the user in the LDAP of its realm and returns its entry and every group it belongs to.
+// The username of the entry is qualified with the realm outside the default realm.
+func (a *API) ldapLogin(c echo.Context, login string, realm string, password string) (*ldap.User, map[string]string, *ErrLogin) {
 
-		// 1 - GENERATE TOKEN
-		tkObj := &sec.TokenClaims{Username: o.Username, Service: o.Service, Groups: gr, Name: name}
-		tokenString, err := a.Secure.CreateToken(tkObj, cipherKey)
-		if err != nil {
-			return c.JSON(http.StatusInternalServerError, &ErrContent{http.StatusInternalServerError, err.Error()})
+	realm, username, err := a.Ldap.Realm(login, realm)
+	if err != nil {
+		return nil, nil, &ErrLogin{http.StatusBadRequest, err.Error(), ""}
+	}
+
+	// Error Connecting to LDAP server
+	s, err := a.Ldap.Session(realm)
+	if err != nil {
+		return nil, nil, loginError(err, http.StatusInternalServerError, "")
+	}
+	// Give the LDAP connection back to the pool
+	defer s.Close()
+
+	// Error performing user authentication, the failures of the directory have their own code
+	user, err := s.Authenticate(username, password)
+	if err != nil {
+		// the logs keep the code of the directory that the response of an unknown user hides
+		c.Logger().Warnj(log.JSON{"message": err.Error(), "username": login, "code": directoryCode(err)})
+		return nil, nil, loginError(err, http.StatusForbidden, LoginFailed)
+	}
+
+	userGroups, err := s.GetGroupsOfUser(username)
+	// Error retrieving user groups
+	if err != nil {
+		if e := loginError(err, http.StatusInternalServerError, ""); e.ErrorCode == ldap.CodeDirectoryUnavailable {
+			return nil, nil, e
 		}
-		r.Token = tokenString
+		return nil, nil, &ErrLogin{http.StatusInternalServerError, ErrorGroups, ""}
+	}
+
+	// Cache every group of the user for the token exchange
+	if err := a.cacheUser(user, userGroups); err != nil {
+		return nil, nil, &ErrLogin{http.StatusInternalServerError, err.Error(), ""}
+	}
+
+	return user, userGroups, nil
+}
+
+// Returns the groups, of the given ones, the user belongs to and the roles its groups grant in the service.
+// The user must meet the requirement of the service, without one it must belong to any of the groups or have a role.
+func (a *API) authorizeGroups(groups []string, svc *redis.Service, userGroups map[string]string) ([]string, []string, *ErrDenied) {
+
+	// Validate if any of the user groups passed in the request exist the LDAP user groups
+	gr := a.validateGroups(groups, userGroups)
+	roles := make([]string, 0)
+	if svc != nil {
+		roles = svc.RolesOf(userGroups)
+	}
 
-		// 2 - ADD TO REDIS
-		key := fmt.Sprintf(a.Redis.GetConfig().TokenKey, o.Username, o.Service, tokenString)
-		err = a.Redis.CreateKey(key, tkObj)
+	if svc != nil && svc.Require != "" {
+		req, err := policy.Parse(svc.Require)
 		if err != nil {
-			return c.JSON(http.StatusInternalServerError, &ErrContent{http.StatusInternalServerError, err.Error()})
+			return nil, nil, &ErrDenied{Code: http.StatusInternalServerError, Message: err.Error()}
+		}
+		if r := policy.Evaluate(req, userGroups); r != nil {
+			return nil, nil, &ErrDenied{Code: http.StatusForbidden, Message: RequirementNotMet, Reason: r}
 		}
+		return gr, roles, nil
+	}
 
-		return c.JSON(http.StatusOK, r)
+	// User doesn't belong to any group
+	if len(gr) == 0 && len(roles) == 0 {
+		return nil, nil, &ErrDenied{Code: http.StatusForbidden, Message: ErrorUserNotInGroups}
+	}
+
+	return gr, roles, nil
+}
+
+// Creates a new session for the token claims, signs the Token and the refresh token when enabled
+func (a *API) createSession(tkObj *sec.TokenClaims, cipherKey string) (*strut.AuthenticateResponse, *ErrContent) {
+
+	session, err := randomString(16)
+	if err != nil {
+		return nil, &ErrContent{http.StatusInternalServerError, err.Error()}
+	}
+	tkObj.Session = session
+
+	r := new(strut.AuthenticateResponse)
+
+	// 1 - GENERATE TOKEN
+	tokenString, err := a.Secure.CreateToken(tkObj, cipherKey)
+	if err != nil {
+		return nil, &ErrContent{http.StatusInternalServerError, err.Error()}
 	}
+	r.Token = tokenString
+
+	// 2 - ADD TO REDIS
+	key := fmt.Sprintf(a.Redis.GetConfig().TokenKey, tkObj.Username, tkObj.Service, tokenString)
+	if err := a.Redis.CreateKey(key, tkObj); err != nil {
+		return nil, &ErrContent{http.StatusInternalServerError, err.Error()}
+	}
+
+	// 3 - GENERATE REFRESH TOKEN
+	if a.Redis.GetConfig().RefreshKey != "" {
+		if r.RefreshToken, err = a.createRefreshToken(tkObj); err != nil {
+			return nil, &ErrContent{http.StatusInternalServerError, err.Error()}
+		}
+	}
+
+	return r, nil
 }
 
 // Validate if any of the user groups passed in the request exist the LDAP user groups
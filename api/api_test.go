@@ -2,15 +2,21 @@ package api
 
 import (
 	"encoding/json"
+	"fmt"
+	"github.com/dgrijalva/jwt-go"
 	"github.com/labstack/echo"
 	apis "github.com/pintobikez/authentication-service/api/structures"
 	strut "github.com/pintobikez/authentication-service/config/structures"
 	"github.com/pintobikez/authentication-service/ldap"
 	"github.com/pintobikez/authentication-service/mocks"
+	"github.com/pintobikez/authentication-service/redis"
+	. "github.com/pintobikez/authentication-service/secure/structures"
 	"github.com/stretchr/testify/assert"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
 	"strings"
+	"sync"
 	"testing"
 )
 
@@ -56,7 +62,9 @@ var testValidateProvider = []validateProvider{
 	{echo.POST, "/validate", "", "T", "T", http.StatusForbidden},               // validate token error
 	{echo.POST, "/validate", "keyc", "V", "V", http.StatusInternalServerError}, // error creating key in redis
 	{echo.POST, "/validate", "apit", "T", "V", http.StatusForbidden},           // API Key not found
+	{echo.POST, "/validate", "revk", "T", "V", http.StatusUnauthorized},        // session revoked
 	{echo.POST, "/validate", "", "T", "V", http.StatusOK},                      // OK
+	{echo.POST, "/validate", "mach", "T", "V", http.StatusUnauthorized},        // token of the client credentials
 }
 
 /*
@@ -87,6 +95,13 @@ func TestValidate(t *testing.T) {
 		if pair.erro == "token" {
 			s.Iserror = true
 		}
+		if pair.erro != "revk" {
+			r.CreateKey(fmt.Sprintf(r.GetConfig().TokenKey, "V", pair.service, pair.token), nil)
+		}
+		if pair.erro == "mach" {
+			s.Claims = &TokenClaims{Username: "service:V", Service: "V", Session: "S", Scope: "read"}
+			r.CreateKey(fmt.Sprintf(r.GetConfig().TokenKey, "service:V", pair.service, pair.token), nil)
+		}
 
 		// Setup
 		e := echo.New()
@@ -94,12 +109,46 @@ func TestValidate(t *testing.T) {
 		rec := httptest.NewRecorder()
 		req := httptest.NewRequest(pair.method, pair.value, nil)
 		req.Header.Set("Authorization", pair.token)
-		req.Header.Set("AuthorizationRequestBy", pair.service)
+		req.Header.Set(HeaderService, pair.service)
 
 		e.ServeHTTP(rec, req)
 		// Assertions
-		assert.Equal(t, rec.Code, pair.result)
+		assert.Equal(t, pair.result, rec.Code, pair.erro)
+	}
+}
+
+/*
+Tests for Logout method
+*/
+func TestLogout(t *testing.T) {
+
+	r := new(mocks.ClientRedisTest)
+	a := API{Secure: new(mocks.ClientTokenManagerTest), Redis: r, Ldap: new(mocks.ClientLdapTest)}
+	e := echo.New()
+	e.POST("/validate", a.Validate())
+	e.POST("/logout", a.Logout())
+
+	call := func(path string, token string) int {
+		rec := httptest.NewRecorder()
+		req := httptest.NewRequest(echo.POST, path, nil)
+		req.Header.Set(echo.HeaderAuthorization, token)
+		req.Header.Set(HeaderService, "V")
+		e.ServeHTTP(rec, req)
+		return rec.Code
 	}
+
+	r.CreateKey(fmt.Sprintf(r.GetConfig().TokenKey, "V", "V", "T"), nil)
+	r.SwapString(fmt.Sprintf(r.GetConfig().RefreshFamilyKey, "V", "V", "S"), "", "R", 60)
+
+	assert.Equal(t, http.StatusBadRequest, call("/logout", ""))
+	assert.Equal(t, http.StatusOK, call("/validate", "T"))
+	assert.Equal(t, http.StatusOK, call("/logout", "T"))
+
+	// the session is revoked and can't be used again
+	assert.Equal(t, http.StatusUnauthorized, call("/validate", "T"))
+	assert.Equal(t, http.StatusUnauthorized, call("/logout", "T"))
+	_, exists := r.Store[fmt.Sprintf(r.GetConfig().RefreshFamilyKey, "V", "V", "S")]
+	assert.False(t, exists)
 }
 
 /*
@@ -164,6 +213,171 @@ func TestAuthenticate(t *testing.T) {
 		e.ServeHTTP(rec, req)
 		// Assertions
 		assert.Equal(t, pair.result, rec.Code)
+		if rec.Code == http.StatusOK {
+			// the session keeps the claims mapped from LDAP
+			tkObj := new(TokenClaims)
+			found, _ := r.FindObject(fmt.Sprintf(r.GetConfig().TokenKey, "A", "A", "cryptoText"), tkObj)
+			assert.True(t, found)
+			assert.Equal(t, map[string]interface{}{"department": "IT"}, tkObj.Claims)
+		}
+	}
+}
+
+/*
+Data Provider for the roles of the registered services
+*/
+type rolesProvider struct {
+	json   string
+	result int
+	groups []string
+	roles  []string
+	unmet  []string
+}
+
+var testRolesProvider = []rolesProvider{
+	{`{"username":"A","password":"A","service":"N"}`, http.StatusBadRequest, nil, nil, nil},                        // service not registered without groups
+	{`{"username":"A","password":"A","service":"G"}`, http.StatusOK, []string{"A"}, nil, nil},                      // groups of the registration
+	{`{"username":"A","password":"A","service":"R"}`, http.StatusOK, []string{}, []string{"admin", "viewer"}, nil}, // roles of the groups
+	{`{"username":"E","password":"A","service":"R"}`, http.StatusOK, []string{}, []string{"viewer"}, nil},          // role of one group
+	{`{"username":"A","password":"A","service":"R","groups":["A"]}`, http.StatusOK, []string{"A"}, []string{"admin", "viewer"}, nil},
+	{`{"username":"A","password":"A","service":"S"}`, http.StatusForbidden, nil, nil, nil},                    // no role
+	{`{"username":"A","password":"A","service":"Q"}`, http.StatusOK, []string{}, nil, nil},                    // requirement met
+	{`{"username":"E","password":"A","service":"Q"}`, http.StatusForbidden, nil, nil, []string{"A", "NOT B"}}, // requirement not met
+	{`{"username":"A","password":"A","service":"I"}`, http.StatusInternalServerError, nil, nil, nil},          // invalid requirement
+}
+
+/*
+Tests for the roles of the registered services at the login
+*/
+func TestAuthenticateRoles(t *testing.T) {
+
+	for _, pair := range testRolesProvider {
+
+		r := &mocks.ClientRedisTest{Services: map[string]*redis.Service{
+			"G": {Name: "G", Groups: []string{"A"}},
+			"R": {Name: "R", Roles: map[string][]string{"admin": {"a"}, "viewer": {"A", "B"}}},
+			"S": {Name: "S", Roles: map[string][]string{"admin": {"B"}}},
+			"Q": {Name: "Q", Require: "A AND NOT B"},
+			"I": {Name: "I", Require: "A AND"},
+		}}
+		a := API{Secure: new(mocks.ClientTokenManagerTest), Redis: r, Ldap: new(mocks.ClientLdapTest)}
+
+		// Setup
+		e := echo.New()
+		e.POST("/authenticate", a.Authenticate())
+		rec := httptest.NewRecorder()
+		req := httptest.NewRequest(echo.POST, "/authenticate", strings.NewReader(pair.json))
+		req.Header.Set("Content-Type", "application/json")
+
+		e.ServeHTTP(rec, req)
+		// Assertions
+		assert.Equal(t, pair.result, rec.Code)
+		if rec.Code == http.StatusOK {
+			o := new(apis.AuthenticateRequest)
+			_ = json.Unmarshal([]byte(pair.json), o)
+			tkObj := new(TokenClaims)
+			found, _ := r.FindObject(fmt.Sprintf(r.GetConfig().TokenKey, o.Username, o.Service, "cryptoText"), tkObj)
+			assert.True(t, found)
+			assert.Equal(t, pair.groups, tkObj.Groups)
+			assert.Equal(t, pair.roles, tkObj.Roles)
+		}
+		if pair.unmet != nil {
+			// the unmet parts of the requirement are returned
+			val := new(ErrDenied)
+			_ = json.Unmarshal(rec.Body.Bytes(), val)
+			assert.Equal(t, RequirementNotMet, val.Message)
+			assert.Equal(t, pair.unmet, val.Reason.Unmet)
+		}
+	}
+}
+
+/*
+Data Provider for the typed failures of the login
+*/
+type loginErrorProvider struct {
+	username string
+	result   int
+	code     string
+	message  string
+}
+
+var testLoginErrorProvider = []loginErrorProvider{
+	{"W", http.StatusUnauthorized, ldap.CodeInvalidCredentials, InvalidCredentials},           // wrong password
+	{"N", http.StatusUnauthorized, ldap.CodeInvalidCredentials, InvalidCredentials},           // unknown user, like a wrong password
+	{"L", http.StatusForbidden, ldap.CodeAccountLocked, AccountLocked},                        // account locked
+	{"U", http.StatusServiceUnavailable, ldap.CodeDirectoryUnavailable, DirectoryUnavailable}, // directory unavailable
+	{"B", http.StatusForbidden, LoginFailed, "Error Auth"},                                    // other failures of the directory
+}
+
+/*
+Tests for the codes of the failed logins
+*/
+func TestAuthenticateErrors(t *testing.T) {
+
+	for _, pair := range testLoginErrorProvider {
+		a := API{Secure: new(mocks.ClientTokenManagerTest), Redis: new(mocks.ClientRedisTest), Ldap: new(mocks.ClientLdapTest)}
+
+		// Setup
+		e := echo.New()
+		e.POST("/authenticate", a.Authenticate())
+		rec := httptest.NewRecorder()
+		req := httptest.NewRequest(echo.POST, "/authenticate", strings.NewReader(`{"username":"`+pair.username+`","password":"A","service":"A","groups":["A"]}`))
+		req.Header.Set("Content-Type", "application/json")
+
+		e.ServeHTTP(rec, req)
+		// Assertions
+		assert.Equal(t, pair.result, rec.Code, pair.username)
+		val := new(ErrLogin)
+		_ = json.Unmarshal(rec.Body.Bytes(), val)
+		assert.Equal(t, &ErrLogin{pair.result, pair.message, pair.code}, val)
+	}
+}
+
+/*
+Data Provider for the logins of the realms
+*/
+type realmProvider struct {
+	json     string
+	result   int
+	username string
+	realm    string
+}
+
+var testRealmProvider = []realmProvider{
+	{`{"username":"A","password":"A","service":"A","groups":["A"]}`, http.StatusOK, "A", ""},                         // default realm
+	{`{"username":"ACME\\A","password":"A","service":"A","groups":["A"]}`, http.StatusOK, "A@ACME", "ACME"},          // domain prefix
+	{`{"username":"A@acme.local","password":"A","service":"A","groups":["A"]}`, http.StatusOK, "A@ACME", "ACME"},     // domain suffix
+	{`{"username":"A","password":"A","service":"A","groups":["A"],"realm":"acme"}`, http.StatusOK, "A@ACME", "ACME"}, // explicit realm
+	{`{"username":"A@other.local","password":"A","service":"A","groups":["A"]}`, http.StatusOK, "A@other.local", ""}, // other domains are left to the default realm
+	{`{"username":"A","password":"A","service":"A","groups":["A"],"realm":"other"}`, http.StatusBadRequest, "", ""},  // unknown realm
+}
+
+/*
+Tests for the realm in the claims and the session key
+*/
+func TestAuthenticateRealm(t *testing.T) {
+
+	for _, pair := range testRealmProvider {
+		r := new(mocks.ClientRedisTest)
+		a := API{Secure: new(mocks.ClientTokenManagerTest), Redis: r, Ldap: new(mocks.ClientLdapTest)}
+
+		// Setup
+		e := echo.New()
+		e.POST("/authenticate", a.Authenticate())
+		rec := httptest.NewRecorder()
+		req := httptest.NewRequest(echo.POST, "/authenticate", strings.NewReader(pair.json))
+		req.Header.Set("Content-Type", "application/json")
+
+		e.ServeHTTP(rec, req)
+		// Assertions
+		assert.Equal(t, pair.result, rec.Code, pair.json)
+		if rec.Code == http.StatusOK {
+			tkObj := new(TokenClaims)
+			found, _ := r.FindObject(fmt.Sprintf(r.GetConfig().TokenKey, pair.username, "A", "cryptoText"), tkObj)
+			assert.True(t, found, pair.json)
+			assert.Equal(t, pair.username, tkObj.Username)
+			assert.Equal(t, pair.realm, tkObj.Realm)
+		}
 	}
 }
 
@@ -225,6 +439,11 @@ func TestHealth(t *testing.T) {
 		switch pair.erro {
 		case "ldap":
 			assert.Equal(t, val.Ldap.Status, StatusUnavailable)
+			// the status of each server
+			assert.Equal(t, []*apis.HealthServerDetail{
+				{Address: "dc1:389", Status: StatusUnavailable, Failures: 2, Reason: ldap.ReasonUnknownAuthority, Detail: "Error LDAP Health"},
+				{Address: "dc2:389", Status: StatusAvailable},
+			}, val.Ldap.Servers)
 			break
 		case "redis":
 			assert.Equal(t, val.Redis.Status, StatusUnavailable)
@@ -235,3 +454,1236 @@ func TestHealth(t *testing.T) {
 		}
 	}
 }
+
+/*
+Data Provider for RefreshToken method
+*/
+type refreshProvider struct {
+	erro   string
+	json   string
+	result int
+}
+
+var testRefreshProvider = []refreshProvider{
+	{"", "", http.StatusBadRequest},                                                // invalid json
+	{"", `{"service":"A"}`, http.StatusBadRequest},                                 // no refresh token in json
+	{"", `{"refreshToken":"A"}`, http.StatusBadRequest},                            // no service in json
+	{"apit", `{"refreshToken":"A","service":"A"}`, http.StatusForbidden},           // API Key not found
+	{"", `{"refreshToken":"A","service":"A"}`, http.StatusUnauthorized},            // refresh token not found
+	{"rdis", `{"refreshToken":"A","service":"A"}`, http.StatusUnauthorized},        // error finding refresh token
+	{"sec", `{"refreshToken":"%s","service":"A"}`, http.StatusInternalServerError}, // error creating token
+	{"", `{"refreshToken":"%s","service":"B"}`, http.StatusUnauthorized},           // refresh token of another service
+	{"", `{"refreshToken":"%s","service":"A"}`, http.StatusOK},                     // OK
+}
+
+/*
+Tests for RefreshToken method
+*/
+func TestRefreshToken(t *testing.T) {
+
+	for _, pair := range testRefreshProvider {
+
+		// API SETUP
+		l := new(mocks.ClientLdapTest)
+		r := new(mocks.ClientRedisTest)
+		s := new(mocks.ClientTokenManagerTest)
+		a := API{Secure: s, Redis: r, Ldap: l}
+
+		// issue a refresh token for the service A
+		rt, _ := a.createRefreshToken(&TokenClaims{Username: "A", Service: "A", Session: "S"})
+
+		switch pair.erro {
+		case "apit":
+			r.IserrorAPI = true
+		case "rdis":
+			r.Iserror = true
+		case "sec":
+			s.Iserror = true
+		}
+
+		body := pair.json
+		if strings.Contains(body, "%s") {
+			body = fmt.Sprintf(body, rt)
+		}
+
+		// Setup
+		e := echo.New()
+		e.POST("/token/refresh", a.RefreshToken())
+		rec := httptest.NewRecorder()
+		req := httptest.NewRequest(echo.POST, "/token/refresh", strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+
+		e.ServeHTTP(rec, req)
+		// Assertions
+		assert.Equal(t, pair.result, rec.Code)
+	}
+}
+
+/*
+Tests for the reuse detection of the RefreshToken method
+*/
+func TestRefreshTokenReuse(t *testing.T) {
+
+	r := new(mocks.ClientRedisTest)
+	a := API{Secure: new(mocks.ClientTokenManagerTest), Redis: r, Ldap: new(mocks.ClientLdapTest)}
+	e := echo.New()
+	e.POST("/authenticate", a.Authenticate())
+	e.POST("/token/refresh", a.RefreshToken())
+	e.POST("/validate", a.Validate())
+
+	// the tokens of the mock are validated as the ones of the user V in the service V
+	refresh := func(token string) (int, *apis.AuthenticateResponse, string) {
+		rec := httptest.NewRecorder()
+		req := httptest.NewRequest(echo.POST, "/token/refresh", strings.NewReader(`{"refreshToken":"`+token+`","service":"V"}`))
+		req.Header.Set("Content-Type", "application/json")
+		e.ServeHTTP(rec, req)
+		val, err := new(apis.AuthenticateResponse), new(ErrContent)
+		_ = json.Unmarshal(rec.Body.Bytes(), val)
+		_ = json.Unmarshal(rec.Body.Bytes(), err)
+		return rec.Code, val, err.Message
+	}
+	validate := func(token string) int {
+		rec := httptest.NewRecorder()
+		req := httptest.NewRequest(echo.POST, "/validate", nil)
+		req.Header.Set("Authorization", token)
+		req.Header.Set(HeaderService, "V")
+		e.ServeHTTP(rec, req)
+		return rec.Code
+	}
+
+	rec := httptest.NewRecorder()
+	req := httptest.NewRequest(echo.POST, "/authenticate", strings.NewReader(`{"username":"V","password":"A","service":"V", "groups":["A"]}`))
+	req.Header.Set("Content-Type", "application/json")
+	e.ServeHTTP(rec, req)
+	login := new(apis.AuthenticateResponse)
+	_ = json.Unmarshal(rec.Body.Bytes(), login)
+	assert.NotEmpty(t, login.RefreshToken)
+
+	// rotation issues a new refresh token
+	code, first, _ := refresh(login.RefreshToken)
+	assert.Equal(t, http.StatusOK, code)
+	assert.NotEqual(t, login.RefreshToken, first.RefreshToken)
+
+	code, second, _ := refresh(first.RefreshToken)
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, http.StatusOK, validate(second.Token))
+
+	// reusing a rotated token revokes the session and its access tokens
+	code, _, msg := refresh(first.RefreshToken)
+	assert.Equal(t, http.StatusUnauthorized, code)
+	assert.Equal(t, RefreshTokenReused, msg)
+	assert.Equal(t, http.StatusUnauthorized, validate(second.Token))
+	code, _, msg = refresh(second.RefreshToken)
+	assert.Equal(t, http.StatusUnauthorized, code)
+	assert.Equal(t, RefreshTokenInvalid, msg)
+
+	// the reuse is detected when the family moved on before the used token was marked rotated
+	rec = httptest.NewRecorder()
+	req = httptest.NewRequest(echo.POST, "/authenticate", strings.NewReader(`{"username":"V","password":"A","service":"V", "groups":["A"]}`))
+	req.Header.Set("Content-Type", "application/json")
+	e.ServeHTTP(rec, req)
+	_ = json.Unmarshal(rec.Body.Bytes(), login)
+	code, first, _ = refresh(login.RefreshToken)
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, http.StatusOK, validate(first.Token))
+	rt := new(RefreshToken)
+	key := fmt.Sprintf(r.GetConfig().RefreshKey, hashToken(login.RefreshToken))
+	_, _ = r.FindObject(key, rt)
+	assert.True(t, rt.Rotated)
+	rt.Rotated = false
+	_ = r.CreateObject(key, rt, 60)
+	code, _, msg = refresh(login.RefreshToken)
+	assert.Equal(t, http.StatusUnauthorized, code)
+	assert.Equal(t, RefreshTokenReused, msg)
+	assert.Equal(t, http.StatusUnauthorized, validate(first.Token))
+
+	// the session isn't reported as revoked when it can't be deleted
+	rec = httptest.NewRecorder()
+	req = httptest.NewRequest(echo.POST, "/authenticate", strings.NewReader(`{"username":"V","password":"A","service":"V", "groups":["A"]}`))
+	req.Header.Set("Content-Type", "application/json")
+	e.ServeHTTP(rec, req)
+	_ = json.Unmarshal(rec.Body.Bytes(), login)
+	refresh(login.RefreshToken)
+	r.IserrorDelete = true
+	rec = httptest.NewRecorder()
+	req = httptest.NewRequest(echo.POST, "/token/refresh", strings.NewReader(`{"refreshToken":"`+login.RefreshToken+`","service":"V"}`))
+	req.Header.Set("Content-Type", "application/json")
+	e.ServeHTTP(rec, req)
+	val := new(ErrContent)
+	_ = json.Unmarshal(rec.Body.Bytes(), val)
+	assert.Equal(t, http.StatusUnauthorized, rec.Code)
+	assert.Equal(t, "error deleting keys", val.Message)
+}
+
+/*
+Data Provider for RevokeSessions method
+*/
+type revokeProvider struct {
+	key     string
+	value   string
+	erro    string
+	result  int
+	removed int
+}
+
+var testRevokeProvider = []revokeProvider{
+	{"", "/admin/sessions/A", "", http.StatusForbidden, 0},                 // no admin key
+	{"B", "/admin/sessions/A", "", http.StatusForbidden, 0},                // invalid admin key
+	{"K", "/admin/sessions/A", "rdis", http.StatusInternalServerError, 0},  // error deleting in redis
+	{"K", "/admin/sessions/A", "", http.StatusOK, 2},                       // OK every service
+	{"K", "/admin/sessions/A?service=S1", "", http.StatusOK, 1},            // OK one service
+	{"K", "/admin/sessions/C", "", http.StatusOK, 0},                       // OK no sessions
+	{"K", "/admin/sessions/A?realm=acme", "", http.StatusOK, 1},            // OK user of other realm
+	{"K", "/admin/sessions/ACME%5CA", "", http.StatusOK, 1},                // OK user named with the realm
+	{"K", "/admin/sessions/A@acme.local?service=S2", "", http.StatusOK, 0}, // OK no sessions in the service
+	{"K", "/admin/sessions/A?realm=other", "", http.StatusBadRequest, 0},   // unknown realm
+}
+
+/*
+Tests for RevokeSessions method
+*/
+func TestRevokeSessions(t *testing.T) {
+
+	for _, pair := range testRevokeProvider {
+
+		r := new(mocks.ClientRedisTest)
+		a := API{Secure: new(mocks.ClientTokenManagerTest), Redis: r, Ldap: new(mocks.ClientLdapTest)}
+
+		r.CreateKey(fmt.Sprintf(r.GetConfig().TokenKey, "A", "S1", "T1"), nil)
+		r.CreateKey(fmt.Sprintf(r.GetConfig().TokenKey, "A", "S2", "T2"), nil)
+		r.CreateKey(fmt.Sprintf(r.GetConfig().TokenKey, "B", "S1", "T3"), nil)
+		r.CreateKey(fmt.Sprintf(r.GetConfig().TokenKey, "A@ACME", "S1", "T4"), nil)
+		if pair.erro == "rdis" {
+			r.Iserror = true
+		}
+
+		// Setup
+		e := echo.New()
+		adm := e.Group("/admin", AdminAuth("K"))
+		adm.DELETE("/sessions/:username", a.RevokeSessions())
+		rec := httptest.NewRecorder()
+		req := httptest.NewRequest(echo.DELETE, pair.value, nil)
+		req.Header.Set(HeaderAdminKey, pair.key)
+
+		e.ServeHTTP(rec, req)
+		// Assertions
+		assert.Equal(t, pair.result, rec.Code, pair.value)
+		if rec.Code == http.StatusOK {
+			val := new(apis.RevokeResponse)
+			_ = json.Unmarshal(rec.Body.Bytes(), val)
+			assert.Equal(t, pair.removed, val.Removed, pair.value)
+		}
+	}
+}
+
+/*
+Data Provider for PasswordChange method
+*/
+type passwordChangeProvider struct {
+	json    string
+	erro    string
+	result  int
+	code    string
+	removed int
+}
+
+var testPasswordChangeProvider = []passwordChangeProvider{
+	{`{"username":"A","oldPassword":"A","newPassword":"N"`, "", http.StatusBadRequest, "", 0},                                     // invalid json
+	{`{"oldPassword":"A","newPassword":"N"}`, "", http.StatusBadRequest, "", 0},                                                   // no username
+	{`{"username":"A","newPassword":"N"}`, "", http.StatusBadRequest, "", 0},                                                      // no old password
+	{`{"username":"A","oldPassword":"A"}`, "", http.StatusBadRequest, "", 0},                                                      // no new password
+	{`{"username":"A","oldPassword":"A","newPassword":"N","realm":"other"}`, "", http.StatusBadRequest, "", 0},                    // unknown realm
+	{`{"username":"A","oldPassword":"A","newPassword":"N"}`, "ldap", http.StatusInternalServerError, "", 0},                       // error connecting to the directory
+	{`{"username":"W","oldPassword":"A","newPassword":"N"}`, "", http.StatusUnauthorized, ldap.CodeInvalidCredentials, 0},         // wrong old password
+	{`{"username":"U","oldPassword":"A","newPassword":"N"}`, "", http.StatusServiceUnavailable, ldap.CodeDirectoryUnavailable, 0}, // directory unavailable
+	{`{"username":"A","oldPassword":"A","newPassword":"weak"}`, "", http.StatusBadRequest, ldap.CodePasswordPolicy, 0},            // password policy
+	{`{"username":"B","oldPassword":"A","newPassword":"N"}`, "", http.StatusInternalServerError, "", 0},                           // other failures of the directory
+	{`{"username":"A","oldPassword":"A","newPassword":"N"}`, "rdis", http.StatusInternalServerError, "", 0},                       // error revoking the sessions
+	{`{"username":"A","oldPassword":"A","newPassword":"N"}`, "", http.StatusOK, "", 2},                                            // OK default realm
+	{`{"username":"ACME\\A","oldPassword":"A","newPassword":"N"}`, "", http.StatusOK, "", 1},                                      // OK other realm
+}
+
+/*
+Tests for PasswordChange method
+*/
+func TestPasswordChange(t *testing.T) {
+
+	for _, pair := range testPasswordChangeProvider {
+
+		r := new(mocks.ClientRedisTest)
+		a := API{Secure: new(mocks.ClientTokenManagerTest), Redis: r, Ldap: &mocks.ClientLdapTest{Iserror: pair.erro == "ldap"}}
+
+		r.CreateKey(fmt.Sprintf(r.GetConfig().TokenKey, "A", "S1", "T1"), nil)
+		r.CreateKey(fmt.Sprintf(r.GetConfig().TokenKey, "A", "S2", "T2"), nil)
+		r.CreateKey(fmt.Sprintf(r.GetConfig().TokenKey, "A@ACME", "S1", "T3"), nil)
+		if pair.erro == "rdis" {
+			r.Iserror = true
+		}
+
+		// Setup
+		e := echo.New()
+		e.POST("/password/change", a.PasswordChange())
+		rec := httptest.NewRecorder()
+		req := httptest.NewRequest(echo.POST, "/password/change", strings.NewReader(pair.json))
+		req.Header.Set("Content-Type", "application/json")
+
+		e.ServeHTTP(rec, req)
+		// Assertions
+		assert.Equal(t, pair.result, rec.Code, pair.json)
+		if rec.Code == http.StatusOK {
+			val := new(apis.RevokeResponse)
+			_ = json.Unmarshal(rec.Body.Bytes(), val)
+			assert.Equal(t, pair.removed, val.Removed, pair.json)
+			continue
+		}
+		val := new(ErrLogin)
+		_ = json.Unmarshal(rec.Body.Bytes(), val)
+		assert.Equal(t, pair.code, val.ErrorCode, pair.json)
+	}
+}
+
+/*
+Data Provider for the directory lookups
+*/
+type directoryProvider struct {
+	value     string
+	user      string
+	erro      string
+	result    int
+	group     string
+	users     []string
+	truncated bool
+}
+
+var testDirectoryProvider = []directoryProvider{
+	{"/directory/users/A", "", "", http.StatusUnauthorized, "", nil, false},                                                      // no credentials
+	{"/directory/users/A", "N", "", http.StatusForbidden, "", nil, false},                                                        // service without the directory permission
+	{"/directory/users/A", "X", "", http.StatusForbidden, "", nil, false},                                                        // service not registered
+	{"/directory/users/A", "D", "rdis", http.StatusInternalServerError, "", nil, false},                                          // error finding the service
+	{"/directory/users/A", "D", "ldap", http.StatusInternalServerError, "", nil, false},                                          // error connecting to the directory
+	{"/directory/users/A", "D", "", http.StatusOK, "", []string{"A"}, false},                                                     // OK
+	{"/directory/users/A?realm=acme", "D", "", http.StatusOK, "", []string{"A@ACME"}, false},                                     // OK other realm
+	{"/directory/users/A?realm=other", "D", "", http.StatusBadRequest, "", nil, false},                                           // unknown realm
+	{"/directory/users/Z", "D", "", http.StatusNotFound, "", nil, false},                                                         // user not found
+	{"/directory/users/U", "D", "", http.StatusServiceUnavailable, "", nil, false},                                               // directory unavailable
+	{"/directory/users/B", "D", "", http.StatusInternalServerError, "", nil, false},                                              // error looking up the user
+	{"/directory/users", "D", "", http.StatusBadRequest, "", nil, false},                                                         // no prefix
+	{"/directory/users?prefix=A", "D", "", http.StatusOK, "", []string{"A", "AB", "AC"}, false},                                  // OK search
+	{"/directory/users?prefix=A&limit=2", "D", "", http.StatusOK, "", []string{"A", "AB"}, true},                                 // OK search truncated
+	{"/directory/users?prefix=AB", "D", "", http.StatusOK, "", []string{"AB"}, false},                                            // OK search one user
+	{"/directory/users?prefix=A&limit=0", "D", "", http.StatusBadRequest, "", nil, false},                                        // limit too low
+	{"/directory/users?prefix=A&limit=1001", "D", "", http.StatusBadRequest, "", nil, false},                                     // limit too high
+	{"/directory/users?prefix=A&limit=x", "D", "", http.StatusBadRequest, "", nil, false},                                        // invalid limit
+	{"/directory/users?prefix=B", "D", "", http.StatusInternalServerError, "", nil, false},                                       // error searching the users
+	{"/directory/groups/dev/members", "D", "", http.StatusOK, "DEV", []string{"A", "E"}, false},                                  // OK members
+	{"/directory/groups/dev/members?limit=1", "D", "", http.StatusOK, "DEV", []string{"A"}, true},                                // OK members truncated
+	{"/directory/groups/dev/members?realm=acme", "D", "", http.StatusOK, "DEV", []string{"A@ACME", "E@ACME"}, false},             // OK members of other realm
+	{"/directory/groups/dev@acme.local/members", "D", "", http.StatusOK, "DEV@ACME.LOCAL", []string{"A", "E"}, false},            // OK group name not taken as a login
+	{"/directory/groups/ACME%5Cdev/members?realm=acme", "D", "", http.StatusOK, `ACME\DEV`, []string{"A@ACME", "E@ACME"}, false}, // OK group name with a backslash
+	{"/directory/groups/dev/members?realm=other", "D", "", http.StatusBadRequest, "", nil, false},                                // unknown realm
+	{"/directory/groups/Z/members", "D", "", http.StatusNotFound, "", nil, false},                                                // group not found
+	{"/directory/groups/U/members", "D", "", http.StatusServiceUnavailable, "", nil, false},                                      // directory unavailable
+}
+
+/*
+Tests for the directory lookups
+*/
+func TestDirectory(t *testing.T) {
+
+	for _, pair := range testDirectoryProvider {
+
+		r := &mocks.ClientRedisTest{Services: map[string]*redis.Service{"D": {Name: "D", Directory: true}, "N": {Name: "N"}}}
+		a := API{Secure: new(mocks.ClientTokenManagerTest), Redis: r, Ldap: &mocks.ClientLdapTest{Iserror: pair.erro == "ldap"}}
+		if pair.erro == "rdis" {
+			r.Iserror = true
+		}
+
+		// Setup
+		e := echo.New()
+		dir := e.Group("/directory", a.DirectoryAuth())
+		dir.GET("/users", a.DirectorySearch())
+		dir.GET("/users/:username", a.DirectoryUser())
+		dir.GET("/groups/:name/members", a.DirectoryGroupMembers())
+		rec := httptest.NewRecorder()
+		req := httptest.NewRequest(echo.GET, pair.value, nil)
+		if pair.user != "" {
+			req.SetBasicAuth(pair.user, "A12345")
+		}
+
+		e.ServeHTTP(rec, req)
+		// Assertions
+		assert.Equal(t, pair.result, rec.Code, pair.value)
+		if rec.Code != http.StatusOK {
+			continue
+		}
+		usernames := make([]string, 0)
+		if strings.HasPrefix(pair.value, "/directory/users/") {
+			val := new(apis.DirectoryUser)
+			_ = json.Unmarshal(rec.Body.Bytes(), val)
+			assert.Equal(t, "Name A", val.Name)
+			assert.Equal(t, map[string]interface{}{"department": "IT"}, val.Claims)
+			usernames = append(usernames, val.Username)
+		} else {
+			val := new(apis.DirectoryUsers)
+			_ = json.Unmarshal(rec.Body.Bytes(), val)
+			assert.Equal(t, pair.group, val.Group, pair.value)
+			assert.Equal(t, pair.truncated, val.Truncated, pair.value)
+			for _, u := range val.Users {
+				usernames = append(usernames, u.Username)
+			}
+		}
+		assert.Equal(t, pair.users, usernames, pair.value)
+	}
+}
+
+/*
+Data Provider for the ServiceRoles methods
+*/
+type serviceRolesProvider struct {
+	method string
+	value  string
+	json   string
+	erro   string
+	result int
+}
+
+var testServiceRolesProvider = []serviceRolesProvider{
+	{echo.GET, "/admin/services/B/roles", "", "", http.StatusNotFound},                                                  // service not registered
+	{echo.GET, "/admin/services/A/roles", "", "rdis", http.StatusInternalServerError},                                   // error finding the service
+	{echo.GET, "/admin/services/A/roles", "", "", http.StatusOK},                                                        // OK
+	{echo.PUT, "/admin/services/A/roles", `{"roles":{"admin":[]}}`, "", http.StatusBadRequest},                          // role without groups
+	{echo.PUT, "/admin/services/B/roles", `{"roles":{"admin":["APP-ADMINS"]}}`, "", http.StatusNotFound},                // service not registered
+	{echo.PUT, "/admin/services/A/roles", `{"roles":{"admin":["APP-ADMINS"]}}`, "keyc", http.StatusInternalServerError}, // error saving the service
+	{echo.PUT, "/admin/services/A/roles", `{"roles":{"admin":["APP-ADMINS","IT-OPS"]}}`, "", http.StatusOK},             // OK
+}
+
+/*
+Tests for the ServiceRoles methods
+*/
+func TestServiceRoles(t *testing.T) {
+
+	for _, pair := range testServiceRolesProvider {
+
+		r := &mocks.ClientRedisTest{Services: map[string]*redis.Service{
+			"A": {Name: "A", Groups: []string{"A"}, Roles: map[string][]string{"viewer": {"A"}}},
+		}}
+		switch pair.erro {
+		case "rdis":
+			r.Iserror = true
+		case "keyc":
+			r.IserrorCreate = true
+		}
+		a := API{Secure: new(mocks.ClientTokenManagerTest), Redis: r, Ldap: new(mocks.ClientLdapTest)}
+
+		// Setup
+		e := echo.New()
+		adm := e.Group("/admin", AdminAuth("K"))
+		adm.GET("/services/:service/roles", a.ServiceRoles())
+		adm.PUT("/services/:service/roles", a.SaveServiceRoles())
+		rec := httptest.NewRecorder()
+		req := httptest.NewRequest(pair.method, pair.value, strings.NewReader(pair.json))
+		req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+		req.Header.Set(HeaderAdminKey, "K")
+
+		e.ServeHTTP(rec, req)
+		// Assertions
+		assert.Equal(t, pair.result, rec.Code)
+		if rec.Code == http.StatusOK {
+			val := new(apis.ServiceRoles)
+			_ = json.Unmarshal(rec.Body.Bytes(), val)
+			assert.Equal(t, "A", val.Service)
+			if pair.method == echo.PUT {
+				assert.Equal(t, map[string][]string{"admin": {"APP-ADMINS", "IT-OPS"}}, val.Roles)
+				// the rest of the registration is kept
+				assert.Equal(t, []string{"A"}, r.Services["A"].Groups)
+				assert.Equal(t, val.Roles, r.Services["A"].Roles)
+			} else {
+				assert.Equal(t, map[string][]string{"viewer": {"A"}}, val.Roles)
+			}
+		}
+	}
+}
+
+/*
+Data Provider for Introspect method
+*/
+type introspectProvider struct {
+	erro    string
+	user    string
+	secret  string
+	token   string
+	session bool
+	result  int
+	active  bool
+}
+
+var testIntrospectProvider = []introspectProvider{
+	{"", "", "", "T", true, http.StatusUnauthorized, false},            // no credentials
+	{"", "V", "B", "T", true, http.StatusUnauthorized, false},          // invalid API key
+	{"apit", "V", "A12345", "T", true, http.StatusUnauthorized, false}, // service not registered
+	{"", "V", "A12345", "", true, http.StatusBadRequest, false},        // no token
+	{"token", "V", "A12345", "T", true, http.StatusOK, false},          // invalid token
+	{"", "A", "A12345", "T", true, http.StatusOK, false},               // token of another service
+	{"", "V", "A12345", "T", false, http.StatusOK, false},              // session revoked
+	{"", "V", "A12345", "T", true, http.StatusOK, true},                // OK
+}
+
+/*
+Tests for Introspect method
+*/
+func TestIntrospect(t *testing.T) {
+
+	for _, pair := range testIntrospectProvider {
+
+		r := new(mocks.ClientRedisTest)
+		s := new(mocks.ClientTokenManagerTest)
+		a := API{Secure: s, Redis: r, Ldap: new(mocks.ClientLdapTest)}
+
+		switch pair.erro {
+		case "apit":
+			r.IserrorAPI = true
+		case "token":
+			s.Iserror = true
+		}
+		if pair.session {
+			r.CreateKey(fmt.Sprintf(r.GetConfig().TokenKey, "V", "V", pair.token), nil)
+		}
+
+		// Setup
+		e := echo.New()
+		e.POST("/introspect", a.Introspect())
+		rec := httptest.NewRecorder()
+		req := httptest.NewRequest(echo.POST, "/introspect", strings.NewReader("token="+pair.token))
+		req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationForm)
+		if pair.user != "" {
+			req.SetBasicAuth(pair.user, pair.secret)
+		}
+
+		e.ServeHTTP(rec, req)
+		// Assertions
+		assert.Equal(t, pair.result, rec.Code)
+		if rec.Code == http.StatusOK {
+			val := new(apis.IntrospectionResponse)
+			_ = json.Unmarshal(rec.Body.Bytes(), val)
+			assert.Equal(t, pair.active, val.Active)
+			if val.Active {
+				assert.Equal(t, "V", val.Username)
+				assert.Equal(t, "S", val.Session.ID)
+			}
+		}
+	}
+}
+
+/*
+Data Provider for ForwardAuth method
+*/
+type forwardProvider struct {
+	value  string
+	header string
+	cookie string
+	result int
+}
+
+var testForwardProvider = []forwardProvider{
+	{"/auth/forward", "", "", http.StatusUnauthorized},                   // no token
+	{"/auth/forward?service=V", "", "", http.StatusUnauthorized},         // no token
+	{"/auth/forward?service=V", "Bearer X", "", http.StatusUnauthorized}, // session not found
+	{"/auth/forward?service=A", "Bearer T", "", http.StatusUnauthorized}, // token of another service
+	{"/auth/forward?service=V", "Bearer T", "", http.StatusOK},           // OK header
+	{"/auth/forward?service=V", "T", "", http.StatusOK},                  // OK header without Bearer
+	{"/auth/forward?service=V", "", "T", http.StatusOK},                  // OK cookie
+	{"/auth/forward", "", "T", http.StatusOK},                            // OK service from configuration
+}
+
+/*
+Tests for ForwardAuth method
+*/
+func TestForwardAuth(t *testing.T) {
+
+	for _, pair := range testForwardProvider {
+
+		r := new(mocks.ClientRedisTest)
+		a := API{Secure: new(mocks.ClientTokenManagerTest), Redis: r, Ldap: new(mocks.ClientLdapTest)}
+		r.CreateKey(fmt.Sprintf(r.GetConfig().TokenKey, "V", "V", "T"), nil)
+
+		// Setup
+		e := echo.New()
+		e.GET("/auth/forward", a.ForwardAuth(strut.ForwardAuthConfig{Service: "V", Cookie: "auth"}))
+		rec := httptest.NewRecorder()
+		req := httptest.NewRequest(echo.GET, pair.value, nil)
+		if pair.header != "" {
+			req.Header.Set(echo.HeaderAuthorization, pair.header)
+		}
+		if pair.cookie != "" {
+			req.AddCookie(&http.Cookie{Name: "auth", Value: pair.cookie})
+		}
+
+		e.ServeHTTP(rec, req)
+		// Assertions
+		assert.Equal(t, pair.result, rec.Code)
+		if rec.Code == http.StatusOK {
+			assert.Equal(t, "V", rec.Header().Get(HeaderAuthUser))
+		}
+	}
+
+	// the tokens of the client credentials don't authenticate a user
+	r := new(mocks.ClientRedisTest)
+	a := API{Secure: &mocks.ClientTokenManagerTest{Claims: &TokenClaims{Username: "service:V", Service: "V", Session: "S"}}, Redis: r, Ldap: new(mocks.ClientLdapTest)}
+	r.CreateKey(fmt.Sprintf(r.GetConfig().TokenKey, "service:V", "V", "T"), nil)
+	e := echo.New()
+	e.GET("/auth/forward", a.ForwardAuth(strut.ForwardAuthConfig{Service: "V"}))
+	rec := httptest.NewRecorder()
+	req := httptest.NewRequest(echo.GET, "/auth/forward", nil)
+	req.Header.Set(echo.HeaderAuthorization, "Bearer T")
+	e.ServeHTTP(rec, req)
+	assert.Equal(t, http.StatusUnauthorized, rec.Code)
+	assert.Empty(t, rec.Header().Get(HeaderAuthUser))
+}
+
+/*
+Tests for the browser sessions kept in cookies
+*/
+func TestCookieSession(t *testing.T) {
+
+	r := &mocks.ClientRedisTest{Services: map[string]*redis.Service{"A": {Name: "A", Cookie: true}}}
+	a := API{Secure: new(mocks.ClientTokenManagerTest), Redis: r, Ldap: new(mocks.ClientLdapTest)}
+	e := echo.New()
+	e.POST("/authenticate", a.Authenticate())
+	e.POST("/validate", a.Validate())
+	e.POST("/token/refresh", a.RefreshToken())
+	e.POST("/logout", a.Logout())
+
+	rec := httptest.NewRecorder()
+	req := httptest.NewRequest(echo.POST, "/authenticate", strings.NewReader(`{"username":"A","password":"A","service":"A", "groups":["A"]}`))
+	req.Header.Set("Content-Type", "application/json")
+	e.ServeHTTP(rec, req)
+	assert.Equal(t, http.StatusOK, rec.Code)
+
+	// the tokens are only in the cookies
+	login := new(apis.AuthenticateResponse)
+	_ = json.Unmarshal(rec.Body.Bytes(), login)
+	assert.Empty(t, login.Token)
+	assert.Empty(t, login.RefreshToken)
+	assert.NotEmpty(t, login.CSRFToken)
+
+	cookies := make(map[string]*http.Cookie)
+	for _, ck := range rec.Result().Cookies() {
+		cookies[ck.Name] = ck
+	}
+	assert.Equal(t, "cryptoText", cookies["auth_A"].Value)
+	assert.True(t, cookies["auth_A"].HttpOnly)
+	assert.True(t, cookies["auth_A"].Secure)
+	assert.True(t, cookies["auth_A_refresh"].HttpOnly)
+	assert.False(t, cookies["auth_A_csrf"].HttpOnly)
+	assert.Equal(t, login.CSRFToken, cookies["auth_A_csrf"].Value)
+
+	// the mock validates every token as a session of the user V in the service V
+	r.CreateKey(fmt.Sprintf(r.GetConfig().TokenKey, "V", "V", "cryptoText"), nil)
+
+	call := func(path string, service string, csrf string, body string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		req := httptest.NewRequest(echo.POST, path, strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set(HeaderService, service)
+		if csrf != "" {
+			req.Header.Set(HeaderCSRFToken, csrf)
+		}
+		for _, ck := range []string{"auth_A", "auth_A_refresh", "auth_A_csrf"} {
+			req.AddCookie(&http.Cookie{Name: strings.Replace(ck, "_A", "_"+service, 1), Value: cookies[ck].Value})
+		}
+		e.ServeHTTP(rec, req)
+		return rec
+	}
+
+	assert.Equal(t, http.StatusForbidden, call("/validate", "V", "", "").Code)
+	assert.Equal(t, http.StatusForbidden, call("/validate", "V", "B", "").Code)
+	assert.Equal(t, http.StatusOK, call("/validate", "V", login.CSRFToken, "").Code)
+
+	// the refresh token is taken from the cookie
+	assert.Equal(t, http.StatusForbidden, call("/token/refresh", "A", "", `{"service":"A"}`).Code)
+	rec = call("/token/refresh", "A", login.CSRFToken, `{"service":"A"}`)
+	assert.Equal(t, http.StatusOK, rec.Code)
+	refreshed := new(apis.AuthenticateResponse)
+	_ = json.Unmarshal(rec.Body.Bytes(), refreshed)
+	assert.Empty(t, refreshed.Token)
+	assert.NotEmpty(t, refreshed.CSRFToken)
+
+	// logout removes the cookies
+	rec = call("/logout", "V", login.CSRFToken, "")
+	assert.Equal(t, http.StatusOK, rec.Code)
+	for _, ck := range rec.Result().Cookies() {
+		assert.Equal(t, "", ck.Value)
+		assert.True(t, ck.MaxAge < 0)
+	}
+	assert.Equal(t, http.StatusUnauthorized, call("/validate", "V", login.CSRFToken, "").Code)
+}
+
+/*
+Data Provider for CORS middleware
+*/
+type corsProvider struct {
+	method      string
+	origin      string
+	service     string
+	allow       string
+	credentials string
+	result      int
+}
+
+var testCORSProvider = []corsProvider{
+	{echo.POST, "", "A", "", "", http.StatusOK},                                                        // no origin
+	{echo.POST, "https://a.example.com", "A", "https://a.example.com", "true", http.StatusOK},          // registered origin
+	{echo.POST, "https://a.example.com", "B", "*", "", http.StatusOK},                                  // origin of another service
+	{echo.POST, "https://c.example.com", "A", "*", "", http.StatusOK},                                  // unknown origin
+	{echo.OPTIONS, "https://a.example.com", "", "https://a.example.com", "true", http.StatusNoContent}, // preflight registered origin
+	{echo.OPTIONS, "https://c.example.com", "", "*", "", http.StatusNoContent},                         // preflight unknown origin
+}
+
+/*
+Tests for CORS middleware
+*/
+func TestCORS(t *testing.T) {
+
+	for _, pair := range testCORSProvider {
+
+		r := &mocks.ClientRedisTest{Services: map[string]*redis.Service{
+			"A": {Name: "A", Origins: []string{"https://a.example.com"}},
+			"B": {Name: "B"},
+		}}
+		a := API{Secure: new(mocks.ClientTokenManagerTest), Redis: r, Ldap: new(mocks.ClientLdapTest)}
+
+		// Setup
+		e := echo.New()
+		e.Match([]string{echo.POST, echo.OPTIONS}, "/cors", func(c echo.Context) error {
+			return c.NoContent(http.StatusOK)
+		}, a.CORS())
+		rec := httptest.NewRecorder()
+		req := httptest.NewRequest(pair.method, "/cors", nil)
+		if pair.origin != "" {
+			req.Header.Set(echo.HeaderOrigin, pair.origin)
+		}
+		if pair.service != "" {
+			req.Header.Set(HeaderService, pair.service)
+		}
+
+		e.ServeHTTP(rec, req)
+		// Assertions
+		assert.Equal(t, pair.result, rec.Code)
+		assert.Equal(t, pair.allow, rec.Header().Get(echo.HeaderAccessControlAllowOrigin))
+		assert.Equal(t, pair.credentials, rec.Header().Get(echo.HeaderAccessControlAllowCredentials))
+	}
+}
+
+/*
+Data Provider for OAuthToken method
+*/
+type oauthTokenProvider struct {
+	erro   string
+	user   string
+	secret string
+	form   string
+	result int
+	scope  string
+}
+
+var testOAuthTokenProvider = []oauthTokenProvider{
+	{"", "A", "A12345", "", http.StatusBadRequest, ""},                                                          // no grant type
+	{"", "A", "A12345", "grant_type=password", http.StatusBadRequest, ""},                                       // unsupported grant type
+	{"", "", "", "grant_type=client_credentials", http.StatusUnauthorized, ""},                                  // no credentials
+	{"", "A", "B", "grant_type=client_credentials", http.StatusUnauthorized, ""},                                // invalid API key
+	{"", "A", "A12345", "grant_type=client_credentials&scope=admin", http.StatusBadRequest, ""},                 // scope not allowed
+	{"sec", "A", "A12345", "grant_type=client_credentials", http.StatusInternalServerError, ""},                 // error creating token
+	{"keyc", "A", "A12345", "grant_type=client_credentials", http.StatusInternalServerError, ""},                // error creating key in redis
+	{"", "A", "A12345", "grant_type=client_credentials", http.StatusOK, "read write"},                           // OK every scope
+	{"", "A", "A12345", "grant_type=client_credentials&scope=write", http.StatusOK, "write"},                    // OK requested scope
+	{"", "B", "A12345", "grant_type=client_credentials", http.StatusOK, ""},                                     // OK service without scopes
+	{"", "", "", "grant_type=client_credentials&client_id=A&client_secret=A12345", http.StatusOK, "read write"}, // OK credentials in the form
+}
+
+/*
+Tests for OAuthToken method
+*/
+func TestOAuthToken(t *testing.T) {
+
+	for _, pair := range testOAuthTokenProvider {
+
+		r := &mocks.ClientRedisTest{Services: map[string]*redis.Service{"A": {Name: "A", Scopes: []string{"read", "write"}}}}
+		s := new(mocks.ClientTokenManagerTest)
+		a := API{Secure: s, Redis: r, Ldap: new(mocks.ClientLdapTest)}
+
+		switch pair.erro {
+		case "sec":
+			s.Iserror = true
+		case "keyc":
+			r.IserrorCreate = true
+		}
+
+		// Setup
+		e := echo.New()
+		e.POST("/oauth/token", a.OAuthToken())
+		rec := httptest.NewRecorder()
+		req := httptest.NewRequest(echo.POST, "/oauth/token", strings.NewReader(pair.form))
+		req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationForm)
+		if pair.user != "" {
+			req.SetBasicAuth(pair.user, pair.secret)
+		}
+
+		e.ServeHTTP(rec, req)
+		// Assertions
+		assert.Equal(t, pair.result, rec.Code)
+		assert.Equal(t, "no-store", rec.Header().Get(HeaderCacheControl))
+		if rec.Code == http.StatusOK {
+			val := new(apis.TokenResponse)
+			_ = json.Unmarshal(rec.Body.Bytes(), val)
+			assert.Equal(t, "cryptoText", val.AccessToken)
+			assert.Equal(t, TokenTypeBearer, val.TokenType)
+			assert.Equal(t, pair.scope, val.Scope)
+
+			// the session of the machine subject is stored
+			service := pair.user
+			if service == "" {
+				service = "A"
+			}
+			_, exists := r.Store[fmt.Sprintf(r.GetConfig().TokenKey, "service:"+service, service, "cryptoText")]
+			assert.True(t, exists)
+		} else {
+			val := new(apis.OAuthError)
+			_ = json.Unmarshal(rec.Body.Bytes(), val)
+			assert.NotEmpty(t, val.Error)
+		}
+	}
+}
+
+/*
+Data Provider for Authorize method
+*/
+type authorizeProvider struct {
+	method   string
+	query    string
+	form     string
+	result   int
+	location string
+}
+
+const (
+	testRedirect  = "https%3A%2F%2Fa.example.com%2Fcb"
+	testVerifier  = "dBjftJeZ4CVP-mB92K27uhbUJU1p1r_wW1gFWFOEjXk"
+	testChallenge = "E9Melhoa2OwvFrEMTJguCHaoeK1t8URWbuGJSstw-cM"
+)
+
+var testAuthorizeProvider = []authorizeProvider{
+	{echo.GET, "", "", http.StatusBadRequest, ""},                                                                                                                                                                                 // no client
+	{echo.GET, "client_id=A&redirect_uri=https%3A%2F%2Fevil.example.com", "", http.StatusBadRequest, ""},                                                                                                                          // redirect not registered
+	{echo.GET, "client_id=B&redirect_uri=" + testRedirect, "", http.StatusBadRequest, ""},                                                                                                                                         // service without registration
+	{echo.GET, "client_id=A&redirect_uri=" + testRedirect + "&response_type=token", "", http.StatusFound, "unsupported_response"},                                                                                                 // unsupported response type
+	{echo.GET, "client_id=A&redirect_uri=" + testRedirect + "&response_type=code&code_challenge_method=plain&code_challenge=A", "", http.StatusFound, "invalid_request"},                                                          // PKCE method not supported
+	{echo.GET, "client_id=A&redirect_uri=" + testRedirect + "&response_type=code", "", http.StatusOK, ""},                                                                                                                         // login form without PKCE
+	{echo.GET, "client_id=C&redirect_uri=" + testRedirect + "&response_type=code&code_challenge_method=S256&code_challenge=" + testChallenge, "", http.StatusFound, "server_error"},                                               // service without groups
+	{echo.GET, "client_id=A&redirect_uri=" + testRedirect + "&response_type=code&code_challenge_method=S256&code_challenge=" + testChallenge, "", http.StatusOK, ""},                                                              // login form
+	{echo.GET, "client_id=A&redirect_uri=" + testRedirect + "&response_type=code&scope=admin&state=xyz", "", http.StatusFound, "error=invalid_scope"},                                                                             // scope not granted to the service
+	{echo.GET, "client_id=A&redirect_uri=" + testRedirect + "&response_type=code&scope=openid+read", "", http.StatusOK, ""},                                                                                                       // login form with granted scopes
+	{echo.POST, "client_id=A&redirect_uri=" + testRedirect + "&response_type=code&code_challenge_method=S256&code_challenge=" + testChallenge, "username=A&csrf_token=T", http.StatusBadRequest, ""},                              // no password
+	{echo.POST, "client_id=A&redirect_uri=" + testRedirect + "&response_type=code&code_challenge_method=S256&code_challenge=" + testChallenge, "username=B&password=A&csrf_token=T", http.StatusForbidden, ""},                    // error in Auth LDAP
+	{echo.POST, "client_id=A&redirect_uri=" + testRedirect + "&response_type=code&code_challenge_method=S256&code_challenge=" + testChallenge, "username=E&password=A&csrf_token=T", http.StatusForbidden, ""},                    // user not in groups
+	{echo.POST, "client_id=A&redirect_uri=" + testRedirect + "&response_type=code&code_challenge_method=S256&code_challenge=" + testChallenge, "username=W&password=A&csrf_token=T", http.StatusUnauthorized, InvalidCredentials}, // wrong password
+	{echo.POST, "client_id=A&redirect_uri=" + testRedirect + "&response_type=code&code_challenge_method=S256&code_challenge=" + testChallenge, "username=N&password=A&csrf_token=T", http.StatusUnauthorized, InvalidCredentials}, // unknown user, like a wrong password
+	{echo.POST, "client_id=A&redirect_uri=" + testRedirect + "&response_type=code&code_challenge_method=S256&code_challenge=" + testChallenge + "&state=xyz", "username=A&password=A&csrf_token=T", http.StatusFound, "code="},    // OK
+	{echo.POST, "client_id=A&redirect_uri=" + testRedirect + "&response_type=code&code_challenge_method=S256&code_challenge=" + testChallenge, "username=A&password=A", http.StatusForbidden, ""},                                 // no CSRF token
+	{echo.POST, "client_id=A&redirect_uri=" + testRedirect + "&response_type=code&code_challenge_method=S256&code_challenge=" + testChallenge, "username=A&password=A&csrf_token=X", http.StatusForbidden, ""},                    // invalid CSRF token
+}
+
+/*
+Tests for Authorize method
+*/
+func TestAuthorize(t *testing.T) {
+
+	for _, pair := range testAuthorizeProvider {
+
+		r := &mocks.ClientRedisTest{Services: map[string]*redis.Service{
+			"A": {Name: "A", RedirectURIs: []string{"https://a.example.com/cb"}, Groups: []string{"A"}, Scopes: []string{"read"}},
+			"C": {Name: "C", RedirectURIs: []string{"https://a.example.com/cb"}},
+		}}
+		a := API{Secure: new(mocks.ClientTokenManagerTest), Redis: r, Ldap: new(mocks.ClientLdapTest)}
+
+		// Setup
+		e := echo.New()
+		e.Match([]string{echo.GET, echo.POST}, "/oauth/authorize", a.Authorize())
+		rec := httptest.NewRecorder()
+		req := httptest.NewRequest(pair.method, "/oauth/authorize?"+pair.query, strings.NewReader(pair.form))
+		req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationForm)
+		req.AddCookie(&http.Cookie{Name: a.cookieName("A", CookieSuffixLogin), Value: "T"})
+
+		e.ServeHTTP(rec, req)
+		// Assertions
+		assert.Equal(t, pair.result, rec.Code, pair.form)
+		if rec.Code == http.StatusFound {
+			assert.True(t, strings.HasPrefix(rec.Header().Get(echo.HeaderLocation), "https://a.example.com/cb?"))
+			assert.Contains(t, rec.Header().Get(echo.HeaderLocation), pair.location)
+		}
+		if rec.Code != http.StatusFound {
+			assert.Contains(t, rec.Body.String(), pair.location)
+			// the login page can't be framed
+			assert.Equal(t, "DENY", rec.Header().Get(echo.HeaderXFrameOptions), pair.query)
+			assert.Equal(t, "frame-ancestors 'none'", rec.Header().Get(echo.HeaderContentSecurityPolicy), pair.query)
+		}
+		if rec.Code < http.StatusMultipleChoices || pair.method == echo.POST {
+			// every form has a new token, in the hidden field and in the cookie of the login page
+			cookies := rec.Result().Cookies()
+			if assert.Len(t, cookies, 1, pair.form) {
+				assert.Equal(t, "auth_A_login", cookies[0].Name)
+				assert.Equal(t, "/oauth/authorize", cookies[0].Path)
+				assert.True(t, cookies[0].HttpOnly)
+				if rec.Code == http.StatusFound {
+					assert.Equal(t, -1, cookies[0].MaxAge)
+				} else {
+					assert.Contains(t, rec.Body.String(), `name="password"`)
+					assert.Contains(t, rec.Body.String(), `name="csrf_token" value="`+cookies[0].Value+`"`)
+					assert.NotEqual(t, "T", cookies[0].Value)
+				}
+			}
+		}
+	}
+}
+
+/*
+Tests for the exchange of the authorization code in the OAuthToken method
+*/
+func TestAuthorizationCode(t *testing.T) {
+
+	r := &mocks.ClientRedisTest{Services: map[string]*redis.Service{
+		"A": {Name: "A", RedirectURIs: []string{"https://a.example.com/cb"}, Groups: []string{"A"}, Scopes: []string{"read"}},
+	}}
+	a := API{Secure: new(mocks.ClientTokenManagerTest), Redis: r, Ldap: new(mocks.ClientLdapTest)}
+	e := echo.New()
+	e.Match([]string{echo.GET, echo.POST}, "/oauth/authorize", a.Authorize())
+	e.POST("/oauth/token", a.OAuthToken())
+
+	login := func(query string) string {
+		rec := httptest.NewRecorder()
+		req := httptest.NewRequest(echo.POST, "/oauth/authorize?client_id=A&redirect_uri="+testRedirect+"&response_type=code"+query, strings.NewReader("username=A&password=A&csrf_token=T"))
+		req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationForm)
+		req.AddCookie(&http.Cookie{Name: a.cookieName("A", CookieSuffixLogin), Value: "T"})
+		e.ServeHTTP(rec, req)
+		u, _ := url.Parse(rec.Header().Get(echo.HeaderLocation))
+		return u.Query().Get("code")
+	}
+	exchange := func(form string, secret string) (int, *apis.TokenResponse, *apis.OAuthError) {
+		rec := httptest.NewRecorder()
+		req := httptest.NewRequest(echo.POST, "/oauth/token", strings.NewReader(form))
+		req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationForm)
+		if secret != "" {
+			req.SetBasicAuth("A", secret)
+		}
+		e.ServeHTTP(rec, req)
+		val, err := new(apis.TokenResponse), new(apis.OAuthError)
+		_ = json.Unmarshal(rec.Body.Bytes(), val)
+		_ = json.Unmarshal(rec.Body.Bytes(), err)
+		return rec.Code, val, err
+	}
+	form := func(code string, client string, verifier string) string {
+		return "grant_type=authorization_code&code=" + code + "&client_id=" + client + "&redirect_uri=" + testRedirect + "&code_verifier=" + verifier
+	}
+	pkce := "&code_challenge_method=S256&code_challenge=" + testChallenge
+
+	code := login(pkce)
+	assert.NotEmpty(t, code)
+
+	// the code is bound to the service and to the PKCE verifier
+	status, _, oerr := exchange(form(code, "B", testVerifier), "")
+	assert.Equal(t, http.StatusBadRequest, status)
+	assert.Equal(t, OAuthInvalidGrant, oerr.Error)
+
+	code = login(pkce)
+	status, _, oerr = exchange(form(code, "A", strings.Repeat("x", 43)), "")
+	assert.Equal(t, http.StatusBadRequest, status)
+	assert.Equal(t, OAuthInvalidGrant, oerr.Error)
+
+	code = login(pkce)
+	status, _, _ = exchange("grant_type=authorization_code&code="+code+"&client_id=A", "")
+	assert.Equal(t, http.StatusBadRequest, status)
+
+	status, tk, _ := exchange(form(code, "A", testVerifier), "")
+	assert.Equal(t, http.StatusOK, status)
+	assert.Equal(t, "cryptoText", tk.AccessToken)
+	assert.NotEmpty(t, tk.RefreshToken)
+	assert.Empty(t, tk.IDToken)
+	assert.Equal(t, "read", tk.Scope)
+
+	// the code can only be used once
+	status, _, oerr = exchange(form(code, "A", testVerifier), "")
+	assert.Equal(t, http.StatusBadRequest, status)
+	assert.Equal(t, OAuthInvalidGrant, oerr.Error)
+
+	// without PKCE the service authenticates with its API key
+	code = login("&scope=openid+email&nonce=N")
+	status, _, oerr = exchange(form(code, "A", ""), "B")
+	assert.Equal(t, http.StatusUnauthorized, status)
+	assert.Equal(t, OAuthInvalidClient, oerr.Error)
+
+	code = login("&scope=openid+email&nonce=N")
+	status, tk, _ = exchange(form(code, "A", ""), "A12345")
+	assert.Equal(t, http.StatusOK, status)
+	assert.Equal(t, "idToken", tk.IDToken)
+	assert.Equal(t, "openid email", tk.Scope)
+}
+
+/*
+Tests for OpenIDConfiguration method
+*/
+func TestOpenIDConfiguration(t *testing.T) {
+
+	for _, issuer := range []string{"", "https://auth.company.local"} {
+
+		a := API{Secure: new(mocks.ClientTokenManagerTest), Redis: new(mocks.ClientRedisTest), Ldap: new(mocks.ClientLdapTest), Issuer: issuer}
+
+		// Setup
+		e := echo.New()
+		e.GET("/.well-known/openid-configuration", a.OpenIDConfiguration())
+		rec := httptest.NewRecorder()
+		req := httptest.NewRequest(echo.GET, "/.well-known/openid-configuration", nil)
+
+		e.ServeHTTP(rec, req)
+		// Assertions
+		if issuer == "" {
+			assert.Equal(t, http.StatusNotImplemented, rec.Code)
+			continue
+		}
+		assert.Equal(t, http.StatusOK, rec.Code)
+		val := new(apis.OpenIDConfiguration)
+		_ = json.Unmarshal(rec.Body.Bytes(), val)
+		assert.Equal(t, issuer, val.Issuer)
+		assert.Equal(t, issuer+"/oauth/authorize", val.AuthorizationEndpoint)
+		assert.Equal(t, issuer+"/userinfo", val.UserInfoEndpoint)
+		assert.Equal(t, []string{"HS256"}, val.IDTokenSigningAlgValuesSupported)
+	}
+}
+
+/*
+Data Provider for UserInfo method
+*/
+type userInfoProvider struct {
+	erro    string
+	service string
+	header  string
+	result  int
+}
+
+var testUserInfoProvider = []userInfoProvider{
+	{"", "V", "", http.StatusUnauthorized},                  // no token
+	{"token", "V", "Bearer", http.StatusUnauthorized},       // validate token error
+	{"", "A", "Bearer", http.StatusUnauthorized},            // token of another service
+	{"revk", "V", "Bearer", http.StatusUnauthorized},        // session revoked
+	{"keyc", "V", "Bearer", http.StatusInternalServerError}, // error refreshing the session
+	{"", "V", "Bearer", http.StatusOK},                      // OK
+}
+
+/*
+Tests for UserInfo method
+*/
+func TestUserInfo(t *testing.T) {
+
+	for _, pair := range testUserInfoProvider {
+
+		r := new(mocks.ClientRedisTest)
+		s := new(mocks.ClientTokenManagerTest)
+		a := API{Secure: s, Redis: r, Ldap: new(mocks.ClientLdapTest)}
+
+		// the service is read from the token before validating it
+		token, _ := jwt.NewWithClaims(jwt.SigningMethodHS256, &TokenClaims{Service: pair.service}).SignedString([]byte("A"))
+
+		switch pair.erro {
+		case "token":
+			s.Iserror = true
+		case "keyc":
+			r.IserrorCreate = true
+		}
+		if pair.erro != "revk" {
+			r.CreateKey(fmt.Sprintf(r.GetConfig().TokenKey, "V", "V", token), nil)
+		}
+
+		// Setup
+		e := echo.New()
+		e.GET("/userinfo", a.UserInfo())
+		rec := httptest.NewRecorder()
+		req := httptest.NewRequest(echo.GET, "/userinfo", nil)
+		if pair.header != "" {
+			req.Header.Set(echo.HeaderAuthorization, pair.header+" "+token)
+		}
+
+		e.ServeHTTP(rec, req)
+		// Assertions
+		assert.Equal(t, pair.result, rec.Code)
+		if rec.Code == http.StatusOK {
+			val := new(apis.UserInfo)
+			_ = json.Unmarshal(rec.Body.Bytes(), val)
+			assert.Equal(t, "V", val.PreferredUsername)
+		}
+	}
+}
+
+/*
+Data Provider for TokenExchange method
+*/
+type tokenExchangeProvider struct {
+	user   string
+	form   string
+	erro   string
+	result int
+}
+
+const (
+	testExchange  = "grant_type=urn%3Aietf%3Aparams%3Aoauth%3Agrant-type%3Atoken-exchange"
+	testTokenType = "&subject_token_type=urn%3Aietf%3Aparams%3Aoauth%3Atoken-type%3Aaccess_token"
+)
+
+var testTokenExchangeProvider = []tokenExchangeProvider{
+	{"", testExchange + testTokenType, "", http.StatusUnauthorized},                // no client credentials
+	{"A", testExchange, "", http.StatusBadRequest},                                 // no subject token type
+	{"A", testExchange + "&subject_token_type=jwt", "", http.StatusBadRequest},     // subject token type not supported
+	{"A", testExchange + testTokenType + "&audience=B", "", http.StatusBadRequest}, // audience of another service
+	{"C", testExchange + testTokenType, "", http.StatusBadRequest},                 // service without groups
+	{"A", testExchange + testTokenType, "token", http.StatusBadRequest},            // invalid subject token
+	{"A", testExchange + testTokenType, "revk", http.StatusBadRequest},             // revoked subject token
+	{"A", testExchange + testTokenType, "cache", http.StatusBadRequest},            // groups not cached
+	{"A", testExchange + testTokenType, "group", http.StatusBadRequest},            // user not in groups
+	{"A", testExchange + testTokenType + "&audience=A", "", http.StatusOK},         // OK
+}
+
+/*
+Tests for TokenExchange method
+*/
+func TestTokenExchange(t *testing.T) {
+
+	for _, pair := range testTokenExchangeProvider {
+
+		r := &mocks.ClientRedisTest{Services: map[string]*redis.Service{
+			"A": {Name: "A", Groups: []string{"A"}},
+			"C": {Name: "C"},
+		}}
+		s := new(mocks.ClientTokenManagerTest)
+		a := API{Secure: s, Redis: r, Ldap: new(mocks.ClientLdapTest)}
+
+		// the subject token is a session of the service V
+		token, _ := jwt.NewWithClaims(jwt.SigningMethodHS256, &TokenClaims{Service: "V"}).SignedString([]byte("A"))
+		if pair.erro != "revk" {
+			r.CreateKey(fmt.Sprintf(r.GetConfig().TokenKey, "V", "V", token), nil)
+		}
+		groups := []string{"A"}
+		if pair.erro == "group" {
+			groups = []string{"B"}
+		}
+		if pair.erro != "cache" {
+			r.CreateObject(fmt.Sprintf(r.GetConfig().GroupsKey, "V"), &UserEntry{Username: "V", Name: "Name V", Groups: groups}, 60)
+		}
+		if pair.erro == "token" {
+			s.Iserror = true
+		}
+
+		// Setup
+		e := echo.New()
+		e.POST("/oauth/token", a.OAuthToken())
+		rec := httptest.NewRecorder()
+		req := httptest.NewRequest(echo.POST, "/oauth/token", strings.NewReader(pair.form+"&subject_token="+token))
+		req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationForm)
+		if pair.user != "" {
+			req.SetBasicAuth(pair.user, "A12345")
+		}
+
+		e.ServeHTTP(rec, req)
+		// Assertions
+		assert.Equal(t, pair.result, rec.Code)
+		if rec.Code == http.StatusOK {
+			val := new(apis.TokenResponse)
+			_ = json.Unmarshal(rec.Body.Bytes(), val)
+			assert.Equal(t, "cryptoText", val.AccessToken)
+			assert.Equal(t, TokenTypeAccessToken, val.IssuedTokenType)
+
+			// the new session of the service keeps the session it was exchanged from
+			tkObj := new(TokenClaims)
+			found, _ := r.FindObject(fmt.Sprintf(r.GetConfig().TokenKey, "V", "A", "cryptoText"), tkObj)
+			assert.True(t, found)
+			assert.Equal(t, []string{"A"}, tkObj.Groups)
+			assert.Equal(t, "Name V", tkObj.Name)
+			assert.Equal(t, &Actor{Subject: "service:V", Session: "S"}, tkObj.Act)
+		} else {
+			val := new(apis.OAuthError)
+			_ = json.Unmarshal(rec.Body.Bytes(), val)
+			assert.NotEmpty(t, val.Error)
+		}
+	}
+}
+
+/*
+Tests for the handlers serving concurrent requests, run with -race
+*/
+func TestConcurrentHandlers(t *testing.T) {
+
+	r := &mocks.ClientRedisTest{Services: map[string]*redis.Service{
+		"R": {Name: "R", Roles: map[string][]string{"admin": {"A"}}},
+	}}
+	a := API{Secure: new(mocks.ClientTokenManagerTest), Redis: r, Ldap: new(mocks.ClientLdapTest)}
+
+	e := echo.New()
+	e.POST("/authenticate", a.Authenticate())
+	e.POST("/validate", a.Validate())
+	e.POST("/token/refresh", a.RefreshToken())
+
+	logins := []struct {
+		json   string
+		result int
+	}{
+		{`{"username":"A","password":"A","service":"R"}`, http.StatusOK},
+		{`{"username":"E","password":"A","service":"R"}`, http.StatusForbidden},
+		{`{"username":"B","password":"A","service":"A","groups":["A"]}`, http.StatusForbidden},
+		{`{"username":"D","password":"A","service":"A","groups":["A"]}`, http.StatusOK},
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 40; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+
+			l := logins[i%len(logins)]
+			rec := httptest.NewRecorder()
+			req := httptest.NewRequest(echo.POST, "/authenticate", strings.NewReader(l.json))
+			req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+			e.ServeHTTP(rec, req)
+			assert.Equal(t, l.result, rec.Code)
+			if rec.Code != http.StatusOK {
+				return
+			}
+
+			val := new(apis.AuthenticateResponse)
+			_ = json.Unmarshal(rec.Body.Bytes(), val)
+
+			// the refresh token of the session is rotated once
+			rec = httptest.NewRecorder()
+			o := new(apis.AuthenticateRequest)
+			_ = json.Unmarshal([]byte(l.json), o)
+			req = httptest.NewRequest(echo.POST, "/token/refresh", strings.NewReader(`{"refreshToken":"`+val.RefreshToken+`","service":"`+o.Service+`"}`))
+			req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+			e.ServeHTTP(rec, req)
+			assert.Equal(t, http.StatusOK, rec.Code)
+
+			// the sessions are read while the other logins write theirs, the claims of the mock token
+			// are the ones of the user V who has no session
+			rec = httptest.NewRecorder()
+			req = httptest.NewRequest(echo.POST, "/validate", nil)
+			req.Header.Set(echo.HeaderAuthorization, val.Token)
+			req.Header.Set(HeaderService, "V")
+			e.ServeHTTP(rec, req)
+			assert.Equal(t, http.StatusUnauthorized, rec.Code)
+		}(i)
+	}
+	wg.Wait()
+
+	// every login kept its own groups and roles
+	tkObj := new(TokenClaims)
+	found, _ := r.FindObject(fmt.Sprintf(r.GetConfig().TokenKey, "A", "R", "cryptoText"), tkObj)
+	assert.True(t, found)
+	assert.Equal(t, []string{"admin"}, tkObj.Roles)
+	found, _ = r.FindObject(fmt.Sprintf(r.GetConfig().TokenKey, "D", "A", "cryptoText"), tkObj)
+	assert.True(t, found)
+	assert.Equal(t, []string{"A"}, tkObj.Groups)
+}
@@ -0,0 +1,376 @@
+package api
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"github.com/labstack/echo"
+	strut "github.com/pintobikez/authentication-service/api/structures"
+	redis "github.com/pintobikez/authentication-service/redis"
+	sec "github.com/pintobikez/authentication-service/secure/structures"
+	"html/template"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+const (
+	GrantAuthorizationCode = "authorization_code"
+	ResponseTypeCode       = "code"
+	ChallengeMethodS256    = "S256"
+	// Default seconds an authorization code can be exchanged
+	DefaultCodeTTL = 60
+
+	// Hidden field of the login form with the anti-CSRF token of its cookie
+	FormCSRFToken = "csrf_token"
+
+	OAuthUnsupportedResponse = "unsupported_response_type"
+	OAuthInvalidGrant        = "invalid_grant"
+
+	AuthorizeDisabled    = "Authorization codes are not enabled"
+	ResponseNotSupported = "Response type %s is not supported"
+	RedirectNotAllowed   = "The redirect_uri is not registered for the service"
+	CodeChallengeMethod  = "The code_challenge_method must be S256"
+	ServiceWithoutGroups = "Service %s doesn't register the groups of its users"
+	CodeInvalid          = "The authorization code is invalid, expired or was already used"
+	CodeVerifierInvalid  = "The code_verifier doesn't match the code_challenge"
+)
+
+// Parameters of the authorization request, carried by the login form
+type authorizeRequest struct {
+	ResponseType        string
+	ClientID            string
+	RedirectURI         string
+	State               string
+	Scope               string
+	Nonce               string
+	CodeChallenge       string
+	CodeChallengeMethod string
+}
+
+// Content of the login page, without the form when the request can't be redirected back
+type loginPage struct {
+	authorizeRequest
+	Username  string
+	Error     string
+	Form      bool
+	CSRFToken string
+}
+
+var loginTemplate = template.Must(template.New("login").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>Login - {{.ClientID}}</title>
+</head>
+<body>
+<h1>{{.ClientID}}</h1>
+{{if .Error}}<p class="error">{{.Error}}</p>{{end}}
+{{if .Form}}
+<form method="post">
+<input type="hidden" name="response_type" value="{{.ResponseType}}">
+<input type="hidden" name="client_id" value="{{.ClientID}}">
+<input type="hidden" name="redirect_uri" value="{{.RedirectURI}}">
+<input type="hidden" name="state" value="{{.State}}">
+<input type="hidden" name="scope" value="{{.Scope}}">
+<input type="hidden" name="nonce" value="{{.Nonce}}">
+<input type="hidden" name="code_challenge" value="{{.CodeChallenge}}">
+<input type="hidden" name="code_challenge_method" value="{{.CodeChallengeMethod}}">
+<input type="hidden" name="csrf_token" value="{{.CSRFToken}}">
+<p><label>Username <input name="username" value="{{.Username}}" autocomplete="username" required autofocus></label></p>
+<p><label>Password <input type="password" name="password" autocomplete="current-password" required></label></p>
+<p><button type="submit">Login</button></p>
+</form>
+{{end}}
+</body>
+</html>
+`))
+
+// Handler of the hosted login page of the OAuth2 authorization code flow with PKCE (RFC 7636).
+// GET renders the login form, POST authenticates the user in LDAP and redirects back to the service with the code.
+// Without a PKCE challenge the service must exchange the code with its API key.
+func (a *API) Authorize() echo.HandlerFunc {
+	return func(c echo.Context) error {
+
+		c.Response().Header().Set(HeaderCacheControl, "no-store")
+
+		o := authorizeRequest{
+			ResponseType:        c.FormValue("response_type"),
+			ClientID:            c.FormValue("client_id"),
+			RedirectURI:         c.FormValue("redirect_uri"),
+			State:               c.FormValue("state"),
+			Scope:               c.FormValue("scope"),
+			Nonce:               c.FormValue("nonce"),
+			CodeChallenge:       c.FormValue("code_challenge"),
+			CodeChallengeMethod: c.FormValue("code_challenge_method"),
+		}
+		p := &loginPage{authorizeRequest: o}
+
+		if a.Redis.GetConfig().AuthCodeKey == "" {
+			p.Error = AuthorizeDisabled
+			return renderLogin(c, http.StatusNotImplemented, p)
+		}
+
+		// Without a registered client and redirect URI the errors can't be sent back to the service
+		svc, e := a.authorizeClient(o)
+		if e != nil {
+			p.Error = e.Message
+			return renderLogin(c, e.Code, p)
+		}
+
+		if o.ResponseType != ResponseTypeCode {
+			return authorizeError(c, o, OAuthUnsupportedResponse, fmt.Sprintf(ResponseNotSupported, o.ResponseType))
+		}
+		if o.CodeChallenge != "" && o.CodeChallengeMethod != ChallengeMethodS256 {
+			return authorizeError(c, o, OAuthInvalidRequest, CodeChallengeMethod)
+		}
+		if !svc.ChecksGroups() {
+			return authorizeError(c, o, OAuthServerError, fmt.Sprintf(ServiceWithoutGroups, o.ClientID))
+		}
+
+		// the other scopes must be granted to the service, like in the client credentials
+		allowed := svc.Scopes
+		if o.Scope != "" {
+			allowed = append(append([]string{}, openIDScopes...), svc.Scopes...)
+		}
+		scopes, err := grantScopes(o.Scope, allowed)
+		if err != nil {
+			return authorizeError(c, o, OAuthInvalidScope, err.Error())
+		}
+
+		p.Form = true
+		if c.Request().Method != echo.POST {
+			return a.renderLoginForm(c, http.StatusOK, p)
+		}
+
+		// 1 - THE FORM WAS POSTED FROM THE LOGIN PAGE, DOUBLE SUBMIT CHECK OF ITS TOKEN
+		p.Username = c.FormValue("username")
+		if !a.sameAsCookie(c, o.ClientID, CookieSuffixLogin, c.FormValue(FormCSRFToken)) {
+			p.Error = CSRFTokenInvalid
+			return a.renderLoginForm(c, http.StatusForbidden, p)
+		}
+
+		// 2 - AUTHENTICATE THE USER
+		password := c.FormValue("password")
+		if p.Username == "" || password == "" {
+			p.Error = fmt.Sprintf(IsEmpty, "username or password")
+			return a.renderLoginForm(c, http.StatusBadRequest, p)
+		}
+
+		user, userGroups, l := a.ldapLogin(c, p.Username, "", password)
+		if l != nil {
+			p.Error = l.Message
+			return a.renderLoginForm(c, l.Code, p)
+		}
+		gr, roles, d := a.authorizeGroups(svc.Groups, svc, userGroups)
+		if d != nil {
+			p.Error = d.Message
+			return a.renderLoginForm(c, d.Code, p)
+		}
+
+		// 3 - SAVE THE AUTHORIZATION CODE
+		code, err := randomString(32)
+		if err != nil {
+			return authorizeError(c, o, OAuthServerError, err.Error())
+		}
+
+		ac := &sec.AuthorizationCode{
+			Service:       o.ClientID,
+			RedirectURI:   o.RedirectURI,
+			CodeChallenge: o.CodeChallenge,
+			Scope:         strings.Join(scopes, " "),
+			Nonce:         o.Nonce,
+			Username:      user.Username,
+			Name:          user.Name,
+			Email:         user.Email,
+			Groups:        gr,
+			Roles:         roles,
+			Realm:         user.Realm,
+			Claims:        user.Claims,
+		}
+		if err := a.Redis.CreateObject(fmt.Sprintf(a.Redis.GetConfig().AuthCodeKey, hashToken(code)), ac, a.codeTTL()); err != nil {
+			return authorizeError(c, o, OAuthServerError, err.Error())
+		}
+
+		// 4 - REDIRECT BACK TO THE SERVICE, THE TOKEN OF THE FORM IS USED ONCE
+		c.SetCookie(a.loginCookie(c, o.ClientID, "", -1))
+		return c.Redirect(http.StatusFound, redirectWith(o.RedirectURI, url.Values{"code": {code}, "state": {o.State}}))
+	}
+}
+
+// Checks the service of the authorization request is registered and allows the redirect URI
+func (a *API) authorizeClient(o authorizeRequest) (*redis.Service, *ErrContent) {
+
+	if o.ClientID == "" {
+		return nil, &ErrContent{http.StatusBadRequest, fmt.Sprintf(IsEmpty, "client_id")}
+	}
+
+	k := fmt.Sprintf(a.Redis.GetConfig().APIKey, o.ClientID)
+	cipherKey, err := a.Redis.FindString(k)
+	if err != nil || cipherKey == "" {
+		return nil, &ErrContent{http.StatusForbidden, fmt.Sprintf(ServiceNotRegistered, o.ClientID)}
+	}
+
+	svc, e := a.findService(o.ClientID)
+	if e != nil {
+		return nil, e
+	}
+	if svc == nil || !svc.AllowsRedirect(o.RedirectURI) {
+		return nil, &ErrContent{http.StatusBadRequest, RedirectNotAllowed}
+	}
+
+	return svc, nil
+}
+
+// Exchanges the authorization code for the tokens of a new session, once
+func (a *API) authorizationCode(c echo.Context) error {
+
+	if a.Redis.GetConfig().AuthCodeKey == "" {
+		return oauthError(c, http.StatusBadRequest, OAuthUnsupportedGrant, AuthorizeDisabled)
+	}
+
+	clientID := c.FormValue("client_id")
+	if clientID == "" {
+		clientID, _, _ = c.Request().BasicAuth()
+	}
+
+	for _, p := range []string{"code", "redirect_uri"} {
+		if c.FormValue(p) == "" {
+			return oauthError(c, http.StatusBadRequest, OAuthInvalidRequest, fmt.Sprintf(IsEmpty, p))
+		}
+	}
+	if clientID == "" {
+		return oauthError(c, http.StatusBadRequest, OAuthInvalidRequest, fmt.Sprintf(IsEmpty, "client_id"))
+	}
+
+	// 1 - TAKE THE CODE, IT CAN'T BE USED AGAIN
+	ac := new(sec.AuthorizationCode)
+	found, err := a.Redis.TakeObject(fmt.Sprintf(a.Redis.GetConfig().AuthCodeKey, hashToken(c.FormValue("code"))), ac)
+	if err != nil {
+		return oauthError(c, http.StatusInternalServerError, OAuthServerError, err.Error())
+	}
+	if !found || ac.Service != clientID || ac.RedirectURI != c.FormValue("redirect_uri") {
+		return oauthError(c, http.StatusBadRequest, OAuthInvalidGrant, CodeInvalid)
+	}
+
+	// 2 - THE SERVICE PROVES IT STARTED THE FLOW WITH THE PKCE VERIFIER, OR AUTHENTICATES WITH ITS API KEY
+	var cipherKey string
+	if ac.CodeChallenge != "" {
+		if !verifyCodeChallenge(c.FormValue("code_verifier"), ac.CodeChallenge) {
+			return oauthError(c, http.StatusBadRequest, OAuthInvalidGrant, CodeVerifierInvalid)
+		}
+
+		// FIND API TOKEN IN REDIS
+		k := fmt.Sprintf(a.Redis.GetConfig().APIKey, clientID)
+		cipherKey, err = a.Redis.FindString(k)
+		if err != nil || cipherKey == "" {
+			return oauthError(c, http.StatusUnauthorized, OAuthInvalidClient, fmt.Sprintf(ServiceNotRegistered, clientID))
+		}
+	} else {
+		var service string
+		var e *ErrContent
+		service, cipherKey, e = a.authenticateService(c)
+		if e != nil || service != clientID {
+			c.Response().Header().Set(echo.HeaderWWWAuthenticate, `Basic realm="oauth"`)
+			return oauthError(c, http.StatusUnauthorized, OAuthInvalidClient, ServiceUnauthorized)
+		}
+	}
+
+	// 3 - CREATE THE SESSION
+	tkObj := &sec.TokenClaims{Username: ac.Username, Service: ac.Service, Groups: ac.Groups, Roles: ac.Roles, Name: ac.Name, Email: ac.Email, Realm: ac.Realm, Claims: ac.Claims}
+	r, e := a.createSession(tkObj, cipherKey)
+	if e != nil {
+		return oauthError(c, e.Code, OAuthServerError, e.Message)
+	}
+
+	res := &strut.TokenResponse{
+		AccessToken:  r.Token,
+		TokenType:    TokenTypeBearer,
+		ExpiresIn:    tkObj.ExpiresAt - tkObj.IssuedAt,
+		RefreshToken: r.RefreshToken,
+		Scope:        ac.Scope,
+	}
+
+	// 4 - OPENID CONNECT ID TOKEN
+	if hasScope(ac.Scope, ScopeOpenID) {
+		if res.IDToken, err = a.createIDToken(ac, cipherKey); err != nil {
+			return oauthError(c, http.StatusInternalServerError, OAuthServerError, err.Error())
+		}
+	}
+
+	return c.JSON(http.StatusOK, res)
+}
+
+// Returns the seconds an authorization code can be exchanged
+func (a *API) codeTTL() int {
+	if ttl := a.Redis.GetConfig().CodeTTL; ttl > 0 {
+		return ttl
+	}
+	return DefaultCodeTTL
+}
+
+// Checks the PKCE verifier matches the S256 challenge of the authorization request
+func verifyCodeChallenge(verifier string, challenge string) bool {
+	// RFC 7636 verifiers have between 43 and 128 characters
+	if len(verifier) < 43 || len(verifier) > 128 {
+		return false
+	}
+	sum := sha256.Sum256([]byte(verifier))
+	expected := base64.RawURLEncoding.EncodeToString(sum[:])
+	return subtle.ConstantTimeCompare([]byte(expected), []byte(challenge)) == 1
+}
+
+// Redirects back to the service with the error of the authorization request
+func authorizeError(c echo.Context, o authorizeRequest, err string, description string) error {
+	v := url.Values{"error": {err}, "error_description": {description}}
+	if o.State != "" {
+		v.Set("state", o.State)
+	}
+	return c.Redirect(http.StatusFound, redirectWith(o.RedirectURI, v))
+}
+
+// Adds the values to the query of the redirect URI
+func redirectWith(uri string, v url.Values) string {
+	u, err := url.Parse(uri)
+	if err != nil {
+		return uri
+	}
+	q := u.Query()
+	for k := range v {
+		if v.Get(k) != "" {
+			q.Set(k, v.Get(k))
+		}
+	}
+	u.RawQuery = q.Encode()
+	return u.String()
+}
+
+// Renders the login form with a new anti-CSRF token, in the hidden field and in the HttpOnly cookie of the login page
+func (a *API) renderLoginForm(c echo.Context, code int, p *loginPage) error {
+	token, err := randomString(32)
+	if err != nil {
+		return authorizeError(c, p.authorizeRequest, OAuthServerError, err.Error())
+	}
+
+	c.SetCookie(a.loginCookie(c, p.ClientID, token, 0))
+	p.CSRFToken = token
+	return renderLogin(c, code, p)
+}
+
+// Builds the cookie of the anti-CSRF token of the login form, only sent back to the login page
+func (a *API) loginCookie(c echo.Context, service string, token string, maxAge int) *http.Cookie {
+	ck := a.cookie(service, CookieSuffixLogin, token, true, maxAge)
+	ck.Path = c.Request().URL.Path
+	return ck
+}
+
+// Renders the hosted login page, no other site can frame it to clickjack the password form
+func renderLogin(c echo.Context, code int, p *loginPage) error {
+	c.Response().Header().Set(echo.HeaderContentType, echo.MIMETextHTMLCharsetUTF8)
+	c.Response().Header().Set(echo.HeaderXFrameOptions, "DENY")
+	c.Response().Header().Set(echo.HeaderContentSecurityPolicy, "frame-ancestors 'none'")
+	c.Response().WriteHeader(code)
+	return loginTemplate.Execute(c.Response(), p)
+}
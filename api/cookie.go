@@ -0,0 +1,217 @@
+package api
+
+import (
+	"crypto/subtle"
+	"github.com/labstack/echo"
+	strut "github.com/pintobikez/authentication-service/api/structures"
+	redis "github.com/pintobikez/authentication-service/redis"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+const (
+	HeaderCSRFToken     = "X-CSRF-Token"
+	CSRFTokenInvalid    = "The CSRF Token is missing or invalid"
+	DefaultCookiePrefix = "auth_"
+	CookieSuffixCSRF    = "_csrf"
+	CookieSuffixRefresh = "_refresh"
+	CookieSuffixLogin   = "_login"
+	// Seconds the browsers cache the preflight requests
+	CORSMaxAge = 600
+)
+
+var (
+	corsMethods = strings.Join([]string{echo.GET, echo.HEAD, echo.POST, echo.OPTIONS}, ",")
+	corsExpose  = strings.Join([]string{HeaderAuthUser, HeaderAuthName, HeaderAuthGroups}, ",")
+)
+
+// Returns the registration of the service, nil if it has none
+func (a *API) findService(name string) (*redis.Service, *ErrContent) {
+	s, err := a.Redis.FindService(name)
+	if err != nil {
+		return nil, &ErrContent{http.StatusInternalServerError, err.Error()}
+	}
+	return s, nil
+}
+
+// Returns the name of the cookie of the service, the suffix identifies the CSRF and refresh cookies
+func (a *API) cookieName(service string, suffix string) string {
+	prefix := a.Cookies.Prefix
+	if prefix == "" {
+		prefix = DefaultCookiePrefix
+	}
+	return prefix + service + suffix
+}
+
+// Builds a cookie of the service with the configured attributes
+func (a *API) cookie(service string, suffix string, value string, httpOnly bool, maxAge int) *http.Cookie {
+	path := a.Cookies.Path
+	if path == "" {
+		path = "/"
+	}
+
+	sameSite := http.SameSiteStrictMode
+	switch strings.ToLower(a.Cookies.SameSite) {
+	case "lax":
+		sameSite = http.SameSiteLaxMode
+	case "none":
+		sameSite = http.SameSiteNoneMode
+	}
+
+	return &http.Cookie{
+		Name:     a.cookieName(service, suffix),
+		Value:    value,
+		Path:     path,
+		Domain:   a.Cookies.Domain,
+		MaxAge:   maxAge,
+		Secure:   !a.Cookies.Insecure,
+		HttpOnly: httpOnly,
+		SameSite: sameSite,
+	}
+}
+
+// Sets the session cookies of the service and returns the CSRF Token.
+// The tokens are HttpOnly, the CSRF Token is readable by the browser to send it back in the X-CSRF-Token header.
+func (a *API) setSessionCookies(c echo.Context, service string, token string, refresh string) (string, error) {
+
+	csrf, err := randomString(32)
+	if err != nil {
+		return "", err
+	}
+
+	c.SetCookie(a.cookie(service, "", token, true, 0))
+	if refresh != "" {
+		c.SetCookie(a.cookie(service, CookieSuffixRefresh, refresh, true, a.Redis.GetConfig().RefreshTTL))
+	}
+	c.SetCookie(a.cookie(service, CookieSuffixCSRF, csrf, false, 0))
+
+	return csrf, nil
+}
+
+// Moves the tokens of the response to the session cookies, only the CSRF Token is kept in the body
+func (a *API) cookieResponse(c echo.Context, service string, r *strut.AuthenticateResponse) error {
+
+	csrf, err := a.setSessionCookies(c, service, r.Token, r.RefreshToken)
+	if err != nil {
+		return err
+	}
+
+	r.Token, r.RefreshToken, r.CSRFToken = "", "", csrf
+	return nil
+}
+
+// Removes the session cookies of the service from the browser
+func (a *API) clearSessionCookies(c echo.Context, service string) {
+	for _, suffix := range []string{"", CookieSuffixRefresh, CookieSuffixCSRF} {
+		c.SetCookie(a.cookie(service, suffix, "", suffix != CookieSuffixCSRF, -1))
+	}
+}
+
+// Retrieves the value of the cookie of the service, empty if it wasn't sent
+func (a *API) cookieValue(c echo.Context, service string, suffix string) string {
+	ck, err := c.Cookie(a.cookieName(service, suffix))
+	if err != nil {
+		return ""
+	}
+	return ck.Value
+}
+
+// Double submit check of the requests authenticated by cookie,
+// the X-CSRF-Token header must hold the value of the CSRF cookie
+func (a *API) checkCSRF(c echo.Context, service string) *ErrContent {
+
+	switch c.Request().Method {
+	case echo.GET, echo.HEAD, echo.OPTIONS:
+		return nil
+	}
+
+	if !a.sameAsCookie(c, service, CookieSuffixCSRF, c.Request().Header.Get(HeaderCSRFToken)) {
+		return &ErrContent{http.StatusForbidden, CSRFTokenInvalid}
+	}
+
+	return nil
+}
+
+// Tells if the value sent by the request is the one of the cookie of the service
+func (a *API) sameAsCookie(c echo.Context, service string, suffix string, value string) bool {
+	ck := a.cookieValue(c, service, suffix)
+	return ck != "" && subtle.ConstantTimeCompare([]byte(value), []byte(ck)) == 1
+}
+
+// CORS middleware that allows credentials only to the origins registered by the services,
+// the other origins are answered with the wildcard origin.
+// The service is taken from the Requester header or the service query parameter,
+// preflight requests don't send it so the origins of every service are allowed.
+func (a *API) CORS() echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+
+			req := c.Request()
+			res := c.Response()
+			origin := req.Header.Get(echo.HeaderOrigin)
+
+			res.Header().Add(echo.HeaderVary, echo.HeaderOrigin)
+			if origin == "" {
+				return next(c)
+			}
+
+			allowed, e := a.allowsOrigin(c, origin)
+			if e != nil {
+				return c.JSON(e.Code, e)
+			}
+			if allowed {
+				res.Header().Set(echo.HeaderAccessControlAllowOrigin, origin)
+				res.Header().Set(echo.HeaderAccessControlAllowCredentials, "true")
+			} else {
+				res.Header().Set(echo.HeaderAccessControlAllowOrigin, "*")
+			}
+
+			// Simple request
+			if req.Method != echo.OPTIONS {
+				res.Header().Set(echo.HeaderAccessControlExposeHeaders, corsExpose)
+				return next(c)
+			}
+
+			// Preflight request
+			res.Header().Add(echo.HeaderVary, echo.HeaderAccessControlRequestMethod)
+			res.Header().Add(echo.HeaderVary, echo.HeaderAccessControlRequestHeaders)
+			res.Header().Set(echo.HeaderAccessControlAllowMethods, corsMethods)
+			if h := req.Header.Get(echo.HeaderAccessControlRequestHeaders); h != "" {
+				res.Header().Set(echo.HeaderAccessControlAllowHeaders, h)
+			}
+			res.Header().Set(echo.HeaderAccessControlMaxAge, strconv.Itoa(CORSMaxAge))
+
+			return c.NoContent(http.StatusNoContent)
+		}
+	}
+}
+
+// Checks if the origin is registered by the service of the request, or by any service when it is unknown
+func (a *API) allowsOrigin(c echo.Context, origin string) (bool, *ErrContent) {
+
+	name := c.Request().Header.Get(HeaderService)
+	if name == "" {
+		name = c.QueryParam("service")
+	}
+
+	if name != "" {
+		s, e := a.findService(name)
+		if e != nil {
+			return false, e
+		}
+		return s != nil && s.AllowsOrigin(origin), nil
+	}
+
+	services, err := a.Redis.FindServices()
+	if err != nil {
+		return false, &ErrContent{http.StatusInternalServerError, err.Error()}
+	}
+	for _, s := range services {
+		if s.AllowsOrigin(origin) {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
@@ -0,0 +1,166 @@
+package api
+
+import (
+	"fmt"
+	"github.com/labstack/echo"
+	strut "github.com/pintobikez/authentication-service/api/structures"
+	"github.com/pintobikez/authentication-service/ldap"
+	"net/http"
+	"strconv"
+)
+
+const (
+	DirectoryForbidden = "Service %s is not allowed to look up the directory"
+	GroupNotFound      = "The group doesn't exist"
+	LimitInvalid       = "limit must be between 1 and %d"
+	// Users returned by the lists when the request has no limit, and the most it can ask for
+	DirectoryLimit    = 100
+	DirectoryMaxLimit = 1000
+)
+
+// DirectoryAuth allows the directory lookups to the registered services with the directory permission,
+// authenticated with their name and API key
+func (a *API) DirectoryAuth() echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			service, _, e := a.authenticateService(c)
+			if e != nil {
+				c.Response().Header().Set(echo.HeaderWWWAuthenticate, `Basic realm="directory"`)
+				return c.JSON(e.Code, e)
+			}
+			svc, e := a.findService(service)
+			if e != nil {
+				return c.JSON(e.Code, e)
+			}
+			if svc == nil || !svc.Directory {
+				return c.JSON(http.StatusForbidden, &ErrContent{http.StatusForbidden, fmt.Sprintf(DirectoryForbidden, service)})
+			}
+			return next(c)
+		}
+	}
+}
+
+// Handler to look up a user of the directory
+func (a *API) DirectoryUser() echo.HandlerFunc {
+	return func(c echo.Context) error {
+
+		s, username, l := a.directorySession(c.Param("username"), c.QueryParam("realm"))
+		if l != nil {
+			return c.JSON(l.Code, l)
+		}
+		defer s.Close()
+
+		u, err := s.FindUser(username)
+		if err != nil {
+			l := loginError(err, http.StatusInternalServerError, "")
+			return c.JSON(l.Code, l)
+		}
+		if u == nil {
+			return c.JSON(http.StatusNotFound, &ErrContent{http.StatusNotFound, UserNotFound})
+		}
+
+		return c.JSON(http.StatusOK, directoryUser(u))
+	}
+}
+
+// Handler to search the users of the directory by the prefix of their username
+func (a *API) DirectorySearch() echo.HandlerFunc {
+	return func(c echo.Context) error {
+
+		if c.QueryParam("prefix") == "" {
+			return c.JSON(http.StatusBadRequest, &ErrContent{http.StatusBadRequest, fmt.Sprintf(IsEmpty, "prefix")})
+		}
+		limit, e := directoryLimit(c)
+		if e != nil {
+			return c.JSON(e.Code, e)
+		}
+
+		s, prefix, l := a.directorySession(c.QueryParam("prefix"), c.QueryParam("realm"))
+		if l != nil {
+			return c.JSON(l.Code, l)
+		}
+		defer s.Close()
+
+		users, truncated, err := s.SearchUsers(prefix, limit)
+		if err != nil {
+			l := loginError(err, http.StatusInternalServerError, "")
+			return c.JSON(l.Code, l)
+		}
+
+		return c.JSON(http.StatusOK, &strut.DirectoryUsers{Users: directoryUsers(users), Truncated: truncated})
+	}
+}
+
+// Handler to list the users member of a group of the directory
+func (a *API) DirectoryGroupMembers() echo.HandlerFunc {
+	return func(c echo.Context) error {
+
+		limit, e := directoryLimit(c)
+		if e != nil {
+			return c.JSON(e.Code, e)
+		}
+
+		// the group names aren't logins, they are looked up as given in the realm of the request
+		realm, err := a.Ldap.RealmName(c.QueryParam("realm"))
+		if err != nil {
+			return c.JSON(http.StatusBadRequest, &ErrLogin{http.StatusBadRequest, err.Error(), ""})
+		}
+		s, err := a.Ldap.Session(realm)
+		if err != nil {
+			l := loginError(err, http.StatusInternalServerError, "")
+			return c.JSON(l.Code, l)
+		}
+		defer s.Close()
+
+		g, truncated, err := s.GroupMembers(c.Param("name"), limit)
+		if err != nil {
+			l := loginError(err, http.StatusInternalServerError, "")
+			return c.JSON(l.Code, l)
+		}
+		if g == nil {
+			return c.JSON(http.StatusNotFound, &ErrContent{http.StatusNotFound, GroupNotFound})
+		}
+
+		return c.JSON(http.StatusOK, &strut.DirectoryUsers{Group: g.Name, Users: directoryUsers(g.Members), Truncated: truncated})
+	}
+}
+
+// Returns the LDAP session of the realm of the name and the name in it, the names are qualified like the logins
+func (a *API) directorySession(name string, realm string) (ldap.SessionI, string, *ErrLogin) {
+
+	realm, name, err := a.Ldap.Realm(name, realm)
+	if err != nil {
+		return nil, "", &ErrLogin{http.StatusBadRequest, err.Error(), ""}
+	}
+
+	s, err := a.Ldap.Session(realm)
+	if err != nil {
+		return nil, "", loginError(err, http.StatusInternalServerError, "")
+	}
+	return s, name, nil
+}
+
+// Returns the limit of the users of the lists
+func directoryLimit(c echo.Context) (int, *ErrContent) {
+	v := c.QueryParam("limit")
+	if v == "" {
+		return DirectoryLimit, nil
+	}
+	limit, err := strconv.Atoi(v)
+	if err != nil || limit < 1 || limit > DirectoryMaxLimit {
+		return 0, &ErrContent{http.StatusBadRequest, fmt.Sprintf(LimitInvalid, DirectoryMaxLimit)}
+	}
+	return limit, nil
+}
+
+func directoryUser(u *ldap.User) *strut.DirectoryUser {
+	return &strut.DirectoryUser{Username: u.Username, Realm: u.Realm, Name: u.Name, Email: u.Email, Claims: u.Claims}
+}
+
+func directoryUsers(users []*ldap.User) []*strut.DirectoryUser {
+	r := make([]*strut.DirectoryUser, 0, len(users))
+	for _, u := range users {
+		r = append(r, directoryUser(u))
+	}
+	return r
+}
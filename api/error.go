@@ -1,8 +1,13 @@
 package api
 
 import (
+	"errors"
+	"fmt"
 	"github.com/labstack/echo"
+	"github.com/pintobikez/authentication-service/ldap"
+	"github.com/pintobikez/authentication-service/policy"
 	"net/http"
+	"strings"
 )
 
 type (
@@ -10,8 +15,61 @@ type (
 		Code    int    `json:"error"`
 		Message string `json:"message"`
 	}
+	// ErrDenied is the error of a user refused by a service, with the unmet requirements
+	ErrDenied struct {
+		Code    int            `json:"error"`
+		Message string         `json:"message"`
+		Reason  *policy.Reason `json:"reason,omitempty"`
+	}
+	// ErrLogin is the error of a failed login, with the machine readable code of the failure
+	ErrLogin struct {
+		Code      int    `json:"error"`
+		Message   string `json:"message"`
+		ErrorCode string `json:"code,omitempty"`
+	}
 )
 
+// Status and message of the failed logins by their code
+var loginErrors = map[string]ErrLogin{
+	ldap.CodeInvalidCredentials: {http.StatusUnauthorized, InvalidCredentials, ldap.CodeInvalidCredentials},
+	// an unknown user fails like a wrong password, so the responses don't tell which users exist
+	ldap.CodeUserNotFound:         {http.StatusUnauthorized, InvalidCredentials, ldap.CodeInvalidCredentials},
+	ldap.CodeAccountDisabled:      {http.StatusForbidden, AccountDisabled, ldap.CodeAccountDisabled},
+	ldap.CodeAccountLocked:        {http.StatusForbidden, AccountLocked, ldap.CodeAccountLocked},
+	ldap.CodePasswordExpired:      {http.StatusForbidden, PasswordExpired, ldap.CodePasswordExpired},
+	ldap.CodeMustChangePassword:   {http.StatusForbidden, MustChangePassword, ldap.CodeMustChangePassword},
+	ldap.CodeDirectoryUnavailable: {http.StatusServiceUnavailable, DirectoryUnavailable, ldap.CodeDirectoryUnavailable},
+	ldap.CodePasswordPolicy:       {http.StatusBadRequest, PasswordPolicy, ldap.CodePasswordPolicy},
+}
+
+// Returns the error of the login from the typed error of the directory, the other errors have the given status and code
+func loginError(err error, code int, errorCode string) *ErrLogin {
+	var ae *ldap.AuthError
+	if errors.As(err, &ae) {
+		if e, ok := loginErrors[ae.Code]; ok {
+			return &e
+		}
+	}
+	return &ErrLogin{code, err.Error(), errorCode}
+}
+
+// Returns the code of the typed error of the directory, empty for the other errors
+func directoryCode(err error) string {
+	var ae *ldap.AuthError
+	if errors.As(err, &ae) {
+		return ae.Code
+	}
+	return ""
+}
+
+// Description returns the message with the unmet requirements
+func (d *ErrDenied) Description() string {
+	if d.Reason == nil {
+		return d.Message
+	}
+	return fmt.Sprintf("%s: %s", d.Message, strings.Join(d.Reason.Unmet, ", "))
+}
+
 func Error(err error, c echo.Context) {
 	code := http.StatusServiceUnavailable
 	msg := http.StatusText(code)
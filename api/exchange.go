@@ -0,0 +1,142 @@
+package api
+
+import (
+	"fmt"
+	"github.com/labstack/echo"
+	strut "github.com/pintobikez/authentication-service/api/structures"
+	"github.com/pintobikez/authentication-service/ldap"
+	sec "github.com/pintobikez/authentication-service/secure/structures"
+	"net/http"
+	"strings"
+)
+
+const (
+	GrantTokenExchange      = "urn:ietf:params:oauth:grant-type:token-exchange"
+	TokenTypeAccessToken    = "urn:ietf:params:oauth:token-type:access_token"
+	OAuthUnauthorizedClient = "unauthorized_client"
+	OAuthInvalidTarget      = "invalid_target"
+	// Default seconds the groups of the user are cached after the login
+	DefaultGroupsTTL = 3600
+
+	ExchangeDisabled     = "The token exchange is not enabled"
+	TokenTypeUnsupported = "Token type %s is not supported"
+	AudienceNotAllowed   = "The audience must be the service calling"
+	SubjectTokenInvalid  = "The subject_token is invalid, expired or revoked"
+	UserGroupsExpired    = "The groups of the user are not cached anymore, the user must login again"
+)
+
+// Exchanges the token of a user in a service for a token of the service calling as described in RFC 8693.
+// The user must belong to the groups registered by the service calling, checked with the groups cached at the login.
+func (a *API) tokenExchange(c echo.Context) error {
+
+	if a.Redis.GetConfig().GroupsKey == "" {
+		return oauthError(c, http.StatusBadRequest, OAuthUnsupportedGrant, ExchangeDisabled)
+	}
+
+	service, cipherKey, e := a.authenticateService(c)
+	if e != nil {
+		c.Response().Header().Set(echo.HeaderWWWAuthenticate, `Basic realm="oauth"`)
+		return oauthError(c, e.Code, OAuthInvalidClient, e.Message)
+	}
+
+	subject := c.FormValue("subject_token")
+	if subject == "" {
+		return oauthError(c, http.StatusBadRequest, OAuthInvalidRequest, fmt.Sprintf(IsEmpty, "subject_token"))
+	}
+	if t := c.FormValue("subject_token_type"); t != TokenTypeAccessToken {
+		if t == "" {
+			return oauthError(c, http.StatusBadRequest, OAuthInvalidRequest, fmt.Sprintf(IsEmpty, "subject_token_type"))
+		}
+		return oauthError(c, http.StatusBadRequest, OAuthInvalidRequest, fmt.Sprintf(TokenTypeUnsupported, t))
+	}
+	if t := c.FormValue("requested_token_type"); t != "" && t != TokenTypeAccessToken {
+		return oauthError(c, http.StatusBadRequest, OAuthInvalidRequest, fmt.Sprintf(TokenTypeUnsupported, t))
+	}
+	if aud := c.FormValue("audience"); aud != "" && aud != service {
+		return oauthError(c, http.StatusBadRequest, OAuthInvalidTarget, AudienceNotAllowed)
+	}
+
+	svc, e := a.findService(service)
+	if e != nil {
+		return oauthError(c, e.Code, OAuthServerError, e.Message)
+	}
+	if svc == nil || !svc.ChecksGroups() {
+		return oauthError(c, http.StatusBadRequest, OAuthUnauthorizedClient, fmt.Sprintf(ServiceWithoutGroups, service))
+	}
+
+	// 1 - THE SUBJECT TOKEN MUST BE A VALID SESSION OF ITS SERVICE
+	origin, e := a.validateSession(subject, tokenService(subject))
+	if e != nil {
+		if e.Code == http.StatusInternalServerError {
+			return oauthError(c, e.Code, OAuthServerError, e.Message)
+		}
+		return oauthError(c, http.StatusBadRequest, OAuthInvalidGrant, SubjectTokenInvalid)
+	}
+
+	// 2 - THE USER MUST BELONG TO THE GROUPS OF THE SERVICE CALLING
+	user := new(sec.UserEntry)
+	found, err := a.Redis.FindObject(fmt.Sprintf(a.Redis.GetConfig().GroupsKey, origin.Username), user)
+	if err != nil {
+		return oauthError(c, http.StatusInternalServerError, OAuthServerError, err.Error())
+	}
+	if !found {
+		return oauthError(c, http.StatusBadRequest, OAuthInvalidGrant, UserGroupsExpired)
+	}
+
+	allGroups := make(map[string]string)
+	for _, g := range user.Groups {
+		allGroups[g] = g
+	}
+	gr, roles, d := a.authorizeGroups(svc.Groups, svc, allGroups)
+	if d != nil {
+		if d.Code == http.StatusInternalServerError {
+			return oauthError(c, d.Code, OAuthServerError, d.Message)
+		}
+		return oauthError(c, http.StatusBadRequest, OAuthInvalidGrant, d.Description())
+	}
+
+	// 3 - CREATE THE SESSION, THE ACT CLAIM KEEPS THE SESSION IT WAS EXCHANGED FROM
+	tkObj := &sec.TokenClaims{
+		Username: origin.Username,
+		Service:  service,
+		Groups:   gr,
+		Roles:    roles,
+		Name:     user.Name,
+		Email:    user.Email,
+		Realm:    origin.Realm,
+		Claims:   user.Claims,
+		Act:      &sec.Actor{Subject: fmt.Sprintf(MachineSubject, origin.Service), Session: origin.Session, Act: origin.Act},
+	}
+	r, e := a.createSession(tkObj, cipherKey)
+	if e != nil {
+		return oauthError(c, e.Code, OAuthServerError, e.Message)
+	}
+
+	return c.JSON(http.StatusOK, &strut.TokenResponse{
+		AccessToken:     r.Token,
+		TokenType:       TokenTypeBearer,
+		ExpiresIn:       tkObj.ExpiresAt - tkObj.IssuedAt,
+		RefreshToken:    r.RefreshToken,
+		IssuedTokenType: TokenTypeAccessToken,
+	})
+}
+
+// Caches the entry of the user with every group it belongs to
+func (a *API) cacheUser(user *ldap.User, groups map[string]string) error {
+	cnf := a.Redis.GetConfig()
+	if cnf.GroupsKey == "" {
+		return nil
+	}
+
+	entry := &sec.UserEntry{Username: user.Username, Realm: user.Realm, Name: user.Name, Email: user.Email, Groups: make([]string, 0, len(groups)), Claims: user.Claims}
+	for g := range groups {
+		entry.Groups = append(entry.Groups, strings.ToUpper(g))
+	}
+
+	ttl := cnf.GroupsTTL
+	if ttl <= 0 {
+		ttl = DefaultGroupsTTL
+	}
+
+	return a.Redis.CreateObject(fmt.Sprintf(cnf.GroupsKey, user.Username), entry, ttl)
+}
@@ -0,0 +1,83 @@
+package api
+
+import (
+	"github.com/labstack/echo"
+	cnf "github.com/pintobikez/authentication-service/config/structures"
+	"net/http"
+	"strings"
+)
+
+const (
+	HeaderAuthUser   = "X-Auth-User"
+	HeaderAuthName   = "X-Auth-Name"
+	HeaderAuthGroups = "X-Auth-Groups"
+	BearerPrefix     = "Bearer "
+)
+
+// Handler for reverse proxies forward authentication (nginx auth_request, Traefik and Caddy).
+// Answers 200 with the user in the X-Auth-* headers when the token is valid, 401 otherwise.
+func (a *API) ForwardAuth(conf cnf.ForwardAuthConfig) echo.HandlerFunc {
+	header := conf.Header
+	if header == "" {
+		header = echo.HeaderAuthorization
+	}
+
+	return func(c echo.Context) error {
+
+		service := c.QueryParam("service")
+		if service == "" {
+			service = conf.Service
+		}
+		if service == "" {
+			return c.NoContent(http.StatusUnauthorized)
+		}
+
+		// without a configured cookie the session cookie of the service is used
+		cookie := conf.Cookie
+		if cookie == "" {
+			cookie = a.cookieName(service, "")
+		}
+
+		token := tokenFromRequest(c, header, cookie)
+		if token == "" {
+			return c.NoContent(http.StatusUnauthorized)
+		}
+
+		tkObj, e := a.validateSession(token, service)
+		if e != nil {
+			if e.Code == http.StatusInternalServerError {
+				return c.JSON(e.Code, e)
+			}
+			return c.NoContent(http.StatusUnauthorized)
+		}
+		// the services behind the proxy expect a user
+		if machineToken(tkObj) {
+			return c.NoContent(http.StatusUnauthorized)
+		}
+
+		c.Response().Header().Set(HeaderAuthUser, tkObj.Username)
+		c.Response().Header().Set(HeaderAuthName, tkObj.Name)
+		c.Response().Header().Set(HeaderAuthGroups, strings.Join(tkObj.Groups, ","))
+
+		return c.NoContent(http.StatusOK)
+	}
+}
+
+// Retrieves the token from the header, with or without the Bearer prefix, or from the cookie
+func tokenFromRequest(c echo.Context, header string, cookie string) string {
+
+	if v := c.Request().Header.Get(header); v != "" {
+		if strings.HasPrefix(v, BearerPrefix) {
+			return strings.TrimSpace(v[len(BearerPrefix):])
+		}
+		return v
+	}
+
+	if cookie != "" {
+		if ck, err := c.Cookie(cookie); err == nil {
+			return ck.Value
+		}
+	}
+
+	return ""
+}
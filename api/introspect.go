@@ -0,0 +1,93 @@
+package api
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"github.com/labstack/echo"
+	strut "github.com/pintobikez/authentication-service/api/structures"
+	"net/http"
+)
+
+const (
+	ServiceUnauthorized = "Invalid service credentials"
+	TokenTypeBearer     = "Bearer"
+	HeaderCacheControl  = "Cache-Control"
+)
+
+// Handler to introspect a Token as described in RFC 7662.
+// The caller authenticates with its service name and API key and only
+// the Tokens issued to the caller service are reported as active.
+func (a *API) Introspect() echo.HandlerFunc {
+	return func(c echo.Context) error {
+
+		service, cipherKey, e := a.authenticateService(c)
+		if e != nil {
+			c.Response().Header().Set(echo.HeaderWWWAuthenticate, `Basic realm="introspect"`)
+			return c.JSON(e.Code, e)
+		}
+
+		token := c.FormValue("token")
+		if token == "" {
+			return c.JSON(http.StatusBadRequest, &ErrContent{http.StatusBadRequest, fmt.Sprintf(IsEmpty, "token")})
+		}
+
+		c.Response().Header().Set(HeaderCacheControl, "no-store")
+		inactive := &strut.IntrospectionResponse{Active: false}
+
+		// 1 - VALIDATE TOKEN
+		tkObj, err := a.Secure.ValidateToken(token, cipherKey)
+		if err != nil || tkObj.Service != service {
+			return c.JSON(http.StatusOK, inactive)
+		}
+
+		// 2 - THE SESSION MUST STILL EXIST
+		key := fmt.Sprintf(a.Redis.GetConfig().TokenKey, tkObj.Username, service, token)
+		ttl, err := a.Redis.FindTTL(key)
+		if err != nil {
+			return c.JSON(http.StatusInternalServerError, &ErrContent{http.StatusInternalServerError, err.Error()})
+		}
+		if ttl == -2 {
+			return c.JSON(http.StatusOK, inactive)
+		}
+
+		return c.JSON(http.StatusOK, &strut.IntrospectionResponse{
+			Active:    true,
+			Subject:   tkObj.Subject,
+			ClientID:  tkObj.Service,
+			TokenType: TokenTypeBearer,
+			ExpiresAt: tkObj.ExpiresAt,
+			IssuedAt:  tkObj.IssuedAt,
+			Username:  tkObj.Username,
+			Name:      tkObj.Name,
+			Service:   tkObj.Service,
+			Groups:    tkObj.Groups,
+			Roles:     tkObj.Roles,
+			Scope:     tkObj.Scope,
+			Act:       tkObj.Act,
+			Realm:     tkObj.Realm,
+			Claims:    tkObj.Claims,
+			Session:   &strut.IntrospectionSession{ID: tkObj.Session, ExpiresIn: ttl},
+		})
+	}
+}
+
+// Authenticates the calling service with its name and API key, sent with
+// HTTP Basic authentication or as the client_id and client_secret form values
+func (a *API) authenticateService(c echo.Context) (string, string, *ErrContent) {
+
+	service, secret, ok := c.Request().BasicAuth()
+	if !ok {
+		service, secret = c.FormValue("client_id"), c.FormValue("client_secret")
+	}
+	if service == "" || secret == "" {
+		return "", "", &ErrContent{http.StatusUnauthorized, ServiceUnauthorized}
+	}
+
+	k := fmt.Sprintf(a.Redis.GetConfig().APIKey, service)
+	cipherKey, err := a.Redis.FindString(k)
+	if err != nil || cipherKey == "" || subtle.ConstantTimeCompare([]byte(secret), []byte(cipherKey)) != 1 {
+		return "", "", &ErrContent{http.StatusUnauthorized, ServiceUnauthorized}
+	}
+
+	return service, cipherKey, nil
+}
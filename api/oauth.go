@@ -0,0 +1,131 @@
+package api
+
+import (
+	"fmt"
+	"github.com/labstack/echo"
+	strut "github.com/pintobikez/authentication-service/api/structures"
+	sec "github.com/pintobikez/authentication-service/secure/structures"
+	"net/http"
+	"strings"
+)
+
+const (
+	GrantClientCredentials = "client_credentials"
+	// Subject of the tokens issued to a service and not to a user
+	MachineSubject = "service:%s"
+
+	OAuthInvalidRequest   = "invalid_request"
+	OAuthInvalidClient    = "invalid_client"
+	OAuthUnsupportedGrant = "unsupported_grant_type"
+	OAuthInvalidScope     = "invalid_scope"
+	OAuthServerError      = "server_error"
+
+	GrantNotSupported = "Grant type %s is not supported"
+	ScopeNotAllowed   = "Scope %s is not allowed for the service"
+)
+
+// Handler of the OAuth2 token endpoint as described in RFC 6749
+func (a *API) OAuthToken() echo.HandlerFunc {
+	return func(c echo.Context) error {
+
+		c.Response().Header().Set(HeaderCacheControl, "no-store")
+
+		switch grant := c.FormValue("grant_type"); grant {
+		case GrantClientCredentials:
+			return a.clientCredentials(c)
+		case GrantAuthorizationCode:
+			return a.authorizationCode(c)
+		case GrantTokenExchange:
+			return a.tokenExchange(c)
+		case "":
+			return oauthError(c, http.StatusBadRequest, OAuthInvalidRequest, fmt.Sprintf(IsEmpty, "grant_type"))
+		default:
+			return oauthError(c, http.StatusBadRequest, OAuthUnsupportedGrant, fmt.Sprintf(GrantNotSupported, grant))
+		}
+	}
+}
+
+// Issues a token to the service authenticated with its name and API key,
+// the token carries the granted scopes instead of the LDAP groups
+func (a *API) clientCredentials(c echo.Context) error {
+
+	service, cipherKey, e := a.authenticateService(c)
+	if e != nil {
+		c.Response().Header().Set(echo.HeaderWWWAuthenticate, `Basic realm="oauth"`)
+		return oauthError(c, e.Code, OAuthInvalidClient, e.Message)
+	}
+
+	svc, e := a.findService(service)
+	if e != nil {
+		return oauthError(c, e.Code, OAuthServerError, e.Message)
+	}
+	var allowed []string
+	if svc != nil {
+		allowed = svc.Scopes
+	}
+
+	scopes, err := grantScopes(c.FormValue("scope"), allowed)
+	if err != nil {
+		return oauthError(c, http.StatusBadRequest, OAuthInvalidScope, err.Error())
+	}
+
+	session, err := randomString(16)
+	if err != nil {
+		return oauthError(c, http.StatusInternalServerError, OAuthServerError, err.Error())
+	}
+
+	// 1 - GENERATE TOKEN
+	subject := fmt.Sprintf(MachineSubject, service)
+	tkObj := &sec.TokenClaims{Username: subject, Service: service, Session: session, Scope: strings.Join(scopes, " ")}
+	tokenString, err := a.Secure.CreateToken(tkObj, cipherKey)
+	if err != nil {
+		return oauthError(c, http.StatusInternalServerError, OAuthServerError, err.Error())
+	}
+
+	// 2 - ADD TO REDIS
+	key := fmt.Sprintf(a.Redis.GetConfig().TokenKey, subject, service, tokenString)
+	if err := a.Redis.CreateKey(key, tkObj); err != nil {
+		return oauthError(c, http.StatusInternalServerError, OAuthServerError, err.Error())
+	}
+
+	return c.JSON(http.StatusOK, &strut.TokenResponse{
+		AccessToken: tokenString,
+		TokenType:   TokenTypeBearer,
+		ExpiresIn:   tkObj.ExpiresAt - tkObj.IssuedAt,
+		Scope:       tkObj.Scope,
+	})
+}
+
+// Tells if the token was issued to a service by the client credentials grant, it has no user
+func machineToken(tk *sec.TokenClaims) bool {
+	return tk.Username == fmt.Sprintf(MachineSubject, tk.Service)
+}
+
+// Returns the requested scopes, or every allowed scope when none is requested
+func grantScopes(requested string, allowed []string) ([]string, error) {
+
+	scopes := strings.Fields(requested)
+	if len(scopes) == 0 {
+		return allowed, nil
+	}
+
+	for _, s := range scopes {
+		found := false
+		for _, o := range allowed {
+			if s == o {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf(ScopeNotAllowed, s)
+		}
+	}
+
+	return scopes, nil
+}
+
+// Writes the error response of the OAuth2 endpoints
+func oauthError(c echo.Context, code int, err string, description string) error {
+	return c.JSON(code, &strut.OAuthError{Error: err, Description: description})
+}
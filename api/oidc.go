@@ -0,0 +1,131 @@
+package api
+
+import (
+	"fmt"
+	"github.com/dgrijalva/jwt-go"
+	"github.com/labstack/echo"
+	strut "github.com/pintobikez/authentication-service/api/structures"
+	sec "github.com/pintobikez/authentication-service/secure/structures"
+	"net/http"
+	"strings"
+)
+
+const (
+	ScopeOpenID        = "openid"
+	IssuerMissing      = "OpenID Connect requires the issuer of the security configuration"
+	SubjectPublic      = "public"
+	AuthBasic          = "client_secret_basic"
+	AuthPost           = "client_secret_post"
+	AuthNone           = "none"
+	BearerInvalidToken = `Bearer error="invalid_token"`
+)
+
+// The scopes of the claims of the user, every service can request them on the login page
+var openIDScopes = []string{ScopeOpenID, "profile", "email", "groups"}
+
+// Handler of the OpenID Connect discovery document
+func (a *API) OpenIDConfiguration() echo.HandlerFunc {
+	return func(c echo.Context) error {
+
+		if a.Issuer == "" {
+			return c.JSON(http.StatusNotImplemented, &ErrContent{http.StatusNotImplemented, IssuerMissing})
+		}
+		base := strings.TrimSuffix(a.Issuer, "/")
+
+		// the id tokens are signed by the key ring, or with the API key of the service without keys
+		algs := make([]string, 0)
+		seen := make(map[string]bool)
+		for _, k := range a.Secure.JWKS().Keys {
+			if k.Alg != "" && !seen[k.Alg] {
+				seen[k.Alg] = true
+				algs = append(algs, k.Alg)
+			}
+		}
+		if len(algs) == 0 {
+			algs = append(algs, jwt.SigningMethodHS256.Alg())
+		}
+
+		return c.JSON(http.StatusOK, &strut.OpenIDConfiguration{
+			Issuer:                            a.Issuer,
+			AuthorizationEndpoint:             base + "/oauth/authorize",
+			TokenEndpoint:                     base + "/oauth/token",
+			UserInfoEndpoint:                  base + "/userinfo",
+			JWKSURI:                           base + "/.well-known/jwks.json",
+			IntrospectionEndpoint:             base + "/introspect",
+			ResponseTypesSupported:            []string{ResponseTypeCode},
+			GrantTypesSupported:               []string{GrantAuthorizationCode, GrantClientCredentials, GrantTokenExchange},
+			SubjectTypesSupported:             []string{SubjectPublic},
+			IDTokenSigningAlgValuesSupported:  algs,
+			ScopesSupported:                   openIDScopes,
+			ClaimsSupported:                   []string{"sub", "iss", "aud", "exp", "iat", "nonce", "name", "preferred_username", "email", "groups"},
+			TokenEndpointAuthMethodsSupported: []string{AuthBasic, AuthPost, AuthNone},
+			CodeChallengeMethodsSupported:     []string{ChallengeMethodS256},
+		})
+	}
+}
+
+// Handler of the OpenID Connect userinfo endpoint, returns the claims of the user of the access token
+func (a *API) UserInfo() echo.HandlerFunc {
+	return func(c echo.Context) error {
+
+		c.Response().Header().Set(HeaderCacheControl, "no-store")
+
+		token := tokenFromRequest(c, echo.HeaderAuthorization, "")
+		if token == "" {
+			c.Response().Header().Set(echo.HeaderWWWAuthenticate, TokenTypeBearer)
+			return c.JSON(http.StatusUnauthorized, &ErrContent{http.StatusUnauthorized, fmt.Sprintf(IsEmpty, echo.HeaderAuthorization)})
+		}
+
+		// the service of the token is only trusted once the token is validated with its key
+		tkObj, e := a.validateSession(token, tokenService(token))
+		if e != nil {
+			if e.Code != http.StatusInternalServerError {
+				c.Response().Header().Set(echo.HeaderWWWAuthenticate, BearerInvalidToken)
+				e.Code = http.StatusUnauthorized
+			}
+			return c.JSON(e.Code, e)
+		}
+
+		return c.JSON(http.StatusOK, &strut.UserInfo{
+			Subject:           tkObj.Subject,
+			Name:              tkObj.Name,
+			PreferredUsername: tkObj.Username,
+			Email:             tkObj.Email,
+			Groups:            tkObj.Groups,
+		})
+	}
+}
+
+// Generates the id_token of the user that logged in with the authorization code
+func (a *API) createIDToken(ac *sec.AuthorizationCode, cipherKey string) (string, error) {
+	tk := &sec.IDTokenClaims{
+		Name:              ac.Name,
+		PreferredUsername: ac.Username,
+		Email:             ac.Email,
+		Groups:            ac.Groups,
+		Nonce:             ac.Nonce,
+	}
+	tk.Subject = ac.Username
+	tk.Audience = ac.Service
+
+	return a.Secure.CreateIDToken(tk, cipherKey)
+}
+
+// Returns the service of the token without validating it
+func tokenService(token string) string {
+	tkObj := new(sec.TokenClaims)
+	if _, _, err := new(jwt.Parser).ParseUnverified(token, tkObj); err != nil {
+		return ""
+	}
+	return tkObj.Service
+}
+
+// Checks if the space separated scopes contain the scope
+func hasScope(scopes string, scope string) bool {
+	for _, s := range strings.Fields(scopes) {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
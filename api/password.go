@@ -0,0 +1,57 @@
+package api
+
+import (
+	"fmt"
+	"github.com/labstack/echo"
+	strut "github.com/pintobikez/authentication-service/api/structures"
+	"github.com/pintobikez/authentication-service/ldap"
+	"net/http"
+)
+
+// Handler to change the password of a user, the sessions of the user are revoked after the change
+func (a *API) PasswordChange() echo.HandlerFunc {
+	return func(c echo.Context) error {
+
+		o := new(strut.PasswordChangeRequest)
+		// if is an invalid json format
+		if err := c.Bind(&o); err != nil {
+			return c.JSON(http.StatusBadRequest, &ErrContent{http.StatusBadRequest, err.Error()})
+		}
+
+		if o.Username == "" {
+			return c.JSON(http.StatusBadRequest, &ErrContent{http.StatusBadRequest, fmt.Sprintf(IsEmpty, "username")})
+		}
+		if o.OldPassword == "" {
+			return c.JSON(http.StatusBadRequest, &ErrContent{http.StatusBadRequest, fmt.Sprintf(IsEmpty, "oldPassword")})
+		}
+		if o.NewPassword == "" {
+			return c.JSON(http.StatusBadRequest, &ErrContent{http.StatusBadRequest, fmt.Sprintf(IsEmpty, "newPassword")})
+		}
+
+		realm, username, err := a.Ldap.Realm(o.Username, o.Realm)
+		if err != nil {
+			return c.JSON(http.StatusBadRequest, &ErrLogin{http.StatusBadRequest, err.Error(), ""})
+		}
+
+		s, err := a.Ldap.Session(realm)
+		if err != nil {
+			l := loginError(err, http.StatusInternalServerError, "")
+			return c.JSON(l.Code, l)
+		}
+		// the connection is given back before the sessions are revoked
+		err = s.ChangePassword(username, o.OldPassword, o.NewPassword)
+		s.Close()
+		if err != nil {
+			l := loginError(err, http.StatusInternalServerError, "")
+			return c.JSON(l.Code, l)
+		}
+
+		// The tokens issued with the old password are no longer valid
+		n, err := a.Redis.DeleteSessions(ldap.Qualify(username, realm), "")
+		if err != nil {
+			return c.JSON(http.StatusInternalServerError, &ErrContent{http.StatusInternalServerError, err.Error()})
+		}
+
+		return c.JSON(http.StatusOK, &strut.RevokeResponse{Removed: n})
+	}
+}
@@ -0,0 +1,192 @@
+package api
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"github.com/labstack/echo"
+	strut "github.com/pintobikez/authentication-service/api/structures"
+	sec "github.com/pintobikez/authentication-service/secure/structures"
+	"net/http"
+)
+
+const (
+	RefreshTokenInvalid = "The provided Refresh Token is invalid or expired"
+	RefreshTokenReused  = "The provided Refresh Token was already used, the session was revoked"
+	RefreshDisabled     = "Refresh Tokens are not enabled"
+)
+
+// Handler to issue a new access token with a refresh token
+func (a *API) RefreshToken() echo.HandlerFunc {
+	return func(c echo.Context) error {
+
+		if a.Redis.GetConfig().RefreshKey == "" {
+			return c.JSON(http.StatusNotImplemented, &ErrContent{http.StatusNotImplemented, RefreshDisabled})
+		}
+
+		o := new(strut.RefreshRequest)
+		// if is an invalid json format
+		if err := c.Bind(&o); err != nil {
+			return c.JSON(http.StatusBadRequest, &ErrContent{http.StatusBadRequest, err.Error()})
+		}
+
+		// Browser sessions send the refresh token in the cookie of the service
+		fromCookie := false
+		if o.RefreshToken == "" && o.Service != "" {
+			if o.RefreshToken = a.cookieValue(c, o.Service, CookieSuffixRefresh); o.RefreshToken != "" {
+				if e := a.checkCSRF(c, o.Service); e != nil {
+					return c.JSON(e.Code, e)
+				}
+				fromCookie = true
+			}
+		}
+
+		if o.RefreshToken == "" {
+			return c.JSON(http.StatusBadRequest, &ErrContent{http.StatusBadRequest, fmt.Sprintf(IsEmpty, "refreshToken")})
+		}
+		if o.Service == "" {
+			return c.JSON(http.StatusBadRequest, &ErrContent{http.StatusBadRequest, fmt.Sprintf(IsEmpty, "service")})
+		}
+
+		// FIND API TOKEN IN REDIS
+		k := fmt.Sprintf(a.Redis.GetConfig().APIKey, o.Service)
+		cipherKey, err := a.Redis.FindString(k)
+		if err != nil || cipherKey == "" {
+			return c.JSON(http.StatusForbidden, &ErrContent{http.StatusForbidden, fmt.Sprintf(ServiceNotRegistered, o.Service)})
+		}
+
+		// 1 - ROTATE THE REFRESH TOKEN
+		rt, next, err := a.rotateRefreshToken(o.RefreshToken, o.Service)
+		if err != nil {
+			return c.JSON(http.StatusUnauthorized, &ErrContent{http.StatusUnauthorized, err.Error()})
+		}
+
+		r := &strut.AuthenticateResponse{RefreshToken: next}
+
+		// 2 - GENERATE TOKEN
+		tkObj := &sec.TokenClaims{Username: rt.Username, Service: rt.Service, Groups: rt.Groups, Roles: rt.Roles, Name: rt.Name, Email: rt.Email, Session: rt.Family, Act: rt.Act, Realm: rt.Realm, Claims: rt.Claims}
+		tokenString, err := a.Secure.CreateToken(tkObj, cipherKey)
+		if err != nil {
+			return c.JSON(http.StatusInternalServerError, &ErrContent{http.StatusInternalServerError, err.Error()})
+		}
+		r.Token = tokenString
+
+		// 3 - ADD TO REDIS
+		key := fmt.Sprintf(a.Redis.GetConfig().TokenKey, rt.Username, rt.Service, tokenString)
+		err = a.Redis.CreateKey(key, tkObj)
+		if err != nil {
+			return c.JSON(http.StatusInternalServerError, &ErrContent{http.StatusInternalServerError, err.Error()})
+		}
+
+		if fromCookie {
+			if err := a.cookieResponse(c, o.Service, r); err != nil {
+				return c.JSON(http.StatusInternalServerError, &ErrContent{http.StatusInternalServerError, err.Error()})
+			}
+		}
+
+		return c.JSON(http.StatusOK, r)
+	}
+}
+
+// Creates the first refresh token of the session of the token claims
+func (a *API) createRefreshToken(tk *sec.TokenClaims) (string, error) {
+	cnf := a.Redis.GetConfig()
+
+	token, err := randomString(32)
+	if err != nil {
+		return "", err
+	}
+
+	rt := &sec.RefreshToken{Family: tk.Session, Username: tk.Username, Service: tk.Service, Name: tk.Name, Email: tk.Email, Groups: tk.Groups, Roles: tk.Roles, Act: tk.Act, Realm: tk.Realm, Claims: tk.Claims}
+	if err := a.Redis.CreateObject(fmt.Sprintf(cnf.RefreshKey, hashToken(token)), rt, cnf.RefreshTTL); err != nil {
+		return "", err
+	}
+
+	// the family holds the only refresh token of the session that can be used
+	family := fmt.Sprintf(cnf.RefreshFamilyKey, tk.Username, tk.Service, tk.Session)
+	if _, err := a.Redis.SwapString(family, "", hashToken(token), cnf.RefreshTTL); err != nil {
+		return "", err
+	}
+
+	return token, nil
+}
+
+// Replaces the refresh token by a new one of the same family.
+// When an already rotated token is used every session of the user in the service is revoked.
+func (a *API) rotateRefreshToken(token string, service string) (*sec.RefreshToken, string, error) {
+	cnf := a.Redis.GetConfig()
+	key := fmt.Sprintf(cnf.RefreshKey, hashToken(token))
+
+	rt := new(sec.RefreshToken)
+	found, err := a.Redis.FindObject(key, rt)
+	if err != nil {
+		return nil, "", err
+	}
+	if !found || rt.Service != service {
+		return nil, "", fmt.Errorf(RefreshTokenInvalid)
+	}
+
+	family := fmt.Sprintf(cnf.RefreshFamilyKey, rt.Username, rt.Service, rt.Family)
+	if rt.Rotated {
+		return nil, "", a.revokeRefreshFamily(rt)
+	}
+
+	next, err := randomString(32)
+	if err != nil {
+		return nil, "", err
+	}
+	nextKey := fmt.Sprintf(cnf.RefreshKey, hashToken(next))
+	if err := a.Redis.CreateObject(nextKey, rt, cnf.RefreshTTL); err != nil {
+		return nil, "", err
+	}
+
+	// Only one of concurrent rotations of the same token wins, a revoked family can't be rotated.
+	// The rotated token is kept to detect its reuse, marked in the same write as the swap of the family.
+	rotated := *rt
+	rotated.Rotated = true
+	swapped, err := a.Redis.SwapStringWithObject(family, hashToken(token), hashToken(next), key, &rotated, cnf.RefreshTTL)
+	if err != nil {
+		a.Redis.DeleteKey(nextKey)
+		return nil, "", err
+	}
+	if !swapped {
+		a.Redis.DeleteKey(nextKey)
+		// the family moved on to another token, the token was used twice
+		current, err := a.Redis.FindString(family)
+		if err != nil {
+			return nil, "", err
+		}
+		if current == "" {
+			return nil, "", fmt.Errorf(RefreshTokenInvalid)
+		}
+		return nil, "", a.revokeRefreshFamily(rt)
+	}
+
+	return rt, next, nil
+}
+
+// The refresh token was reused, the tokens may be stolen so the access tokens of the user in the service
+// and their refresh tokens are revoked
+func (a *API) revokeRefreshFamily(rt *sec.RefreshToken) error {
+	if _, err := a.Redis.DeleteSessions(rt.Username, rt.Service); err != nil {
+		return err
+	}
+	return fmt.Errorf(RefreshTokenReused)
+}
+
+// Generates a random URL safe string of n bytes
+func randomString(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// Opaque tokens are only stored hashed
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
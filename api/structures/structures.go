@@ -1,14 +1,155 @@
 package structures
 
+import (
+	"encoding/json"
+	sec "github.com/pintobikez/authentication-service/secure/structures"
+)
+
 type AuthenticateRequest struct {
 	Username string   `json:"username"`
 	Password string   `json:"password"`
 	Service  string   `json:"service"`
 	Groups   []string `json:"groups"`
+	Realm    string   `json:"realm,omitempty"`
+}
+
+// PasswordChangeRequest changes the password of the user with its current one
+type PasswordChangeRequest struct {
+	Username    string `json:"username"`
+	Realm       string `json:"realm,omitempty"`
+	OldPassword string `json:"oldPassword"`
+	NewPassword string `json:"newPassword"`
 }
 
+// AuthenticateResponse of the services in cookie mode only holds the CSRF Token, the tokens are in the cookies
 type AuthenticateResponse struct {
-	Token string `json:"token"`
+	Token        string `json:"token,omitempty"`
+	RefreshToken string `json:"refreshToken,omitempty"`
+	CSRFToken    string `json:"csrfToken,omitempty"`
+}
+
+type RefreshRequest struct {
+	RefreshToken string `json:"refreshToken"`
+	Service      string `json:"service"`
+}
+
+// TokenResponse of the OAuth2 token endpoint as described in RFC 6749
+type TokenResponse struct {
+	AccessToken  string `json:"access_token"`
+	TokenType    string `json:"token_type"`
+	ExpiresIn    int64  `json:"expires_in,omitempty"`
+	RefreshToken string `json:"refresh_token,omitempty"`
+	IDToken      string `json:"id_token,omitempty"`
+	Scope        string `json:"scope,omitempty"`
+	// Type of the token issued by the token exchange
+	IssuedTokenType string `json:"issued_token_type,omitempty"`
+}
+
+// UserInfo of the OpenID Connect userinfo endpoint
+type UserInfo struct {
+	Subject           string   `json:"sub"`
+	Name              string   `json:"name,omitempty"`
+	PreferredUsername string   `json:"preferred_username,omitempty"`
+	Email             string   `json:"email,omitempty"`
+	Groups            []string `json:"groups,omitempty"`
+}
+
+// OpenIDConfiguration is the OpenID Connect discovery document
+type OpenIDConfiguration struct {
+	Issuer                            string   `json:"issuer"`
+	AuthorizationEndpoint             string   `json:"authorization_endpoint"`
+	TokenEndpoint                     string   `json:"token_endpoint"`
+	UserInfoEndpoint                  string   `json:"userinfo_endpoint"`
+	JWKSURI                           string   `json:"jwks_uri"`
+	IntrospectionEndpoint             string   `json:"introspection_endpoint"`
+	ResponseTypesSupported            []string `json:"response_types_supported"`
+	GrantTypesSupported               []string `json:"grant_types_supported"`
+	SubjectTypesSupported             []string `json:"subject_types_supported"`
+	IDTokenSigningAlgValuesSupported  []string `json:"id_token_signing_alg_values_supported"`
+	ScopesSupported                   []string `json:"scopes_supported"`
+	ClaimsSupported                   []string `json:"claims_supported"`
+	TokenEndpointAuthMethodsSupported []string `json:"token_endpoint_auth_methods_supported"`
+	CodeChallengeMethodsSupported     []string `json:"code_challenge_methods_supported"`
+}
+
+// OAuthError is the error response of the OAuth2 endpoints
+type OAuthError struct {
+	Error       string `json:"error"`
+	Description string `json:"error_description,omitempty"`
+}
+
+// ServiceRoles are the roles of a service and the LDAP groups granting each of them
+type ServiceRoles struct {
+	Service string              `json:"service,omitempty"`
+	Roles   map[string][]string `json:"roles"`
+}
+
+// DirectoryUser is a user of the directory lookups, the username is qualified with @realm outside the default realm
+type DirectoryUser struct {
+	Username string                 `json:"username"`
+	Realm    string                 `json:"realm,omitempty"`
+	Name     string                 `json:"name,omitempty"`
+	Email    string                 `json:"email,omitempty"`
+	Claims   map[string]interface{} `json:"claims,omitempty"`
+}
+
+// DirectoryUsers are the users found, or the members of the group, truncated when there were more than the limit
+type DirectoryUsers struct {
+	Group     string           `json:"group,omitempty"`
+	Users     []*DirectoryUser `json:"users"`
+	Truncated bool             `json:"truncated"`
+}
+
+type RevokeResponse struct {
+	Removed int `json:"removed"`
+}
+
+// IntrospectionResponse as described in RFC 7662
+type IntrospectionResponse struct {
+	Active    bool                  `json:"active"`
+	Subject   string                `json:"sub,omitempty"`
+	ClientID  string                `json:"client_id,omitempty"`
+	TokenType string                `json:"token_type,omitempty"`
+	ExpiresAt int64                 `json:"exp,omitempty"`
+	IssuedAt  int64                 `json:"iat,omitempty"`
+	Username  string                `json:"username,omitempty"`
+	Name      string                `json:"name,omitempty"`
+	Service   string                `json:"service,omitempty"`
+	Groups    []string              `json:"groups,omitempty"`
+	Roles     []string              `json:"roles,omitempty"`
+	Scope     string                `json:"scope,omitempty"`
+	Act       *sec.Actor            `json:"act,omitempty"`
+	Realm     string                `json:"realm,omitempty"`
+	Session   *IntrospectionSession `json:"session,omitempty"`
+	// Claims mapped from the LDAP attributes, at the top level of the response
+	Claims map[string]interface{} `json:"-"`
+}
+
+// introspectionResponse is IntrospectionResponse without its JSON methods
+type introspectionResponse IntrospectionResponse
+
+// MarshalJSON adds the mapped claims next to the members of the response
+func (r *IntrospectionResponse) MarshalJSON() ([]byte, error) {
+	b, err := json.Marshal((*introspectionResponse)(r))
+	if err != nil || len(r.Claims) == 0 {
+		return b, err
+	}
+
+	m := make(map[string]interface{}, len(r.Claims))
+	for k, v := range r.Claims {
+		m[k] = v
+	}
+	// the members of the response win over the mapped claims
+	if err := json.Unmarshal(b, &m); err != nil {
+		return nil, err
+	}
+
+	return json.Marshal(m)
+}
+
+type IntrospectionSession struct {
+	ID        string `json:"sid,omitempty"`
+	ExpiresIn int    `json:"expires_in"`
 }
 
 type HealthStatus struct {
@@ -18,6 +159,17 @@ type HealthStatus struct {
 }
 
 type HealthStatusDetail struct {
-	Status string `json:"status"`
-	Detail string `json:"detail,omitempty"`
+	Status  string                `json:"status"`
+	Detail  string                `json:"detail,omitempty"`
+	Servers []*HealthServerDetail `json:"servers,omitempty"`
+}
+
+// HealthServerDetail is the status of each LDAP server
+type HealthServerDetail struct {
+	Realm    string `json:"realm,omitempty"`
+	Address  string `json:"address"`
+	Status   string `json:"status"`
+	Failures int    `json:"failures,omitempty"`
+	Reason   string `json:"reason,omitempty"`
+	Detail   string `json:"detail,omitempty"`
 }
@@ -40,7 +40,7 @@ func init() {
 func Handler(c *cli.Context) error {
 
 	// Echo instance
-	e := &srv.Server{echo.New()}
+	e := &srv.Server{Echo: echo.New()}
 	e.HTTPErrorHandler = api.Error
 	e.Logger.SetLevel(log.INFO)
 	e.Logger.SetOutput(lg.File(c.String("log-folder") + "/app.log"))
@@ -73,43 +73,77 @@ func Handler(c *cli.Context) error {
 	} else {
 		ldapC.IsMock = true
 	}
+	defer ldapC.Close()
 
-	//loads security config
-	err := uti.LoadConfigFile(c.String("security-file"), secCnf)
+	//loads redis config
+	err := uti.LoadConfigFile(c.String("redis-file"), redisCnf)
 	if err != nil {
 		e.Logger.Fatal(err)
 	}
-	securC := &secure.TokenManager{secCnf}
+	redisC := redis.New(redisCnf)
 
-	//loads redis config
-	err = uti.LoadConfigFile(c.String("redis-file"), redisCnf)
+	//loads security config
+	err = uti.LoadConfigFile(c.String("security-file"), secCnf)
 	if err != nil {
 		e.Logger.Fatal(err)
 	}
-	redisC := redis.New(redisCnf)
+	securC, err := secure.New(secCnf)
+	if err != nil {
+		e.Logger.Fatal(err)
+	}
+	// signing keys shared through redis
+	if redisCnf.KeyRing != "" {
+		securC.Store = redisC
+	}
 
-	a := &api.API{Ldap: ldapC, Redis: redisC, Secure: securC}
+	a := &api.API{Ldap: ldapC, Redis: redisC, Secure: securC, Cookies: secCnf.Cookie, Issuer: secCnf.Issuer}
+
+	// Browsers send the preflight requests to the same routes, answered by the CORS middleware
+	cors := a.CORS()
+	browser := []string{echo.POST, echo.OPTIONS}
 
 	// Routes => api
-	e.POST("/authenticate", a.Authenticate(), mw.CORSWithConfig(
+	e.Match(browser, "/authenticate", a.Authenticate(), cors)
+	e.Match(browser, "/validate", a.Validate(), cors)
+	e.POST("/introspect", a.Introspect())
+	e.POST("/oauth/token", a.OAuthToken())
+	e.Match([]string{echo.GET, echo.POST}, "/oauth/authorize", a.Authorize())
+	e.Match([]string{echo.GET, echo.POST, echo.OPTIONS}, "/userinfo", a.UserInfo(), cors)
+	e.GET("/auth/forward", a.ForwardAuth(secCnf.Forward))
+	e.Match(browser, "/logout", a.Logout(), cors)
+	e.Match(browser, "/token/refresh", a.RefreshToken(), cors)
+	e.Match(browser, "/password/change", a.PasswordChange(), cors)
+	e.GET("/health", a.HealthStatus(), mw.CORSWithConfig(
 		mw.CORSConfig{
 			AllowOrigins: []string{"*"},
 			AllowMethods: []string{echo.GET, echo.OPTIONS, echo.HEAD},
 		},
 	))
-	e.POST("/validate", a.Validate(), mw.CORSWithConfig(
+	e.GET("/.well-known/jwks.json", a.JWKS(), mw.CORSWithConfig(
 		mw.CORSConfig{
 			AllowOrigins: []string{"*"},
-			AllowMethods: []string{echo.POST, echo.OPTIONS, echo.HEAD},
+			AllowMethods: []string{echo.GET, echo.OPTIONS, echo.HEAD},
 		},
 	))
-	e.GET("/health", a.HealthStatus(), mw.CORSWithConfig(
+	e.GET("/.well-known/openid-configuration", a.OpenIDConfiguration(), mw.CORSWithConfig(
 		mw.CORSConfig{
 			AllowOrigins: []string{"*"},
 			AllowMethods: []string{echo.GET, echo.OPTIONS, echo.HEAD},
 		},
 	))
 
+	// Routes => directory
+	dir := e.Group("/directory", a.DirectoryAuth())
+	dir.GET("/users", a.DirectorySearch())
+	dir.GET("/users/:username", a.DirectoryUser())
+	dir.GET("/groups/:name/members", a.DirectoryGroupMembers())
+
+	// Routes => admin
+	adm := e.Group("/admin", api.AdminAuth(secCnf.AdminKey))
+	adm.DELETE("/sessions/:username", a.RevokeSessions())
+	adm.GET("/services/:service/roles", a.ServiceRoles())
+	adm.PUT("/services/:service/roles", a.SaveServiceRoles())
+
 	if c.String("revision-file") != "" {
 		e.File("/rev.txt", c.String("revision-file"))
 	}
@@ -144,7 +178,7 @@ func Handler(c *cli.Context) error {
 	}()
 
 	// Graceful Shutdown
-	quit := make(chan os.Signal)
+	quit := make(chan os.Signal, 1)
 	signal.Notify(quit, os.Interrupt)
 	<-quit
 
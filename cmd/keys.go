@@ -0,0 +1,155 @@
+package main
+
+import (
+	"fmt"
+	"github.com/labstack/gommon/color"
+	uti "github.com/pintobikez/authentication-service/config"
+	strut "github.com/pintobikez/authentication-service/config/structures"
+	"github.com/pintobikez/authentication-service/redis"
+	"github.com/pintobikez/authentication-service/secure"
+	secstrut "github.com/pintobikez/authentication-service/secure/structures"
+	"gopkg.in/urfave/cli.v1"
+	"io/ioutil"
+	"time"
+)
+
+// Keys manages the signing key ring shared by all the replicas of the Authentication Service
+func Keys(c *cli.Context) error {
+
+	redisCnf = new(strut.RedisConfig)
+	//loads redis config
+	if err := uti.LoadConfigFile(c.String("redis-file"), redisCnf); err != nil {
+		printErrorAndExit(err)
+	}
+	if redisCnf.KeyRing == "" {
+		printErrorAndExit(fmt.Errorf("Redis config doesn't define the keyring"))
+	}
+	redisC := redis.New(redisCnf)
+
+	action := "list"
+	if len(c.Args()) > 0 {
+		action = c.Args()[0]
+	}
+
+	switch action {
+	case "add":
+		var pk []byte
+		if f := c.String("key-file"); f != "" {
+			b, err := ioutil.ReadFile(f)
+			if err != nil {
+				printErrorAndExit(err)
+			}
+			pk = b
+		}
+
+		// the key is only activated after every replica had time to load it
+		k, err := secure.NewSigningKey(c.String("algorithm"), pk, time.Now().Add(c.Duration("activate-in")))
+		if err != nil {
+			printErrorAndExit(err)
+		}
+		// the private keys are only stored encrypted with the cipher key
+		if err := secure.SealSigningKey(k, keysCipherKey(c)); err != nil {
+			printErrorAndExit(err)
+		}
+		if err := redisC.SaveSigningKey(k); err != nil {
+			printErrorAndExit(err)
+		}
+		printAndExit(fmt.Sprintf("Signing key %s added, active from %s", k.ID, time.Unix(k.ActivatesAt, 0).Format(time.RFC3339)))
+
+	case "retire", "remove":
+		kid := c.String("kid")
+		if kid == "" {
+			printErrorAndExit(fmt.Errorf("Flag kid must be specified"))
+		}
+
+		k := findSigningKey(redisC, kid)
+		if k == nil {
+			printAndExit(fmt.Sprintf("Signing key doesn't exist: %s", kid))
+		}
+
+		if action == "remove" {
+			if err := redisC.DeleteSigningKey(kid); err != nil {
+				printErrorAndExit(err)
+			}
+			printAndExit(fmt.Sprintf("Signing key %s removed", kid))
+		}
+
+		// the key keeps validating the outstanding tokens until it retires
+		k.RetiresAt = time.Now().Add(c.Duration("retire-in")).Unix()
+		if err := redisC.SaveSigningKey(k); err != nil {
+			printErrorAndExit(err)
+		}
+		printAndExit(fmt.Sprintf("Signing key %s retires at %s", kid, time.Unix(k.RetiresAt, 0).Format(time.RFC3339)))
+
+	case "seal":
+		cipherKey := keysCipherKey(c)
+		keys, err := redisC.FindSigningKeys()
+		if err != nil {
+			printErrorAndExit(err)
+		}
+		// encrypts the keys stored in clear by the previous versions
+		n := 0
+		for _, k := range keys {
+			if k.Sealed {
+				continue
+			}
+			if err := secure.SealSigningKey(k, cipherKey); err != nil {
+				printErrorAndExit(err)
+			}
+			if err := redisC.SaveSigningKey(k); err != nil {
+				printErrorAndExit(err)
+			}
+			n++
+		}
+		printAndExit(fmt.Sprintf("%d signing keys sealed", n))
+
+	case "list":
+		keys, err := redisC.FindSigningKeys()
+		if err != nil {
+			printErrorAndExit(err)
+		}
+		now := time.Now().Unix()
+		for _, k := range keys {
+			status := color.Green("active")
+			if k.ActivatesAt > now {
+				status = color.Yellow("pending")
+			}
+			if k.RetiresAt > 0 && k.RetiresAt <= now {
+				status = color.Red("retired")
+			}
+			fmt.Printf("%s %s %s %s\n", k.ID, k.Algorithm, time.Unix(k.ActivatesAt, 0).Format(time.RFC3339), status)
+		}
+		cli.OsExiter(0)
+
+	default:
+		printErrorAndExit(fmt.Errorf("Unknown action %s", action))
+	}
+
+	return nil
+}
+
+// Returns the cipher key of the security configuration, that encrypts the keys of the ring
+func keysCipherKey(c *cli.Context) string {
+	secCnf = new(strut.SecurityConfig)
+	if err := uti.LoadConfigFile(c.String("security-file"), secCnf); err != nil {
+		printErrorAndExit(err)
+	}
+	if secCnf.CipherKey == "" {
+		printErrorAndExit(fmt.Errorf("Security config doesn't define the cipherkey"))
+	}
+	return secCnf.CipherKey
+}
+
+// Finds a key of the signing key ring by its id
+func findSigningKey(redisC *redis.Client, kid string) *secstrut.SigningKey {
+	keys, err := redisC.FindSigningKeys()
+	if err != nil {
+		printErrorAndExit(err)
+	}
+	for _, k := range keys {
+		if k.ID == kid {
+			return k
+		}
+	}
+	return nil
+}
@@ -3,6 +3,7 @@ package main
 import (
 	"gopkg.in/urfave/cli.v1"
 	"os"
+	"time"
 )
 
 var (
@@ -95,13 +96,81 @@ func main() {
 			Name:      "register",
 			Usage:     "Register a service and returns an API Key for the service",
 			Action:    Register,
-			ArgsUsage: "[add] [remove]",
+			ArgsUsage: "[add] [update] [remove]",
+			Flags:     registerFlags,
+		},
+		cli.Command{
+			Name:      "keys",
+			Usage:     "Manage the signing key ring shared by the replicas",
+			Action:    Keys,
+			ArgsUsage: "[list] [add] [retire] [remove] [seal]",
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "algorithm",
+					Usage: "The signing `ALGORITHM` of the key to add",
+					Value: "RS256",
+				},
+				cli.StringFlag{
+					Name:  "key-file",
+					Usage: "PEM private key (or HMAC secret) `FILE` to add, generated when empty",
+					Value: "",
+				},
+				cli.StringFlag{
+					Name:  "kid",
+					Usage: "The `ID` of the key to retire or remove",
+					Value: "",
+				},
+				cli.DurationFlag{
+					Name:  "activate-in",
+					Usage: "Delay before the new key starts signing, must be longer than the keyrefresh interval",
+					Value: 5 * time.Minute,
+				},
+				cli.DurationFlag{
+					Name:  "retire-in",
+					Usage: "Delay before the key stops validating tokens, must be longer than the token ttl",
+					Value: 24 * time.Hour,
+				},
+				cli.StringFlag{
+					Name:   "security-file, sf",
+					Value:  "",
+					Usage:  "Security configuration `FILE` with the cipherkey encrypting the keys to add or seal",
+					EnvVar: "SECURITY_FILE",
+				},
+				cli.StringFlag{
+					Name:   "redis-file, rf",
+					Value:  "",
+					Usage:  "Redis configuration `FILE`",
+					EnvVar: "REDIS_FILE",
+				},
+			},
+		},
+		cli.Command{
+			Name:      "sessions",
+			Usage:     "Revoke every session of a user",
+			Action:    Sessions,
+			ArgsUsage: "[revoke]",
 			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "username",
+					Usage: "The `USERNAME` whose sessions are revoked",
+					Value: "",
+				},
+				cli.StringFlag{
+					Name:  "realm",
+					Usage: "The `REALM` of the user, by default the one of the DOMAIN\\user or user@domain",
+					Value: "",
+				},
 				cli.StringFlag{
 					Name:  "service",
-					Usage: "The name of the `SERVICE` to register",
+					Usage: "Only revoke the sessions of the `SERVICE`",
 					Value: "",
 				},
+				cli.StringFlag{
+					Name:   "ldap-file, secf",
+					Value:  "",
+					Usage:  "LDAP configuration `FILE` normalising the username, by default the username is used as given",
+					EnvVar: "LDAP_FILE",
+				},
 				cli.StringFlag{
 					Name:   "redis-file, rf",
 					Value:  "",
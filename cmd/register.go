@@ -6,10 +6,60 @@ import (
 	"github.com/labstack/gommon/color"
 	uti "github.com/pintobikez/authentication-service/config"
 	strut "github.com/pintobikez/authentication-service/config/structures"
+	"github.com/pintobikez/authentication-service/policy"
 	"github.com/pintobikez/authentication-service/redis"
 	"gopkg.in/urfave/cli.v1"
+	"strings"
 )
 
+// Flags of the register command, the settings of the service are only changed by the flags passed to update
+var registerFlags = []cli.Flag{
+	cli.StringFlag{
+		Name:  "service",
+		Usage: "The name of the `SERVICE` to register",
+		Value: "",
+	},
+	cli.BoolFlag{
+		Name:  "cookie",
+		Usage: "Keep the browser sessions of the service in cookies",
+	},
+	cli.StringSliceFlag{
+		Name:  "origin",
+		Usage: "Browser `ORIGIN` allowed to send requests with credentials, can be repeated",
+	},
+	cli.StringSliceFlag{
+		Name:  "scope",
+		Usage: "`SCOPE` granted to the service with the client credentials, can be repeated",
+	},
+	cli.StringSliceFlag{
+		Name:  "redirect-uri",
+		Usage: "`URI` the login page can redirect back to with the authorization code, can be repeated",
+	},
+	cli.StringSliceFlag{
+		Name:  "group",
+		Usage: "LDAP `GROUP` checked when the users log in without sending the groups, can be repeated",
+	},
+	cli.StringFlag{
+		Name:  "require",
+		Usage: "`REQUIREMENT` on the LDAP groups of the users, like \"FINANCE AND NOT CONTRACTORS\"",
+		Value: "",
+	},
+	cli.StringSliceFlag{
+		Name:  "role",
+		Usage: "`ROLE=GROUP,GROUP` granted to the users of the LDAP groups, can be repeated",
+	},
+	cli.BoolFlag{
+		Name:  "directory",
+		Usage: "Allow the service to look up the users and the groups of the directory",
+	},
+	cli.StringFlag{
+		Name:   "redis-file, rf",
+		Value:  "",
+		Usage:  "Redis configuration `FILE`",
+		EnvVar: "REDIS_FILE",
+	},
+}
+
 // Register a service in the Authentication Service and returns the generated API KEY
 func Register(c *cli.Context) error {
 
@@ -25,9 +75,9 @@ func Register(c *cli.Context) error {
 		printErrorAndExit(fmt.Errorf("Flag service must be specified"))
 	}
 
-	add := true
-	if len(c.Args()) > 0 && c.Args()[0] == "remove" {
-		add = false
+	action := "add"
+	if len(c.Args()) > 0 {
+		action = c.Args()[0]
 	}
 
 	// Try to find the service key, if already exists
@@ -37,38 +87,162 @@ func Register(c *cli.Context) error {
 		printErrorAndExit(err)
 	}
 
-	if v != "" && add {
-		printAndExit(fmt.Sprintf("Existant API KEY for service %s: %s", sName, v))
-	}
-
-	// Found and is to Delete
-	if !add {
+	switch action {
+	case "add":
 		if v != "" {
-			if err := redisC.DeleteKey(k); err != nil {
+			printAndExit(fmt.Sprintf("Existant API KEY for service %s: %s", sName, v))
+		}
+
+		// Not found lets create a Key and return it
+		vt, err := uuid.NewRandom()
+		if err != nil {
+			printErrorAndExit(err)
+		}
+
+		//Save the Key to REDIS
+		if err := redisC.CreateString(k, vt.String()); err != nil {
+			printErrorAndExit(err)
+		}
+		saveService(c, redisC, sName, false)
+
+		printAndExit(fmt.Sprintf("API KEY for service %s: %s", sName, vt.String()))
+
+	case "update":
+		if v == "" {
+			printAndExit(fmt.Sprintf("API KEY doesn't exist for service: %s", sName))
+		}
+		if redisCnf.Services == "" {
+			printErrorAndExit(fmt.Errorf("Redis config doesn't define the services"))
+		}
+		saveService(c, redisC, sName, true)
+
+		printAndExit(fmt.Sprintf("Service %s updated", sName))
+
+	case "remove":
+		// Found and is to Delete
+		if v == "" {
+			printAndExit(fmt.Sprintf("API KEY doesn't exist for service: %s", sName))
+		}
+		if err := redisC.DeleteKey(k); err != nil {
+			printErrorAndExit(err)
+		}
+		if redisCnf.Services != "" {
+			if err := redisC.DeleteService(sName); err != nil {
 				printErrorAndExit(err)
 			}
-			printAndExit(fmt.Sprintf("API KEY %s deleted for service %s", v, sName))
-		} else {
-			printAndExit(fmt.Sprintf("API KEY doesn't exist for service: %s", sName))
 		}
+		printAndExit(fmt.Sprintf("API KEY %s deleted for service %s", v, sName))
+
+	default:
+		printErrorAndExit(fmt.Errorf("Unknown action %s", action))
 	}
 
-	// Not found lets create a Key and return it
-	vt, err := uuid.NewRandom()
-	if err != nil {
-		printErrorAndExit(err)
+	return nil
+}
+
+// Saves the registration of the service with the settings of the flags, an update keeps the settings of the flags not passed
+func saveService(c *cli.Context, redisC *redis.Client, name string, update bool) {
+
+	if redisCnf.Services == "" {
+		return
 	}
 
-	//Save the Key to REDIS
-	if err := redisC.CreateString(k, vt.String()); err != nil {
+	s := &redis.Service{Name: name}
+	if update {
+		found, err := redisC.FindService(name)
+		if err != nil {
+			printErrorAndExit(err)
+		}
+		if found != nil {
+			s = found
+		}
+	}
+	if err := applyFlags(c, s); err != nil {
 		printErrorAndExit(err)
 	}
+	if err := redisC.SaveService(s); err != nil {
+		printErrorAndExit(err)
+	}
+}
+
+// Sets the settings of the service of the flags passed, an empty value clears a list
+func applyFlags(c *cli.Context, s *redis.Service) error {
 
-	printAndExit(fmt.Sprintf("API KEY for service %s: %s", sName, vt.String()))
+	if c.IsSet("role") {
+		roles, err := parseRoles(values(c.StringSlice("role")))
+		if err != nil {
+			return err
+		}
+		s.Roles = roles
+	}
+	if c.IsSet("require") {
+		if r := c.String("require"); r != "" {
+			if _, err := policy.Parse(r); err != nil {
+				return err
+			}
+		}
+		s.Require = c.String("require")
+	}
+	if c.IsSet("cookie") {
+		s.Cookie = c.Bool("cookie")
+	}
+	if c.IsSet("directory") {
+		s.Directory = c.Bool("directory")
+	}
+	if c.IsSet("origin") {
+		s.Origins = values(c.StringSlice("origin"))
+	}
+	if c.IsSet("scope") {
+		s.Scopes = values(c.StringSlice("scope"))
+	}
+	if c.IsSet("redirect-uri") {
+		s.RedirectURIs = values(c.StringSlice("redirect-uri"))
+	}
+	if c.IsSet("group") {
+		s.Groups = values(c.StringSlice("group"))
+	}
 
 	return nil
 }
 
+// Returns the values of a repeated flag without the empty ones, nil when there are none
+func values(flags []string) []string {
+	var v []string
+	for _, f := range flags {
+		if f != "" {
+			v = append(v, f)
+		}
+	}
+	return v
+}
+
+// Parses the role flags, each one is the role and its comma separated LDAP groups
+func parseRoles(flags []string) (map[string][]string, error) {
+	if len(flags) == 0 {
+		return nil, nil
+	}
+
+	roles := make(map[string][]string)
+	for _, f := range flags {
+		p := strings.SplitN(f, "=", 2)
+		if len(p) != 2 || strings.TrimSpace(p[0]) == "" {
+			return nil, fmt.Errorf("Role %s must be ROLE=GROUP,GROUP", f)
+		}
+
+		role := strings.TrimSpace(p[0])
+		for _, g := range strings.Split(p[1], ",") {
+			if g = strings.TrimSpace(g); g != "" {
+				roles[role] = append(roles[role], g)
+			}
+		}
+		if len(roles[role]) == 0 {
+			return nil, fmt.Errorf("Role %s must be ROLE=GROUP,GROUP", f)
+		}
+	}
+
+	return roles, nil
+}
+
 func printErrorAndExit(err error) {
 	fmt.Printf("%s %s\n", color.Red("[ERROR]"), err.Error())
 	cli.OsExiter(1)
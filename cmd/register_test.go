@@ -0,0 +1,71 @@
+package main
+
+import (
+	"flag"
+	"github.com/pintobikez/authentication-service/redis"
+	"github.com/stretchr/testify/assert"
+	"gopkg.in/urfave/cli.v1"
+	"testing"
+)
+
+// Returns the context of the register command with the flags of the arguments
+func contextTest(t *testing.T, args ...string) *cli.Context {
+	set := flag.NewFlagSet("register", flag.ContinueOnError)
+	for _, f := range registerFlags {
+		f.Apply(set)
+	}
+	if err := set.Parse(args); err != nil {
+		t.Fatal(err)
+	}
+	return cli.NewContext(nil, set, nil)
+}
+
+// Returns a registration with every setting
+func serviceTest() *redis.Service {
+	return &redis.Service{
+		Name:         "A",
+		Cookie:       true,
+		Origins:      []string{"https://app.company.local"},
+		Scopes:       []string{"read"},
+		RedirectURIs: []string{"https://app.company.local/callback"},
+		Groups:       []string{"APP-USERS"},
+		Roles:        map[string][]string{"admin": {"APP-ADMINS"}},
+		Require:      "APP-USERS AND NOT CONTRACTORS",
+		Directory:    true,
+	}
+}
+
+/*
+Tests for the settings changed by the flags of the register command
+*/
+func TestApplyFlags(t *testing.T) {
+
+	// the update only changes the settings of the flags passed
+	s := serviceTest()
+	assert.Nil(t, applyFlags(contextTest(t, "--scope", "write", "--scope", "admin"), s))
+	expected := serviceTest()
+	expected.Scopes = []string{"write", "admin"}
+	assert.Equal(t, expected, s)
+
+	// the empty values clear the lists and the booleans can be turned off
+	s = serviceTest()
+	assert.Nil(t, applyFlags(contextTest(t, "--group", "", "--cookie=false", "--directory=false", "--require", ""), s))
+	expected = serviceTest()
+	expected.Groups, expected.Cookie, expected.Directory, expected.Require = nil, false, false, ""
+	assert.Equal(t, expected, s)
+
+	// the roles replace the roles of the service
+	s = serviceTest()
+	assert.Nil(t, applyFlags(contextTest(t, "--role", "viewer=APP-USERS,IT-OPS"), s))
+	assert.Equal(t, map[string][]string{"viewer": {"APP-USERS", "IT-OPS"}}, s.Roles)
+	assert.Equal(t, serviceTest().Origins, s.Origins)
+
+	// a new service only has the settings of the flags
+	s = &redis.Service{Name: "B"}
+	assert.Nil(t, applyFlags(contextTest(t, "--cookie", "--origin", "https://b.company.local"), s))
+	assert.Equal(t, &redis.Service{Name: "B", Cookie: true, Origins: []string{"https://b.company.local"}}, s)
+
+	// the invalid settings
+	assert.NotNil(t, applyFlags(contextTest(t, "--require", "APP-USERS AND"), serviceTest()))
+	assert.NotNil(t, applyFlags(contextTest(t, "--role", "admin"), serviceTest()))
+}
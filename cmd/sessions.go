@@ -0,0 +1,62 @@
+package main
+
+import (
+	"fmt"
+	uti "github.com/pintobikez/authentication-service/config"
+	strut "github.com/pintobikez/authentication-service/config/structures"
+	"github.com/pintobikez/authentication-service/ldap"
+	"github.com/pintobikez/authentication-service/redis"
+	"gopkg.in/urfave/cli.v1"
+)
+
+// Sessions revokes every session of a user, optionally only the ones of a service
+func Sessions(c *cli.Context) error {
+
+	redisCnf = new(strut.RedisConfig)
+	//loads redis config
+	if err := uti.LoadConfigFile(c.String("redis-file"), redisCnf); err != nil {
+		printErrorAndExit(err)
+	}
+	redisC := redis.New(redisCnf)
+
+	if len(c.Args()) == 0 || c.Args()[0] != "revoke" {
+		printErrorAndExit(fmt.Errorf("Unknown action, use: sessions revoke"))
+	}
+
+	if c.String("username") == "" {
+		printErrorAndExit(fmt.Errorf("Flag username must be specified"))
+	}
+
+	//loads ldap config, its realms normalise the username like the logins
+	ldapC := &ldap.Client{}
+	if c.String("ldap-file") != "" {
+		ldapCnf = new(strut.LDAPConfig)
+		if err := uti.LoadConfigFile(c.String("ldap-file"), ldapCnf); err != nil {
+			printErrorAndExit(err)
+		}
+		ldapC = ldap.New(ldapCnf)
+	}
+
+	user, err := sessionsUser(ldapC, c.String("username"), c.String("realm"))
+	if err != nil {
+		printErrorAndExit(err)
+	}
+
+	n, err := redisC.DeleteSessions(user, c.String("service"))
+	if err != nil {
+		printErrorAndExit(err)
+	}
+
+	printAndExit(fmt.Sprintf("%d sessions revoked for user %s", n, user))
+
+	return nil
+}
+
+// Returns the username of the sessions of the user, normalised and qualified with the realm like the logins
+func sessionsUser(lc ldap.ClientI, username, realm string) (string, error) {
+	realm, username, err := lc.Realm(username, realm)
+	if err != nil {
+		return "", err
+	}
+	return ldap.Qualify(username, realm), nil
+}
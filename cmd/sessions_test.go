@@ -0,0 +1,42 @@
+package main
+
+import (
+	strut "github.com/pintobikez/authentication-service/config/structures"
+	"github.com/pintobikez/authentication-service/ldap"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+/* Test for the username of the revoked sessions */
+func TestSessionsUser(t *testing.T) {
+
+	acme := &strut.LDAPConfig{Domains: []string{"acme.local"}}
+	acme.Username.Lowercase = true
+	lc := ldap.New(&strut.LDAPConfig{Realms: map[string]*strut.LDAPConfig{"ACME": acme}})
+	defer lc.Close()
+
+	provider := []struct {
+		username, realm, user, err string
+	}{
+		{"jdoe", "", "jdoe", ""},                                  // default realm
+		{`ACME\JDoe`, "", "jdoe@ACME", ""},                        // realm of the prefix, normalised
+		{"JDoe@acme.local", "", "jdoe@ACME", ""},                  // realm of the domain
+		{"JDoe", "acme", "jdoe@ACME", ""},                         // realm of the flag
+		{"jdoe", "other", "", "Unknown realm other"},              // unknown realm
+		{"j\ndoe", "", "", "The username has control characters"}, // invalid username
+	}
+	for _, test := range provider {
+		user, err := sessionsUser(lc, test.username, test.realm)
+		if test.err != "" {
+			assert.EqualError(t, err, test.err)
+			continue
+		}
+		assert.Nil(t, err)
+		assert.Equal(t, test.user, user, test.username)
+	}
+
+	// without the LDAP configuration the username is used as given
+	user, err := sessionsUser(&ldap.Client{}, `ACME\JDoe`, "")
+	assert.Nil(t, err)
+	assert.Equal(t, `ACME\JDoe`, user)
+}
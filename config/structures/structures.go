@@ -12,19 +12,124 @@ type LDAPConfig struct {
 	SkipTLS     bool   `yaml:"skipTLS,omitempty"`
 	SSLKey      string `yaml:"ssl-key,omitempty"`
 	SSLCert     string `yaml:"ssl-cert,omitempty"`
+	// CA bundle verifying the certificates of the servers, the system roots by default
+	CACert string `yaml:"ca-cert,omitempty"`
+	// Minimum TLS version: 1.0, 1.1, 1.2 or 1.3, 1.2 by default
+	MinTLSVersion string `yaml:"minTLSVersion,omitempty"`
+	// Accepts any certificate, the passwords can be captured by a man in the middle
+	InsecureSkipVerify bool `yaml:"insecureSkipVerify,omitempty"`
+	// Attribute of the user entry holding the email, mail by default
+	EmailAttribute string `yaml:"emailAttribute,omitempty"`
+	// Attributes of the user entry embedded as claims in the tokens
+	Claims []ClaimMapping `yaml:"claims,omitempty"`
+	// Connection pool, the timeouts are in seconds
+	MaxOpen     int `yaml:"maxOpen,omitempty"`
+	MaxIdle     int `yaml:"maxIdle,omitempty"`
+	IdleTimeout int `yaml:"idleTimeout,omitempty"`
+	PoolTimeout int `yaml:"poolTimeout,omitempty"`
+	// Searches the user with the service account and binds as the DN found, instead of the bindDN pattern
+	SearchBind bool   `yaml:"searchBind,omitempty"`
+	ServiceDN  string `yaml:"serviceDN,omitempty"`
+	// Password of the service account, read from the file or the environment variable when they are set
+	ServicePassword     string `yaml:"servicePassword,omitempty"`
+	ServicePasswordFile string `yaml:"servicePasswordFile,omitempty"`
+	ServicePasswordEnv  string `yaml:"servicePasswordEnv,omitempty"`
+	// Strategy resolving the nested groups: inChain, tokenGroups or recursive, only the direct groups by default
+	NestedGroups string `yaml:"nestedGroups,omitempty"`
+	// Levels of groups walked by the recursive strategy, 10 by default
+	NestedDepth int `yaml:"nestedDepth,omitempty"`
+	// Operation changing the passwords: activeDirectory or passwordModify (RFC 3062), activeDirectory by default
+	PasswordChange string `yaml:"passwordChange,omitempty"`
+	// Attribute of the user entry holding the username in the directory lookups, the one of the userFilter by default
+	UsernameAttribute string `yaml:"usernameAttribute,omitempty"`
+	// Filter of the groups by name, and of the members of a group by its DN, in the directory lookups
+	GroupNameFilter string `yaml:"groupNameFilter,omitempty"`
+	MemberFilter    string `yaml:"memberFilter,omitempty"`
+	// Entries of each page of the directory lookups, 500 by default
+	PageSize int `yaml:"pageSize,omitempty"`
+	// Servers used instead of the host and port, picked with the balance policy: failover by default or roundRobin
+	Servers []ServerConfig `yaml:"servers,omitempty"`
+	Balance string         `yaml:"balance,omitempty"`
+	// Seconds a failed server is skipped, doubled at each failure in a row
+	Backoff int `yaml:"backoff,omitempty"`
+	// Other directories chosen by the realm of the login, the settings above are the default realm
+	Realms map[string]*LDAPConfig `yaml:"realms,omitempty"`
+	// Other names of the realm in the user@domain and DOMAIN\user logins
+	Domains []string `yaml:"domains,omitempty"`
+	// Normalisation of the usernames of the realm
+	Username UsernameConfig `yaml:"username,omitempty"`
+}
+
+// UsernameConfig normalises the usernames, so the same person always has the same sessions
+type UsernameConfig struct {
+	Trim      bool `yaml:"trim,omitempty"`
+	Lowercase bool `yaml:"lowercase,omitempty"`
+	// Removes the DOMAIN\ prefix
+	StripDomain bool `yaml:"stripDomain,omitempty"`
+	// Maps the user@domain UPN to the user sAMAccountName
+	UPNToSAM bool `yaml:"upnToSAM,omitempty"`
+}
+
+// ServerConfig is an LDAP server, the lower priorities are used first and the weights share the load of the same priority
+type ServerConfig struct {
+	Host       string `yaml:"host"`
+	Port       int    `yaml:"port"`
+	ServerName string `yaml:"servername,omitempty"`
+	Priority   int    `yaml:"priority,omitempty"`
+	Weight     int    `yaml:"weight,omitempty"`
+}
+
+// ClaimMapping maps an LDAP attribute to a claim, multi valued attributes are a list of strings
+type ClaimMapping struct {
+	Attribute string `yaml:"attribute"`
+	Claim     string `yaml:"claim"`
+	Multi     bool   `yaml:"multi,omitempty"`
 }
 
 type SecurityConfig struct {
-	CipherKey string `yaml:"cipherkey"`
-	TTL       int    `yaml:"ttl"`
+	CipherKey  string            `yaml:"cipherkey"`
+	TTL        int               `yaml:"ttl"`
+	Algorithm  string            `yaml:"algorithm,omitempty"`
+	PrivateKey string            `yaml:"privatekey,omitempty"`
+	Algorithms []string          `yaml:"algorithms,omitempty"`
+	KeyRefresh int               `yaml:"keyrefresh,omitempty"`
+	AdminKey   string            `yaml:"adminkey,omitempty"`
+	Issuer     string            `yaml:"issuer,omitempty"`
+	Forward    ForwardAuthConfig `yaml:"forward,omitempty"`
+	Cookie     CookieConfig      `yaml:"cookie,omitempty"`
+}
+
+// ForwardAuthConfig is how the forward auth endpoint finds the token and the service
+type ForwardAuthConfig struct {
+	Service string `yaml:"service,omitempty"`
+	Header  string `yaml:"header,omitempty"`
+	Cookie  string `yaml:"cookie,omitempty"`
+}
+
+// CookieConfig are the attributes of the session cookies set for the services in cookie mode
+type CookieConfig struct {
+	Prefix   string `yaml:"prefix,omitempty"`
+	Domain   string `yaml:"domain,omitempty"`
+	Path     string `yaml:"path,omitempty"`
+	SameSite string `yaml:"samesite,omitempty"`
+	Insecure bool   `yaml:"insecure,omitempty"`
 }
 
 type RedisConfig struct {
-	Mode     string `yaml:"mode"`
-	Host     string `yaml:"host"`
-	Port     int    `yaml:"port"`
-	TTL      int    `yaml:"ttl"`
-	APITTL   int    `yaml:"ttlapi"`
-	APIKey   string `yaml:"apikey"`
-	TokenKey string `yaml:"tokenkey"`
+	Mode             string `yaml:"mode"`
+	Host             string `yaml:"host"`
+	Port             int    `yaml:"port"`
+	TTL              int    `yaml:"ttl"`
+	APITTL           int    `yaml:"ttlapi"`
+	RefreshTTL       int    `yaml:"ttlrefresh,omitempty"`
+	CodeTTL          int    `yaml:"ttlcode,omitempty"`
+	GroupsTTL        int    `yaml:"ttlgroups,omitempty"`
+	APIKey           string `yaml:"apikey"`
+	TokenKey         string `yaml:"tokenkey"`
+	KeyRing          string `yaml:"keyring,omitempty"`
+	RefreshKey       string `yaml:"refreshkey,omitempty"`
+	RefreshFamilyKey string `yaml:"refreshfamilykey,omitempty"`
+	Services         string `yaml:"services,omitempty"`
+	AuthCodeKey      string `yaml:"authcodekey,omitempty"`
+	GroupsKey        string `yaml:"groupskey,omitempty"`
 }
@@ -0,0 +1,199 @@
+package ldap
+
+import (
+	"fmt"
+	"gopkg.in/ldap.v2"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+const (
+	// Default entries of each page of the directory lookups
+	DefaultPageSize = 500
+
+	defaultGroupNameFilter = "(&(|(objectClass=group)(objectClass=groupOfNames)(objectClass=groupOfUniqueNames))(cn=%s))"
+	defaultMemberFilter    = "(memberOf=%s)"
+	inChainMemberFilter    = "(memberOf:1.2.840.113556.1.4.1941:=%s)"
+)
+
+// First attribute compared to the username in the userFilter, like sAMAccountName in (&(objectClass=user)(sAMAccountName=%s))
+var usernameFilter = regexp.MustCompile(`\(([A-Za-z][A-Za-z0-9-]*)=%s\)`)
+
+// FindUser looks up the user with the service account, nil when the user isn't in the directory
+func (s *Session) FindUser(username string) (*User, error) {
+	if err := s.bindLookup(); err != nil {
+		return nil, err
+	}
+
+	entry, err := s.searchUser(username)
+	if ae, ok := err.(*AuthError); ok && ae.Code == CodeUserNotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return s.client.entryUser(entry, username), nil
+}
+
+// SearchUsers returns the users whose username starts with the prefix, sorted by username.
+// At most limit users are read, the second value tells if there were more.
+func (s *Session) SearchUsers(prefix string, limit int) ([]*User, bool, error) {
+	if err := s.bindLookup(); err != nil {
+		return nil, false, err
+	}
+
+	lc := s.client
+	entries, truncated, err := s.searchPaged(fmt.Sprintf(lc.Config.UserFilter, EscapeFilter(prefix)+"*"), lc.userAttributes(), limit)
+	if err != nil {
+		return nil, false, err
+	}
+	return lc.entryUsers(entries), truncated, nil
+}
+
+// GroupMembers returns the group with the users member of it, sorted by username, nil when the group isn't in
+// the directory. At most limit members are read, the second value tells if there were more.
+func (s *Session) GroupMembers(name string, limit int) (*Group, bool, error) {
+	if err := s.bindLookup(); err != nil {
+		return nil, false, err
+	}
+
+	lc := s.client
+	groups, err := s.searchGroups(fmt.Sprintf(lc.groupNameFilter(), EscapeFilter(name)))
+	if err != nil {
+		return nil, false, authError(err)
+	}
+	if len(groups) == 0 {
+		return nil, false, nil
+	}
+	if len(groups) > 1 {
+		return nil, false, fmt.Errorf("Group %s matches %d entries", name, len(groups))
+	}
+
+	// Only the user entries, the groups member of the group are left out
+	g := &Group{Name: strings.ToUpper(groups[0].GetAttributeValue("cn")), DN: groups[0].DN}
+	filter := fmt.Sprintf("(&%s%s)", fmt.Sprintf(lc.Config.UserFilter, "*"), fmt.Sprintf(lc.memberFilter(), EscapeFilter(g.DN)))
+	entries, truncated, err := s.searchPaged(filter, lc.userAttributes(), limit)
+	if err != nil {
+		return nil, false, err
+	}
+	g.Members = lc.entryUsers(entries)
+	return g, truncated, nil
+}
+
+// Binds as the service account, the lookups are never made with the rights of a user
+func (s *Session) bindLookup() error {
+	if s.client.Config.ServiceDN == "" {
+		return fmt.Errorf("The directory lookups need the LDAP service account")
+	}
+	return s.bindService()
+}
+
+// Searches the entries matching the filter with the paged results control of RFC 2696, so the lookups of the
+// large groups aren't cut by the size limit of the server. The search stops once more than limit entries are read,
+// at most limit of them are returned and the second value tells if there were more.
+func (s *Session) searchPaged(filter string, attributes []string, limit int) ([]*ldap.Entry, bool, error) {
+	lc := s.client
+
+	paging := ldap.NewControlPaging(uint32(lc.pageSize()))
+	if limit > 0 && limit < lc.pageSize() {
+		paging.PagingSize = uint32(limit + 1)
+	}
+	searchRequest := ldap.NewSearchRequest(
+		lc.Config.BaseDN,
+		ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, 0, 0, false,
+		filter,
+		attributes,
+		[]ldap.Control{paging},
+	)
+
+	entries := make([]*ldap.Entry, 0)
+	for {
+		sr, err := s.conn.Search(searchRequest)
+		if err != nil {
+			s.failed(err)
+			return nil, false, authError(err)
+		}
+		entries = append(entries, sr.Entries...)
+
+		var cookie []byte
+		if c, ok := ldap.FindControl(sr.Controls, ldap.ControlTypePaging).(*ldap.ControlPaging); ok {
+			cookie = c.Cookie
+		}
+		if limit > 0 && len(entries) > limit {
+			if len(cookie) > 0 {
+				// a page of size 0 abandons the search, so the server releases its state
+				paging.PagingSize = 0
+				paging.SetCookie(cookie)
+				if _, err := s.conn.Search(searchRequest); err != nil {
+					s.failed(err)
+				}
+			}
+			return entries[:limit], true, nil
+		}
+		if len(cookie) == 0 {
+			return entries, false, nil
+		}
+		paging.SetCookie(cookie)
+	}
+}
+
+// Maps the user entries to the users sorted by username
+func (lc *Client) entryUsers(entries []*ldap.Entry) []*User {
+	users := make([]*User, 0, len(entries))
+	for _, e := range entries {
+		users = append(users, lc.entryUser(e, ""))
+	}
+	sort.Slice(users, func(i, j int) bool { return users[i].Username < users[j].Username })
+	return users
+}
+
+// Maps the user entry to the user with the username of the entry, normalised as the logins of the realm,
+// or the given one when the entry has none
+func (lc *Client) entryUser(entry *ldap.Entry, username string) *User {
+	if v := entry.GetAttributeValue(lc.usernameAttribute()); v != "" {
+		username = v
+	}
+	if n, err := lc.normalize(username); err == nil {
+		username = n
+	}
+	return lc.user(username, entry)
+}
+
+// Returns the attribute holding the username, the one compared in the userFilter by default
+func (lc *Client) usernameAttribute() string {
+	if lc.Config.UsernameAttribute != "" {
+		return lc.Config.UsernameAttribute
+	}
+	if m := usernameFilter.FindStringSubmatch(lc.Config.UserFilter); m != nil {
+		return m[1]
+	}
+	return "uid"
+}
+
+// Returns the filter of the groups by name
+func (lc *Client) groupNameFilter() string {
+	if lc.Config.GroupNameFilter != "" {
+		return lc.Config.GroupNameFilter
+	}
+	return defaultGroupNameFilter
+}
+
+// Returns the filter of the members of a group, the nested members too with the inChain strategy
+func (lc *Client) memberFilter() string {
+	switch {
+	case lc.Config.MemberFilter != "":
+		return lc.Config.MemberFilter
+	case lc.Config.NestedGroups == NestedInChain:
+		return inChainMemberFilter
+	}
+	return defaultMemberFilter
+}
+
+// Returns the entries of each page of the lookups
+func (lc *Client) pageSize() int {
+	if lc.Config.PageSize > 0 {
+		return lc.Config.PageSize
+	}
+	return DefaultPageSize
+}
@@ -0,0 +1,76 @@
+package ldap
+
+import (
+	"gopkg.in/ldap.v2"
+	"regexp"
+	"strings"
+)
+
+const (
+	// The password is wrong
+	CodeInvalidCredentials = "invalid_credentials"
+	// The user isn't in the directory
+	CodeUserNotFound = "user_not_found"
+	// The account is disabled or expired
+	CodeAccountDisabled = "account_disabled"
+	// The account is locked out after too many wrong passwords
+	CodeAccountLocked = "account_locked"
+	// The password expired
+	CodePasswordExpired = "password_expired"
+	// The password must be changed before the first login
+	CodeMustChangePassword = "must_change_password"
+	// The directory can't be reached or is busy
+	CodeDirectoryUnavailable = "directory_unavailable"
+)
+
+// Sub-code of Active Directory in the message of the invalid credentials, like "data 52e"
+var adData = regexp.MustCompile(`data ([0-9a-fA-F]+)`)
+
+// Failures of the Active Directory binds by their sub-code
+var adCodes = map[string]string{
+	"525": CodeUserNotFound,
+	"52e": CodeInvalidCredentials,
+	"532": CodePasswordExpired,
+	"533": CodeAccountDisabled,
+	"701": CodeAccountDisabled,
+	"773": CodeMustChangePassword,
+	"775": CodeAccountLocked,
+}
+
+// AuthError is the typed failure of an authentication, the message is the one of the directory
+type AuthError struct {
+	Code string
+	Err  error
+}
+
+func (e *AuthError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *AuthError) Unwrap() error {
+	return e.Err
+}
+
+// Types the error of the directory, the sub-code of Active Directory tells why the credentials are invalid
+func authError(err error) error {
+	switch {
+	case unavailable(err):
+		return &AuthError{CodeDirectoryUnavailable, err}
+	case ldap.IsErrorWithCode(err, ldap.LDAPResultInvalidCredentials):
+		code := CodeInvalidCredentials
+		if m := adData.FindStringSubmatch(err.Error()); m != nil {
+			if c, ok := adCodes[strings.ToLower(m[1])]; ok {
+				code = c
+			}
+		}
+		return &AuthError{code, err}
+	}
+	return err
+}
+
+// Tells if the directory can't answer, the connection is lost or the server is busy
+func unavailable(err error) bool {
+	return ldap.IsErrorWithCode(err, ldap.ErrorNetwork) ||
+		ldap.IsErrorWithCode(err, ldap.LDAPResultBusy) ||
+		ldap.IsErrorWithCode(err, ldap.LDAPResultUnavailable)
+}
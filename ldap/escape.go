@@ -0,0 +1,50 @@
+package ldap
+
+import (
+	"fmt"
+	"strings"
+)
+
+// EscapeFilter escapes a value inserted in a search filter as described in RFC 4515,
+// so the value can't add conditions or wildcards to the filter
+func EscapeFilter(value string) string {
+	var b strings.Builder
+	for i := 0; i < len(value); i++ {
+		switch c := value[i]; c {
+		case '\\', '*', '(', ')', 0:
+			fmt.Fprintf(&b, "\\%02x", c)
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
+
+// EscapeDN escapes a value inserted as an attribute value of a DN as described in RFC 4514
+func EscapeDN(value string) string {
+	var b strings.Builder
+	for i := 0; i < len(value); i++ {
+		c := value[i]
+		switch {
+		case c == 0:
+			b.WriteString("\\00")
+		case strings.IndexByte(`\,+"<>;=`, c) >= 0,
+			i == 0 && (c == ' ' || c == '#'),
+			i == len(value)-1 && c == ' ':
+			b.WriteByte('\\')
+			b.WriteByte(c)
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
+
+// Returns the bind name of the user, the username is escaped when the pattern is a DN like uid=%s,ou=people.
+// The patterns like %s@company or COMPANY\%s are names of Active Directory and aren't escaped.
+func bindName(pattern, username string) string {
+	if strings.Contains(pattern, "=") {
+		return fmt.Sprintf(pattern, EscapeDN(username))
+	}
+	return fmt.Sprintf(pattern, username)
+}
@@ -0,0 +1,122 @@
+package ldap
+
+import (
+	"fmt"
+	"gopkg.in/ldap.v2"
+	"strings"
+)
+
+const (
+	// Groups searched with the LDAP_MATCHING_RULE_IN_CHAIN of Active Directory
+	NestedInChain = "inChain"
+	// Groups read from the tokenGroups attribute of the Active Directory user
+	NestedTokenGroups = "tokenGroups"
+	// Groups searched again with the GroupFilter for each group found
+	NestedRecursive = "recursive"
+	// Default levels of groups walked by the recursive search
+	DefaultNestedDepth = 10
+
+	inChainFilter = "(&(objectClass=group)(member:1.2.840.113556.1.4.1941:=%s))"
+)
+
+// Returns the direct and nested group entries of the user with the configured strategy
+func (s *Session) searchGroupsOfUser() ([]*ldap.Entry, error) {
+	switch s.client.Config.NestedGroups {
+	case "":
+		return s.searchGroups(fmt.Sprintf(s.client.Config.GroupFilter, EscapeFilter(s.userDN)))
+	case NestedInChain:
+		return s.searchGroups(fmt.Sprintf(inChainFilter, EscapeFilter(s.userDN)))
+	case NestedTokenGroups:
+		return s.tokenGroups()
+	case NestedRecursive:
+		return s.recursiveGroups()
+	}
+	return nil, fmt.Errorf("Unknown nested groups strategy %s", s.client.Config.NestedGroups)
+}
+
+// Searches the groups matching the filter
+func (s *Session) searchGroups(filter string) ([]*ldap.Entry, error) {
+	searchRequest := ldap.NewSearchRequest(
+		s.client.Config.BaseDN,
+		ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, 0, 0, false,
+		filter,
+		[]string{"cn"},
+		nil,
+	)
+	// Perform search for groups in LDAP
+	sr, err := s.conn.Search(searchRequest)
+	if err != nil {
+		s.failed(err)
+		return nil, err
+	}
+	return sr.Entries, nil
+}
+
+// Reads the SIDs of every group of the user, computed by Active Directory, and searches the groups with them
+func (s *Session) tokenGroups() ([]*ldap.Entry, error) {
+	searchRequest := ldap.NewSearchRequest(
+		s.userDN,
+		ldap.ScopeBaseObject, ldap.NeverDerefAliases, 0, 0, false,
+		"(objectClass=*)",
+		[]string{"tokenGroups"},
+		nil,
+	)
+	sr, err := s.conn.Search(searchRequest)
+	if err != nil {
+		s.failed(err)
+		return nil, err
+	}
+	if len(sr.Entries) == 0 {
+		return nil, fmt.Errorf("User %s not found", s.userDN)
+	}
+
+	sids := sr.Entries[0].GetRawAttributeValues("tokenGroups")
+	if len(sids) == 0 {
+		return nil, nil
+	}
+
+	var filter strings.Builder
+	filter.WriteString("(|")
+	for _, sid := range sids {
+		filter.WriteString("(objectSid=")
+		for _, b := range sid {
+			fmt.Fprintf(&filter, "\\%02x", b)
+		}
+		filter.WriteString(")")
+	}
+	filter.WriteString(")")
+
+	return s.searchGroups(filter.String())
+}
+
+// Walks the groups of the groups with the GroupFilter, level by level up to the configured depth.
+// Each group is searched once, so the cycles of groups members of each other end the walk.
+func (s *Session) recursiveGroups() ([]*ldap.Entry, error) {
+	depth := s.client.Config.NestedDepth
+	if depth <= 0 {
+		depth = DefaultNestedDepth
+	}
+
+	var groups []*ldap.Entry
+	seen := map[string]bool{strings.ToLower(s.userDN): true}
+	members := []string{s.userDN}
+	for level := 0; level < depth && len(members) > 0; level++ {
+		var next []string
+		for _, dn := range members {
+			entries, err := s.searchGroups(fmt.Sprintf(s.client.Config.GroupFilter, EscapeFilter(dn)))
+			if err != nil {
+				return nil, err
+			}
+			for _, entry := range entries {
+				if key := strings.ToLower(entry.DN); !seen[key] {
+					seen[key] = true
+					groups = append(groups, entry)
+					next = append(next, entry.DN)
+				}
+			}
+		}
+		members = next
+	}
+
+	return groups, nil
+}
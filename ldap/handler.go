@@ -1,153 +1,406 @@
 package ldap
 
 import (
-	"crypto/tls"
 	"fmt"
 	cnf "github.com/pintobikez/authentication-service/config/structures"
 	"gopkg.in/ldap.v2"
+	"io/ioutil"
+	"os"
 	"strings"
+	"time"
 )
 
 type Client struct {
-	Conn   *ldap.Conn
-	Config *cnf.LDAPConfig
-	IsBind bool
-	UserDN string
-	IsMock bool
+	Config  *cnf.LDAPConfig
+	IsMock  bool
+	pool    *Pool
+	servers *servers
+	// Name of the realm of the directory, empty for the default one
+	realm string
+	// Clients of the other realms by their lower case names and domains
+	realms map[string]*Client
+	// Clients of the other realms sorted by name
+	realmList []*Client
 }
 
 func New(c *cnf.LDAPConfig) *Client {
-	return &Client{Conn: nil, IsBind: false, Config: c, IsMock: false}
+	lc := newClient(c)
+	lc.addRealms(c.Realms)
+	return lc
 }
 
-// Connect connects to the ldap backend.
-func (lc *Client) Connect() error {
-	if lc.Conn == nil && lc.Config != nil {
-		var l *ldap.Conn
-		var err error
-		address := fmt.Sprintf("%s:%d", lc.Config.Host, lc.Config.Port)
-		if !lc.Config.UseSSL {
-			l, err = ldap.Dial("tcp", address)
+// Creates the client of one directory
+func newClient(c *cnf.LDAPConfig) *Client {
+	lc := &Client{Config: c, IsMock: false, servers: newServers(c)}
+	lc.pool = NewPool(
+		lc.dial,
+		lc.check,
+		c.MaxOpen,
+		c.MaxIdle,
+		time.Duration(c.IdleTimeout)*time.Second,
+		time.Duration(c.PoolTimeout)*time.Second,
+	)
+	return lc
+}
+
+// Session draws a connection from the pool of the directory of the realm for the request
+func (lc *Client) Session(realm string) (SessionI, error) {
+
+	if lc.IsMock {
+		return &mockSession{realm: realm}, nil
+	}
+
+	if lc.Config == nil || lc.pool == nil {
+		return nil, fmt.Errorf("LDAP Config file not loaded")
+	}
+
+	rc, err := lc.realmClient(realm)
+	if err != nil {
+		return nil, err
+	}
+
+	c, err := rc.pool.Get()
+	if err != nil {
+		return nil, &AuthError{CodeDirectoryUnavailable, err}
+	}
+
+	return &Session{client: rc, conn: c}, nil
+}
+
+// Close closes the idle connections of the pools
+func (lc *Client) Close() {
+	if lc.pool != nil {
+		lc.pool.Close()
+	}
+	for _, rc := range lc.realmList {
+		rc.Close()
+	}
+}
+
+// Connects to the first ldap server answering, the connections are created by the pool
+func (lc *Client) dial() (Conn, error) {
+	var err error
+	for _, sv := range lc.servers.order() {
+		var c Conn
+		if c, err = lc.dialServer(sv); err == nil {
+			lc.servers.succeeded(sv)
+			return c, nil
+		}
+		lc.servers.failed(sv, err)
+	}
+	return nil, fmt.Errorf("No LDAP server available: %s", err)
+}
+
+// Connects to the server, verifying its certificate unless the configuration is insecure
+func (lc *Client) dialServer(sv *server) (Conn, error) {
+	var l *ldap.Conn
+	var err error
+	var verifyErr error
+
+	if !lc.Config.UseSSL {
+		l, err = ldap.Dial("tcp", sv.address)
+		if err != nil {
+			return nil, err
+		}
+		// Reconnect with TLS
+		if !lc.Config.SkipTLS {
+			config, err := lc.tlsConfig(sv, &verifyErr)
 			if err != nil {
-				return err
+				l.Close()
+				return nil, err
 			}
-			// Reconnect with TLS
-			if !lc.Config.SkipTLS {
-				err = l.StartTLS(&tls.Config{InsecureSkipVerify: true})
-				if err != nil {
-					return err
-				}
-			}
-		} else {
-			config := &tls.Config{
-				InsecureSkipVerify: true,
-				ServerName:         lc.Config.ServerName,
-			}
-			//IF there is a certificate configured
-			if lc.Config.SSLCert != "" && lc.Config.SSLKey != "" {
-				cert, err := tls.LoadX509KeyPair(lc.Config.SSLCert, lc.Config.SSLKey)
-				if err != nil {
-					return err
-				}
-				config.Certificates = append(config.Certificates, cert)
-			}
-			l, err = ldap.DialTLS("tcp", address, config)
-			if err != nil {
-				return err
+			if err = l.StartTLS(config); err != nil {
+				l.Close()
+				return nil, certificateErr(err, verifyErr)
 			}
 		}
+	} else {
+		config, err := lc.tlsConfig(sv, &verifyErr)
+		if err != nil {
+			return nil, err
+		}
+		l, err = ldap.DialTLS("tcp", sv.address, config)
+		if err != nil {
+			return nil, certificateErr(err, verifyErr)
+		}
+	}
 
-		lc.Conn = l
+	return l, nil
+}
+
+// Returns the error of the certificate when it failed the handshake
+func certificateErr(err error, verifyErr error) error {
+	if verifyErr != nil {
+		return &certificateError{verifyErr}
 	}
-	return nil
+	return err
 }
 
-// Close closes the ldap backend connection.
-func (lc *Client) Close() {
-	lc.IsBind = false
-	if lc.Conn != nil {
-		lc.Conn.Close()
-		lc.Conn = nil
+// Checks an idle connection still answers, reading the root DSE
+func (lc *Client) check(c Conn) error {
+	searchRequest := ldap.NewSearchRequest(
+		"",
+		ldap.ScopeBaseObject, ldap.NeverDerefAliases, 1, 0, false,
+		"(objectClass=*)",
+		[]string{"1.1"},
+		nil,
+	)
+	_, err := c.Search(searchRequest)
+	return err
+}
+
+// Returns the attribute holding the email of the users, mail by default
+func (lc *Client) emailAttribute() string {
+	if lc.Config.EmailAttribute != "" {
+		return lc.Config.EmailAttribute
 	}
+	return "mail"
 }
 
-// Authenticate authenticates the user against the ldap backend.
-func (lc *Client) Authenticate(username, password string) (string, error) {
+// Returns the attributes read from the user entries
+func (lc *Client) userAttributes() []string {
+	attributes := []string{"cn", lc.emailAttribute(), lc.usernameAttribute()}
+	for _, m := range lc.Config.Claims {
+		attributes = append(attributes, m.Attribute)
+	}
+	return attributes
+}
 
-	if lc.IsMock {
-		return "mock", nil
+// Maps the user entry to the user, the username is qualified with the realm outside the default realm
+func (lc *Client) user(username string, entry *ldap.Entry) *User {
+	return &User{
+		Username: Qualify(username, lc.realm),
+		Realm:    lc.realm,
+		DN:       entry.DN,
+		Name:     entry.GetAttributeValue("cn"),
+		Email:    entry.GetAttributeValue(lc.emailAttribute()),
+		Claims:   lc.mapClaims(entry),
+	}
+}
+
+// Maps the attributes of the entry to the configured claims, the attributes without value are left out
+func (lc *Client) mapClaims(entry *ldap.Entry) map[string]interface{} {
+	if len(lc.Config.Claims) == 0 {
+		return nil
 	}
 
-	if lc.Conn != nil {
-		err := lc.Connect()
+	claims := make(map[string]interface{})
+	for _, m := range lc.Config.Claims {
+		if m.Multi {
+			if v := entry.GetAttributeValues(m.Attribute); len(v) > 0 {
+				claims[m.Claim] = v
+			}
+		} else if v := entry.GetAttributeValue(m.Attribute); v != "" {
+			claims[m.Claim] = v
+		}
+	}
+
+	return claims
+}
+
+// Returns the password of the service account, the file and the environment variable are read at every bind
+// so the password can be rotated without a restart
+func (lc *Client) servicePassword() (string, error) {
+	c := lc.Config
+	switch {
+	case c.ServicePasswordFile != "":
+		b, err := ioutil.ReadFile(c.ServicePasswordFile)
 		if err != nil {
 			return "", err
 		}
+		if p := strings.TrimRight(string(b), "\r\n"); p != "" {
+			return p, nil
+		}
+	case c.ServicePasswordEnv != "":
+		if p := os.Getenv(c.ServicePasswordEnv); p != "" {
+			return p, nil
+		}
+	case c.ServicePassword != "":
+		return c.ServicePassword, nil
+	}
+	return "", fmt.Errorf("The password of the LDAP service account is not set")
+}
+
+// Servers returns the health of each LDAP server of every realm
+func (lc *Client) Servers() []ServerStatus {
+	if lc.IsMock || lc.servers == nil {
+		return nil
+	}
+
+	var st []ServerStatus
+	if lc.hasDirectory() {
+		st = lc.servers.status()
+	}
+	for _, rc := range lc.realmList {
+		for _, s := range rc.servers.status() {
+			s.Realm = rc.realm
+			st = append(st, s)
+		}
+	}
+	return st
+}
+
+// Health Endpoint of the Client, every realm must be available
+func (lc *Client) Health() error {
+
+	if lc.IsMock {
+		return nil
 	}
 
-	// Bind as the user to verify their password
-	err := lc.Conn.Bind(fmt.Sprintf(lc.Config.BindDN, username), password)
+	if lc.Config == nil {
+		return fmt.Errorf("LDAP Config file not loaded")
+	}
+
+	if lc.hasDirectory() {
+		if err := lc.health(); err != nil {
+			return err
+		}
+	}
+	for _, rc := range lc.realmList {
+		if err := rc.health(); err != nil {
+			return fmt.Errorf("Realm %s: %s", rc.realm, err)
+		}
+	}
+
+	return nil
+}
+
+// Checks the directory of the realm
+func (lc *Client) health() error {
+
+	c, err := lc.pool.Get()
 	if err != nil {
-		return "", err
+		return err
+	}
+	s := &Session{client: lc, conn: c}
+	defer s.Close()
+
+	// The service account must still be accepted
+	if lc.Config.SearchBind {
+		return s.bindService()
 	}
 
-	attributes := []string{"cn"}
+	return nil
+}
+
+// Session holds the connection and the bind state of one request, it is not safe for concurrent use
+type Session struct {
+	client *Client
+	conn   Conn
+	userDN string
+	broken bool
+}
+
+// Authenticate authenticates the user against the ldap backend and returns its entry.
+func (s *Session) Authenticate(username, password string) (*User, error) {
+
+	lc := s.client
+
+	// An empty password is an unauthenticated bind, accepted by most servers
+	if password == "" {
+		return nil, fmt.Errorf("The password of %s is empty", username)
+	}
+
+	var entry *ldap.Entry
+	var err error
+	if lc.Config.SearchBind {
+		// Find the DN of the user with the service account, then bind as the user to verify their password
+		if err = s.bindService(); err != nil {
+			return nil, err
+		}
+		if entry, err = s.searchUser(username); err != nil {
+			return nil, err
+		}
+		if err = s.conn.Bind(entry.DN, password); err != nil {
+			s.failed(err)
+			return nil, authError(err)
+		}
+	} else {
+		// Bind as the user to verify their password
+		if err = s.conn.Bind(bindName(lc.Config.BindDN, username), password); err != nil {
+			s.failed(err)
+			return nil, authError(err)
+		}
+		if entry, err = s.searchUser(username); err != nil {
+			return nil, err
+		}
+	}
+
+	u := lc.user(username, entry)
+	s.userDN = u.DN
+
+	return u, nil
+}
+
+// Searches the entry of the user with the UserFilter
+func (s *Session) searchUser(username string) (*ldap.Entry, error) {
+
+	lc := s.client
+
 	// Search for the given username
 	searchRequest := ldap.NewSearchRequest(
 		lc.Config.BaseDN,
 		ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, 0, 0, false,
-		fmt.Sprintf(lc.Config.UserFilter, username),
-		attributes,
+		fmt.Sprintf(lc.Config.UserFilter, EscapeFilter(username)),
+		lc.userAttributes(),
 		nil,
 	)
 
 	// Perform search for user in LDAP
-	sr, err := lc.Conn.Search(searchRequest)
+	sr, err := s.conn.Search(searchRequest)
 	if err != nil {
-		return "", nil
+		s.failed(err)
+		return nil, authError(err)
+	}
+	if len(sr.Entries) == 0 {
+		return nil, &AuthError{CodeUserNotFound, fmt.Errorf("User %s not found", username)}
+	}
+	// The password must not be checked against another user
+	if lc.Config.SearchBind && len(sr.Entries) > 1 {
+		return nil, fmt.Errorf("User %s matches %d entries", username, len(sr.Entries))
 	}
 
-	name := sr.Entries[0].GetAttributeValue("cn")
-	lc.UserDN = sr.Entries[0].DN
-	lc.IsBind = true
+	return sr.Entries[0], nil
+}
 
-	return name, nil
+// Binds as the service account, the connection may still be bound as the user of a previous request
+func (s *Session) bindService() error {
+	password, err := s.client.servicePassword()
+	if err != nil {
+		return err
+	}
+	if err = s.conn.Bind(s.client.Config.ServiceDN, password); err != nil {
+		s.failed(err)
+		if unavailable(err) {
+			return &AuthError{CodeDirectoryUnavailable, err}
+		}
+		return err
+	}
+	return nil
 }
 
 // GetGroupsOfUser returns the group for a user.
-func (lc *Client) GetGroupsOfUser(username string) (map[string]string, error) {
-
-	if lc.IsMock {
-		return map[string]string{"MOCK": "MOCK"}, nil
-	}
+func (s *Session) GetGroupsOfUser(username string) (map[string]string, error) {
 
-	if !lc.IsBind {
+	if s.userDN == "" {
 		return nil, fmt.Errorf("User %s is not Binded, please Login first", username)
 	}
 
-	if lc.Conn != nil {
-		err := lc.Connect()
-		if err != nil {
+	// The users may not be allowed to read the groups
+	if s.client.Config.SearchBind {
+		if err := s.bindService(); err != nil {
 			return nil, err
 		}
 	}
 
-	searchRequest := ldap.NewSearchRequest(
-		lc.Config.BaseDN,
-		ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, 0, 0, false,
-		fmt.Sprintf(lc.Config.GroupFilter, lc.UserDN),
-		[]string{"cn"},
-		nil,
-	)
-	// Perform search for groups in LDAP
-	sr, err := lc.Conn.Search(searchRequest)
+	entries, err := s.searchGroupsOfUser()
 	if err != nil {
-		return nil, err
+		return nil, authError(err)
 	}
 
 	// Map the groups
 	groups := make(map[string]string)
-	for _, entry := range sr.Entries {
+	for _, entry := range entries {
 		if entry.GetAttributeValue("cn") != "" {
 			n := strings.ToUpper(entry.GetAttributeValue("cn"))
 			groups[n] = n
@@ -157,22 +410,48 @@ func (lc *Client) GetGroupsOfUser(username string) (map[string]string, error) {
 	return groups, nil
 }
 
-// Health Endpoint of the Client
-func (lc *Client) Health() error {
-
-	if lc.IsMock {
-		return nil
+// Close gives the connection back to the pool
+func (s *Session) Close() {
+	if s.conn != nil {
+		s.client.pool.Put(s.conn, s.broken)
+		s.conn = nil
 	}
+}
 
-	if lc.Config == nil {
-		return fmt.Errorf("LDAP Config file not loaded")
+// Marks the connection as broken on network errors, it isn't given back to the idle connections
+func (s *Session) failed(err error) {
+	if ldap.IsErrorWithCode(err, ldap.ErrorNetwork) {
+		s.broken = true
 	}
+}
 
-	err := lc.Connect()
-	if err != nil {
-		return err
-	}
-	defer lc.Close()
+// mockSession authenticates every user when the LDAP is overridden
+type mockSession struct {
+	realm string
+}
+
+func (m *mockSession) Authenticate(username, password string) (*User, error) {
+	return &User{Username: Qualify(username, m.realm), Realm: m.realm, Name: "mock"}, nil
+}
+
+func (m *mockSession) GetGroupsOfUser(username string) (map[string]string, error) {
+	return map[string]string{"MOCK": "MOCK"}, nil
+}
 
+func (m *mockSession) ChangePassword(username, oldPassword, newPassword string) error {
 	return nil
 }
+
+func (m *mockSession) FindUser(username string) (*User, error) {
+	return &User{Username: Qualify(username, m.realm), Realm: m.realm, Name: "mock"}, nil
+}
+
+func (m *mockSession) SearchUsers(prefix string, limit int) ([]*User, bool, error) {
+	return []*User{}, false, nil
+}
+
+func (m *mockSession) GroupMembers(name string, limit int) (*Group, bool, error) {
+	return &Group{Name: strings.ToUpper(name), Members: []*User{}}, false, nil
+}
+
+func (m *mockSession) Close() {}
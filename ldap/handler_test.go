@@ -0,0 +1,466 @@
+package ldap
+
+import (
+	"fmt"
+	cnf "github.com/pintobikez/authentication-service/config/structures"
+	"github.com/stretchr/testify/assert"
+	"gopkg.in/ldap.v2"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+/* Test for the search-then-bind authentication with the service account */
+func TestSearchBind(t *testing.T) {
+
+	f, _ := ioutil.TempFile("", "ldap-password")
+	defer os.Remove(f.Name())
+	f.WriteString("PS\n")
+	f.Close()
+	os.Setenv("LDAP_TEST_PASSWORD", "PS")
+	defer os.Unsetenv("LDAP_TEST_PASSWORD")
+
+	dial, _ := dialTest()
+	cnf := cnfTest
+	cnf.BindDN = ""
+	cnf.SearchBind = true
+	cnf.ServiceDN = "cn=svc,dc=test"
+	lc := &Client{Config: &cnf}
+	lc.pool = NewPool(dial, nil, 1, 1, time.Minute, time.Second)
+
+	for _, src := range []struct{ password, file, env string }{{"PS", "", ""}, {"", f.Name(), ""}, {"", "", "LDAP_TEST_PASSWORD"}} {
+		cnf.ServicePassword, cnf.ServicePasswordFile, cnf.ServicePasswordEnv = src.password, src.file, src.env
+		assert.Nil(t, lc.Health())
+
+		s, _ := lc.Session("")
+		u, err := s.Authenticate("A", "PA")
+		assert.Nil(t, err)
+		assert.Equal(t, "uid=A,dc=test", u.DN)
+		assert.Equal(t, "User A", u.Name)
+
+		// the groups are searched with the service account
+		gr, err := s.GetGroupsOfUser("A")
+		assert.Nil(t, err)
+		assert.Equal(t, map[string]string{"ADMINS": "ADMINS"}, gr)
+		c := s.(*Session).conn.(*connTest)
+		assert.Equal(t, []string{"cn=svc,dc=test", "uid=A,dc=test", "cn=svc,dc=test"}, c.binds[len(c.binds)-3:])
+		s.Close()
+	}
+
+	s, _ := lc.Session("")
+
+	// the wrong password, the empty password, the unknown and the ambiguous users
+	_, err := s.Authenticate("A", "PB")
+	assert.NotNil(t, err)
+	_, err = s.Authenticate("A", "")
+	assert.NotNil(t, err)
+	_, err = s.Authenticate("Z", "PA")
+	assert.EqualError(t, err, "User Z not found")
+	_, err = s.Authenticate("M", "PM")
+	assert.EqualError(t, err, "User M matches 2 entries")
+
+	// the service account without password
+	cnf.ServicePasswordEnv = "LDAP_TEST_UNSET"
+	_, err = s.Authenticate("A", "PA")
+	assert.EqualError(t, err, "The password of the LDAP service account is not set")
+	s.Close()
+	assert.EqualError(t, lc.Health(), "The password of the LDAP service account is not set")
+}
+
+/* Test for the strategies resolving the nested groups */
+func TestNestedGroups(t *testing.T) {
+
+	provider := []struct {
+		strategy string
+		depth    int
+		groups   []string
+		err      string
+	}{
+		{"", 0, []string{"DEV"}, ""},
+		{NestedRecursive, 0, []string{"DEV", "ENG", "ALL"}, ""},
+		{NestedRecursive, 2, []string{"DEV", "ENG"}, ""},
+		{NestedInChain, 0, []string{"DEV", "ALL"}, ""},
+		{NestedTokenGroups, 0, []string{"ENG"}, ""},
+		{"unknown", 0, nil, "Unknown nested groups strategy unknown"},
+	}
+
+	for _, test := range provider {
+		cnf := cnfTest
+		cnf.NestedGroups = test.strategy
+		cnf.NestedDepth = test.depth
+		s := &Session{client: &Client{Config: &cnf}, conn: new(connTest), userDN: "uid=N,dc=test"}
+
+		gr, err := s.GetGroupsOfUser("N")
+		if test.err != "" {
+			assert.EqualError(t, err, test.err)
+			continue
+		}
+		assert.Nil(t, err)
+		expected := make(map[string]string)
+		for _, g := range test.groups {
+			expected[g] = g
+		}
+		assert.Equal(t, expected, gr, test.strategy)
+	}
+}
+
+/* Test for the realms chosen by the logins */
+func TestRealms(t *testing.T) {
+
+	acme := cnfTest
+	acme.Domains = []string{"acme.local"}
+	globex := cnfTest
+	lc := New(&cnf.LDAPConfig{Realms: map[string]*cnf.LDAPConfig{"ACME": &acme, "GLOBEX": &globex}})
+	defer lc.Close()
+
+	provider := []struct {
+		username, realm     string
+		toRealm, toUsername string
+		err                 string
+	}{
+		{`ACME\jdoe`, "", "ACME", "jdoe", ""},
+		{`acme.local\jdoe`, "", "ACME", "jdoe", ""},
+		{"jdoe@Acme.Local", "", "ACME", "jdoe", ""},
+		{"jdoe@globex", "", "GLOBEX", "jdoe", ""},
+		{"jdoe", "globex", "GLOBEX", "jdoe", ""},
+		{"jdoe@globex", "globex", "GLOBEX", "jdoe", ""},
+		{"jdoe@other", "acme", "ACME", "jdoe@other", ""},
+		{`OTHER\jdoe`, "", "", `OTHER\jdoe`, ""},
+		{"jdoe@other", "", "", "jdoe@other", ""},
+		{"jdoe", "other", "", "", "Unknown realm other"},
+	}
+	for _, test := range provider {
+		realm, username, err := lc.Realm(test.username, test.realm)
+		if test.err != "" {
+			assert.EqualError(t, err, test.err)
+			continue
+		}
+		assert.Equal(t, test.toRealm, realm, test.username)
+		assert.Equal(t, test.toUsername, username, test.username)
+	}
+
+	// the names of the realms, without a username
+	realm, err := lc.RealmName("Acme.Local")
+	assert.Nil(t, err)
+	assert.Equal(t, "ACME", realm)
+	realm, err = lc.RealmName("")
+	assert.Nil(t, err)
+	assert.Equal(t, "", realm)
+	_, err = lc.RealmName("other")
+	assert.EqualError(t, err, "Unknown realm other")
+
+	// the configuration without default realm
+	_, err = lc.Session("")
+	assert.EqualError(t, err, "The login doesn't name a realm")
+	_, err = lc.Session("other")
+	assert.EqualError(t, err, "Unknown realm other")
+
+	// each realm has its own pool, the username of the sessions is qualified with the realm
+	dial, _ := dialTest()
+	lc.realms["acme"].pool = NewPool(dial, nil, 1, 1, time.Minute, time.Second)
+	s, err := lc.Session("acme")
+	assert.Nil(t, err)
+	u, err := s.Authenticate("A", "PA")
+	assert.Nil(t, err)
+	assert.Equal(t, "A@ACME", u.Username)
+	assert.Equal(t, "ACME", u.Realm)
+	s.Close()
+	inUse, idle := lc.realms["acme"].pool.Stats()
+	assert.Equal(t, 0, inUse)
+	assert.Equal(t, 1, idle)
+}
+
+/* Test for the escaping of the values inserted in the filters and the DNs */
+func TestEscape(t *testing.T) {
+
+	assert.Equal(t, `\2a\29\28uid=\2a`, EscapeFilter("*)(uid=*"))
+	assert.Equal(t, `cn=a\5c\28b\29,dc=test`, EscapeFilter(`cn=a\(b),dc=test`))
+	assert.Equal(t, `a\00b`, EscapeFilter("a\x00b"))
+	assert.Equal(t, "José", EscapeFilter("José"))
+
+	assert.Equal(t, `Smith\, John`, EscapeDN("Smith, John"))
+	assert.Equal(t, `\#a\=b\+c\;\<\>\"\\`, EscapeDN(`#a=b+c;<>"\`))
+	assert.Equal(t, `\ a \ `, EscapeDN(" a  "))
+
+	// only the DNs are escaped
+	assert.Equal(t, `uid=a\,ou\=admins,ou=people`, bindName("uid=%s,ou=people", "a,ou=admins"))
+	assert.Equal(t, `COMPANY\a`, bindName(`COMPANY\%s`, "a"))
+	assert.Equal(t, "a,b@company", bindName("%s@company", "a,b"))
+
+	// the username can't change the search of the user
+	dial, _ := dialTest()
+	c := cnfTest
+	c.SearchBind, c.ServiceDN, c.ServicePassword = true, "cn=svc,dc=test", "PS"
+	lc := &Client{Config: &c}
+	lc.pool = NewPool(dial, nil, 1, 1, time.Minute, time.Second)
+	s, _ := lc.Session("")
+	defer s.Close()
+	_, err := s.Authenticate("*)(uid=*", "PA")
+	assert.EqualError(t, err, "User *)(uid=* not found")
+	conn := s.(*Session).conn.(*connTest)
+	assert.Equal(t, `(uid=\2a\29\28uid=\2a)`, conn.filters[len(conn.filters)-1])
+}
+
+/* Test for the normalisation of the usernames */
+func TestNormalize(t *testing.T) {
+
+	acme := cnfTest
+	acme.Username = cnf.UsernameConfig{Trim: true, Lowercase: true, StripDomain: true, UPNToSAM: true}
+	lc := New(&cnf.LDAPConfig{Host: "ldap", Username: cnf.UsernameConfig{Trim: true}, Realms: map[string]*cnf.LDAPConfig{"ACME": &acme}})
+	defer lc.Close()
+
+	provider := []struct {
+		username, realm     string
+		toRealm, toUsername string
+		err                 string
+	}{
+		{" JDoe ", "", "", "JDoe", ""},
+		{`OTHER\JDoe`, "", "", `OTHER\JDoe`, ""},
+		{` ACME\JDoe `, "", "ACME", "jdoe", ""},
+		{"JDoe@acme", "", "ACME", "jdoe", ""},
+		{`OTHER\JDoe`, "acme", "ACME", "jdoe", ""},
+		{"JDoe@acme.com", "acme", "ACME", "jdoe", ""},
+		{"jdoe\n", "", "", "", "The username has control characters"},
+		{"jd\x00oe", "acme", "", "", "The username has control characters"},
+		{"  ", "", "", "", "The username is empty"},
+		{`ACME\ `, "", "", "", "The username is empty"},
+	}
+	for _, test := range provider {
+		realm, username, err := lc.Realm(test.username, test.realm)
+		if test.err != "" {
+			assert.EqualError(t, err, test.err, test.username)
+			continue
+		}
+		assert.Nil(t, err, test.username)
+		assert.Equal(t, test.toRealm, realm, test.username)
+		assert.Equal(t, test.toUsername, username, test.username)
+	}
+}
+
+/* Test for the typed failures of the authentication */
+func TestAuthErrors(t *testing.T) {
+
+	ad := func(data string) error {
+		return ldap.NewError(ldap.LDAPResultInvalidCredentials, fmt.Errorf("80090308: LdapErr: DSID-0C09042F, comment: AcceptSecurityContext error, data %s, v4563", data))
+	}
+	provider := []struct {
+		err  error
+		code string
+	}{
+		{ad("52e"), CodeInvalidCredentials},
+		{ad("525"), CodeUserNotFound},
+		{ad("530"), CodeInvalidCredentials},
+		{ad("532"), CodePasswordExpired},
+		{ad("533"), CodeAccountDisabled},
+		{ad("701"), CodeAccountDisabled},
+		{ad("773"), CodeMustChangePassword},
+		{ad("775"), CodeAccountLocked},
+		{ldap.NewError(ldap.LDAPResultInvalidCredentials, fmt.Errorf("invalid credentials")), CodeInvalidCredentials},
+		{ldap.NewError(ldap.ErrorNetwork, fmt.Errorf("connection reset")), CodeDirectoryUnavailable},
+		{ldap.NewError(ldap.LDAPResultBusy, fmt.Errorf("busy")), CodeDirectoryUnavailable},
+		{ldap.NewError(ldap.LDAPResultUnavailable, fmt.Errorf("unavailable")), CodeDirectoryUnavailable},
+		{ldap.NewError(ldap.LDAPResultInsufficientAccessRights, fmt.Errorf("insufficient access")), ""},
+	}
+	for _, test := range provider {
+		err := authError(test.err)
+		ae, ok := err.(*AuthError)
+		if test.code == "" {
+			assert.False(t, ok, test.err.Error())
+			continue
+		}
+		assert.True(t, ok, test.err.Error())
+		assert.Equal(t, test.code, ae.Code, test.err.Error())
+		assert.Equal(t, test.err.Error(), err.Error())
+	}
+
+	// the failures of the sessions
+	dial, _ := dialTest()
+	lc := &Client{Config: &cnfTest}
+	lc.pool = NewPool(dial, nil, 1, 1, time.Minute, 10*time.Millisecond)
+	s, _ := lc.Session("")
+
+	code := func(err error) string {
+		if ae, ok := err.(*AuthError); ok {
+			return ae.Code
+		}
+		return ""
+	}
+	_, err := s.Authenticate("A", "PB")
+	assert.Equal(t, CodeInvalidCredentials, code(err))
+	_, err = s.Authenticate("L", "PL")
+	assert.Equal(t, CodeAccountLocked, code(err))
+	_, err = s.Authenticate("Z", "PZ")
+	assert.Equal(t, CodeUserNotFound, code(err))
+
+	// the pool without free connection
+	_, err = lc.Session("")
+	assert.Equal(t, CodeDirectoryUnavailable, code(err))
+
+	s.(*Session).conn.(*connTest).broken = true
+	_, err = s.Authenticate("A", "PA")
+	assert.Equal(t, CodeDirectoryUnavailable, code(err))
+	s.Close()
+}
+
+/* Test for the password changes of Active Directory and of the password modify operation */
+func TestChangePassword(t *testing.T) {
+
+	policy := ldap.NewError(ldap.LDAPResultConstraintViolation, fmt.Errorf("0000052D: Constraint violation - check_password_restrictions: the password is too short"))
+	wrong := ldap.NewError(ldap.LDAPResultConstraintViolation, fmt.Errorf("00000056: AtrErr: DSID-03191083, #1:\n\t0: 00000056: DSID-03191083, problem 1005 (CONSTRAINT_ATT_TYPE), data 0, Att 9005a (unicodePwd)"))
+
+	provider := []struct {
+		desc               string
+		change, serviceDN  string
+		skipTLS            bool
+		username, old, new string
+		modifyErr          error
+		code, err          string
+	}{
+		{"ad", "", "", false, "A", "PA", "NEW", nil, "", ""},
+		{"ad policy", PasswordActiveDirectory, "", false, "A", "PA", "weak", policy, CodePasswordPolicy, ""},
+		{"ad wrong password", PasswordActiveDirectory, "", false, "A", "PA", "NEW", wrong, CodeInvalidCredentials, ""},
+		{"ad expired", "", "cn=svc,dc=test", false, "X", "PX", "NEW", nil, "", ""},
+		{"ad expired without the service account", "", "", false, "X", "PX", "NEW", nil, CodePasswordExpired, ""},
+		{"passwordModify", PasswordModify, "", false, "A", "PA", "NEW", nil, "", ""},
+		{"passwordModify policy", PasswordModify, "", false, "A", "PA", "weak", nil, CodePasswordPolicy, ""},
+		{"wrong old password", "", "", false, "A", "PB", "NEW", nil, CodeInvalidCredentials, ""},
+		{"empty new password", "", "", false, "A", "PA", "", nil, "", "The new password of A is empty"},
+		{"without TLS", "", "", true, "A", "PA", "NEW", nil, "", "The password can only be changed over TLS"},
+		{"unknown change", "unknown", "", false, "A", "PA", "NEW", nil, "", "Unknown password change unknown"},
+	}
+
+	for _, test := range provider {
+		dial, _ := dialTest()
+		cnf := cnfTest
+		cnf.PasswordChange, cnf.ServiceDN, cnf.ServicePassword, cnf.SkipTLS = test.change, test.serviceDN, "PS", test.skipTLS
+		lc := &Client{Config: &cnf}
+		lc.pool = NewPool(dial, nil, 1, 1, time.Minute, time.Second)
+
+		s, _ := lc.Session("")
+		conn := s.(*Session).conn.(*connTest)
+		conn.modifyErr = test.modifyErr
+
+		err := s.ChangePassword(test.username, test.old, test.new)
+		switch {
+		case test.code != "":
+			ae, ok := err.(*AuthError)
+			assert.True(t, ok, test.desc)
+			if ok {
+				assert.Equal(t, test.code, ae.Code, test.desc)
+			}
+		case test.err != "":
+			assert.EqualError(t, err, test.err, test.desc)
+			assert.Equal(t, 0, conn.modified, test.desc)
+		default:
+			assert.Nil(t, err, test.desc)
+			assert.Equal(t, 1, conn.modified, test.desc)
+		}
+		s.Close()
+	}
+
+	// the unicodePwd is the quoted password in UTF-16LE
+	assert.Equal(t, "\"\x00P\x00\xe9\x00\"\x00", unicodePwd("Pé"))
+}
+
+/* Test for the lookups of the users and the members of the groups */
+func TestDirectory(t *testing.T) {
+
+	dial, _ := dialTest()
+	cnf := cnfTest
+	cnf.ServiceDN, cnf.ServicePassword, cnf.GroupNameFilter = "cn=svc,dc=test", "PS", "(cn=%s)"
+	lc := &Client{Config: &cnf}
+	lc.pool = NewPool(dial, nil, 1, 1, time.Minute, time.Second)
+
+	s, _ := lc.Session("")
+	conn := s.(*Session).conn.(*connTest)
+	defer s.Close()
+
+	usernames := func(users []*User) []string {
+		names := make([]string, 0)
+		for _, u := range users {
+			names = append(names, u.Username)
+		}
+		return names
+	}
+
+	// the users, looked up with the service account
+	u, err := s.FindUser("A")
+	assert.Nil(t, err)
+	assert.Equal(t, &User{Username: "A", DN: "uid=A,dc=test", Name: "User A", Email: "a@test"}, u)
+	assert.Equal(t, "cn=svc,dc=test", conn.binds[len(conn.binds)-1])
+	u, err = s.FindUser("Z")
+	assert.Nil(t, err)
+	assert.Nil(t, u)
+
+	// the members of the groups, with the paged results
+	g, truncated, err := s.GroupMembers("dev", 0)
+	assert.Nil(t, err)
+	assert.False(t, truncated)
+	assert.Equal(t, "DEV", g.Name)
+	assert.Equal(t, []string{"A", "N"}, usernames(g.Members))
+	assert.Equal(t, "a@test", g.Members[0].Email)
+	assert.Equal(t, uint32(DefaultPageSize), conn.pageSize)
+
+	// the pages are read until the last one, or until more members than the limit arrived
+	cnf.PageSize, conn.pages = 1, 0
+	g, truncated, err = s.GroupMembers("dev", 0)
+	assert.Nil(t, err)
+	assert.False(t, truncated)
+	assert.Equal(t, []string{"A", "N"}, usernames(g.Members))
+	assert.Equal(t, 2, conn.pages)
+	assert.Equal(t, 0, conn.abandoned)
+
+	cnf.PageSize, conn.pages = 0, 0
+	g, truncated, err = s.GroupMembers("dev", 1)
+	assert.Nil(t, err)
+	assert.True(t, truncated)
+	assert.Equal(t, []string{"N"}, usernames(g.Members))
+	assert.Equal(t, uint32(2), conn.pageSize)
+	assert.Equal(t, 1, conn.pages)
+
+	g, _, err = s.GroupMembers("none", 0)
+	assert.Nil(t, err)
+	assert.Nil(t, g)
+	_, _, err = s.GroupMembers("dup", 0)
+	assert.EqualError(t, err, "Group dup matches 2 entries")
+
+	// the nested members with the inChain strategy
+	cnf.NestedGroups, cnf.PageSize = NestedInChain, 50
+	g, _, err = s.GroupMembers("dev", 0)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"A", "N", "X"}, usernames(g.Members))
+	assert.Equal(t, uint32(50), conn.pageSize)
+
+	// the search is abandoned once the limit is passed
+	conn.pages = 0
+	g, truncated, err = s.GroupMembers("dev", 1)
+	assert.Nil(t, err)
+	assert.True(t, truncated)
+	assert.Equal(t, []string{"N"}, usernames(g.Members))
+	assert.Equal(t, 1, conn.pages)
+	assert.Equal(t, 1, conn.abandoned)
+
+	// the prefix search, the usernames are normalised as the logins
+	cnf.Username.Lowercase = true
+	users, truncated, err := s.SearchUsers("N", 10)
+	assert.Nil(t, err)
+	assert.False(t, truncated)
+	assert.Equal(t, []string{"n"}, usernames(users))
+	users, _, err = s.SearchUsers("*", 10)
+	assert.Nil(t, err)
+	assert.Empty(t, users)
+	assert.Equal(t, `(uid=\2a*)`, conn.filters[len(conn.filters)-1])
+
+	// the lookups need the service account
+	cnf.ServiceDN = ""
+	_, err = s.FindUser("A")
+	assert.EqualError(t, err, "The directory lookups need the LDAP service account")
+
+	// the attribute of the username
+	ad := cnfTest
+	ad.UserFilter = "(&(objectClass=user)(sAMAccountName=%s))"
+	assert.Equal(t, "sAMAccountName", (&Client{Config: &ad}).usernameAttribute())
+	ad.UsernameAttribute = "userPrincipalName"
+	assert.Equal(t, "userPrincipalName", (&Client{Config: &ad}).usernameAttribute())
+}
@@ -0,0 +1,120 @@
+package ldap
+
+import (
+	"fmt"
+	"gopkg.in/ldap.v2"
+	"regexp"
+	"strings"
+	"unicode/utf16"
+)
+
+const (
+	// The password is changed by the delete of the old unicodePwd and the add of the new one
+	PasswordActiveDirectory = "activeDirectory"
+	// The password is changed by the password modify extended operation of RFC 3062
+	PasswordModify = "passwordModify"
+
+	// The new password doesn't meet the password policy of the directory
+	CodePasswordPolicy = "password_policy"
+)
+
+// Error of Active Directory at the start of the message, like "0000052D: Constraint violation"
+var adError = regexp.MustCompile(`^([0-9a-fA-F]{8}):`)
+
+// Failures of the Active Directory password changes by their error
+var adPasswordCodes = map[string]string{
+	// ERROR_PASSWORD_RESTRICTION, the length, complexity or history of the password
+	"0000052d": CodePasswordPolicy,
+	// ERROR_INVALID_PASSWORD, the old password is wrong
+	"00000056": CodeInvalidCredentials,
+}
+
+// ChangePassword changes the password of the user, the old password can be expired.
+// The change is made as the user, or as the service account when the old password expired.
+func (s *Session) ChangePassword(username, oldPassword, newPassword string) error {
+
+	lc := s.client
+
+	// The passwords are never sent in clear
+	if !lc.Config.UseSSL && lc.Config.SkipTLS {
+		return fmt.Errorf("The password can only be changed over TLS")
+	}
+	if newPassword == "" {
+		return fmt.Errorf("The new password of %s is empty", username)
+	}
+
+	// 1 - THE OLD PASSWORD MUST BE THE ONE OF THE USER
+	u, err := s.Authenticate(username, oldPassword)
+	dn := ""
+	if err == nil {
+		dn = u.DN
+	} else {
+		ae, ok := err.(*AuthError)
+		if !ok || (ae.Code != CodePasswordExpired && ae.Code != CodeMustChangePassword) {
+			return err
+		}
+		// the user can't bind with the expired password
+		if lc.Config.ServiceDN == "" {
+			return &AuthError{ae.Code, fmt.Errorf("The expired passwords can only be changed with the service account: %s", ae.Err)}
+		}
+		if err = s.bindService(); err != nil {
+			return err
+		}
+		entry, err := s.searchUser(username)
+		if err != nil {
+			return err
+		}
+		dn = entry.DN
+	}
+
+	// 2 - CHANGE THE PASSWORD
+	switch lc.Config.PasswordChange {
+	case "", PasswordActiveDirectory:
+		// the old password is checked again by the delete, so it is a change and not a reset
+		req := ldap.NewModifyRequest(dn)
+		req.Delete("unicodePwd", []string{unicodePwd(oldPassword)})
+		req.Add("unicodePwd", []string{unicodePwd(newPassword)})
+		err = s.conn.Modify(req)
+	case PasswordModify:
+		_, err = s.conn.PasswordModify(ldap.NewPasswordModifyRequest(dn, oldPassword, newPassword))
+	default:
+		return fmt.Errorf("Unknown password change %s", lc.Config.PasswordChange)
+	}
+	if err != nil {
+		s.failed(err)
+		return passwordError(err)
+	}
+
+	return nil
+}
+
+// Encodes the password as the unicodePwd attribute, the quoted password in UTF-16LE
+func unicodePwd(password string) string {
+	u := utf16.Encode([]rune(`"` + password + `"`))
+	b := make([]byte, 0, 2*len(u))
+	for _, c := range u {
+		b = append(b, byte(c), byte(c>>8))
+	}
+	return string(b)
+}
+
+// Types the error of the password change, the password policy violations have their own code
+func passwordError(err error) error {
+	if m := adError.FindStringSubmatch(ldapMessage(err)); m != nil {
+		if c, ok := adPasswordCodes[strings.ToLower(m[1])]; ok {
+			return &AuthError{c, err}
+		}
+	}
+	if ldap.IsErrorWithCode(err, ldap.LDAPResultConstraintViolation) {
+		return &AuthError{CodePasswordPolicy, err}
+	}
+	return authError(err)
+}
+
+// Returns the message of the directory without the result code
+func ldapMessage(err error) string {
+	if e, ok := err.(*ldap.Error); ok && e.Err != nil {
+		return e.Err.Error()
+	}
+	return err.Error()
+}
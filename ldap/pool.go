@@ -0,0 +1,157 @@
+package ldap
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+const (
+	// Default number of connections open at the same time
+	DefaultMaxOpen = 10
+	// Default number of connections kept idle
+	DefaultMaxIdle = 5
+	// Default seconds an idle connection is kept
+	DefaultIdleTimeout = 300
+	// Default seconds a request waits for a free connection
+	DefaultPoolTimeout = 5
+)
+
+var ErrPoolTimeout = fmt.Errorf("Timeout waiting for a free LDAP connection")
+var ErrPoolClosed = fmt.Errorf("The LDAP connection pool is closed")
+
+type idleConn struct {
+	conn  Conn
+	since time.Time
+}
+
+// Pool is a bounded pool of connections to the LDAP server.
+// The idle connections are checked before being handed out again.
+type Pool struct {
+	dial        func() (Conn, error)
+	check       func(Conn) error
+	open        chan struct{}
+	maxIdle     int
+	idleTimeout time.Duration
+	timeout     time.Duration
+
+	mu     sync.Mutex
+	idle   []*idleConn
+	closed bool
+}
+
+// NewPool creates a pool of at most maxOpen connections created by dial,
+// check tells if an idle connection can still be used
+func NewPool(dial func() (Conn, error), check func(Conn) error, maxOpen int, maxIdle int, idleTimeout time.Duration, timeout time.Duration) *Pool {
+	if maxOpen <= 0 {
+		maxOpen = DefaultMaxOpen
+	}
+	if maxIdle <= 0 {
+		maxIdle = DefaultMaxIdle
+	}
+	if maxIdle > maxOpen {
+		maxIdle = maxOpen
+	}
+	if idleTimeout <= 0 {
+		idleTimeout = DefaultIdleTimeout * time.Second
+	}
+	if timeout <= 0 {
+		timeout = DefaultPoolTimeout * time.Second
+	}
+
+	return &Pool{
+		dial:        dial,
+		check:       check,
+		open:        make(chan struct{}, maxOpen),
+		maxIdle:     maxIdle,
+		idleTimeout: idleTimeout,
+		timeout:     timeout,
+	}
+}
+
+// Get returns an idle connection, or a new one, waiting when the maximum is open
+func (p *Pool) Get() (Conn, error) {
+
+	t := time.NewTimer(p.timeout)
+	defer t.Stop()
+	select {
+	case p.open <- struct{}{}:
+	case <-t.C:
+		return nil, ErrPoolTimeout
+	}
+
+	for {
+		ic, err := p.popIdle()
+		if err != nil {
+			<-p.open
+			return nil, err
+		}
+		if ic == nil {
+			break
+		}
+		// the expired and broken connections are discarded
+		if time.Since(ic.since) > p.idleTimeout || (p.check != nil && p.check(ic.conn) != nil) {
+			ic.conn.Close()
+			continue
+		}
+		return ic.conn, nil
+	}
+
+	c, err := p.dial()
+	if err != nil {
+		<-p.open
+		return nil, err
+	}
+	return c, nil
+}
+
+// Put gives the connection back, the broken connections are closed
+func (p *Pool) Put(c Conn, broken bool) {
+	defer func() { <-p.open }()
+
+	p.mu.Lock()
+	if broken || p.closed || len(p.idle) >= p.maxIdle {
+		p.mu.Unlock()
+		c.Close()
+		return
+	}
+	p.idle = append(p.idle, &idleConn{conn: c, since: time.Now()})
+	p.mu.Unlock()
+}
+
+// Close closes the idle connections, the connections in use are closed when given back
+func (p *Pool) Close() {
+	p.mu.Lock()
+	idle := p.idle
+	p.idle = nil
+	p.closed = true
+	p.mu.Unlock()
+
+	for _, ic := range idle {
+		ic.conn.Close()
+	}
+}
+
+// Stats returns the number of connections in use and idle
+func (p *Pool) Stats() (int, int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return len(p.open), len(p.idle)
+}
+
+// Returns the most recent idle connection, nil when there is none
+func (p *Pool) popIdle() (*idleConn, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.closed {
+		return nil, ErrPoolClosed
+	}
+	n := len(p.idle)
+	if n == 0 {
+		return nil, nil
+	}
+	ic := p.idle[n-1]
+	p.idle = p.idle[:n-1]
+	return ic, nil
+}
@@ -0,0 +1,322 @@
+package ldap
+
+import (
+	"fmt"
+	cnf "github.com/pintobikez/authentication-service/config/structures"
+	"github.com/stretchr/testify/assert"
+	"gopkg.in/ldap.v2"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+var cnfTest = cnf.LDAPConfig{BaseDN: "dc=test", BindDN: "%s@test", UserFilter: "(uid=%s)", GroupFilter: "(member=%s)"}
+
+// connTest is a connection to a fake LDAP server
+type connTest struct {
+	closed  int32
+	broken  bool
+	users   map[string]string
+	binds   []string
+	filters []string
+	// passwords of the entries changed by the password modify requests
+	passwords map[string]string
+	modified  int
+	modifyErr error
+	// size of the pages of the last paged search, the pages read and the searches abandoned
+	pageSize  uint32
+	pages     int
+	abandoned int
+}
+
+func (c *connTest) Bind(username, password string) error {
+	if c.broken {
+		return ldap.NewError(ldap.ErrorNetwork, fmt.Errorf("connection closed"))
+	}
+	// the account of L is locked and the password of X expired in Active Directory
+	if username == "L@test" {
+		return ldap.NewError(ldap.LDAPResultInvalidCredentials, fmt.Errorf("80090308: LdapErr: DSID-0C09042F, comment: AcceptSecurityContext error, data 775, v4563"))
+	}
+	if username == "X@test" {
+		return ldap.NewError(ldap.LDAPResultInvalidCredentials, fmt.Errorf("80090308: LdapErr: DSID-0C09042F, comment: AcceptSecurityContext error, data 532, v4563"))
+	}
+	if p, ok := c.users[username]; !ok || p != password {
+		return ldap.NewError(ldap.LDAPResultInvalidCredentials, fmt.Errorf("invalid credentials"))
+	}
+	c.binds = append(c.binds, username)
+	return nil
+}
+
+func (c *connTest) Search(r *ldap.SearchRequest) (*ldap.SearchResult, error) {
+	if c.broken {
+		return nil, ldap.NewError(ldap.ErrorNetwork, fmt.Errorf("connection closed"))
+	}
+	paging, _ := ldap.FindControl(r.Controls, ldap.ControlTypePaging).(*ldap.ControlPaging)
+	if paging != nil && paging.PagingSize == 0 {
+		c.abandoned++
+		return &ldap.SearchResult{}, nil
+	}
+	if paging == nil || len(paging.Cookie) == 0 {
+		c.filters = append(c.filters, r.Filter)
+	}
+	sr := c.search(r)
+	if paging == nil {
+		return sr, nil
+	}
+
+	// the cookie is the offset of the next page
+	c.pageSize = paging.PagingSize
+	c.pages++
+	offset := 0
+	if len(paging.Cookie) > 0 {
+		offset, _ = strconv.Atoi(string(paging.Cookie))
+	}
+	end := offset + int(paging.PagingSize)
+	next := ldap.NewControlPaging(0)
+	if end < len(sr.Entries) {
+		next.SetCookie([]byte(strconv.Itoa(end)))
+	} else {
+		end = len(sr.Entries)
+	}
+	return &ldap.SearchResult{Entries: sr.Entries[offset:end], Controls: []ldap.Control{next}}, nil
+}
+
+func (c *connTest) search(r *ldap.SearchRequest) *ldap.SearchResult {
+	if r.BaseDN == "uid=N,dc=test" {
+		return &ldap.SearchResult{Entries: []*ldap.Entry{ldap.NewEntry("uid=N,dc=test", map[string][]string{"tokenGroups": {"\x01\x02", "\x01\x03"}})}}
+	}
+	switch r.Filter {
+	case "(uid=A)":
+		return &ldap.SearchResult{Entries: []*ldap.Entry{ldap.NewEntry("uid=A,dc=test", map[string][]string{"cn": {"User A"}, "mail": {"a@test"}})}}
+	case "(uid=X)":
+		return &ldap.SearchResult{Entries: []*ldap.Entry{ldap.NewEntry("uid=X,dc=test", map[string][]string{"cn": {"User X"}})}}
+	case "(uid=B)":
+		return &ldap.SearchResult{Entries: []*ldap.Entry{ldap.NewEntry("uid=B,dc=test", map[string][]string{"cn": {"User B"}})}}
+	case "(uid=M)":
+		return &ldap.SearchResult{Entries: []*ldap.Entry{ldap.NewEntry("uid=M,ou=a,dc=test", nil), ldap.NewEntry("uid=M,ou=b,dc=test", nil)}}
+	// N is member of dev, dev of eng, and eng of dev and all
+	case "(member=uid=N,dc=test)":
+		return &ldap.SearchResult{Entries: []*ldap.Entry{ldap.NewEntry("cn=dev,dc=test", map[string][]string{"cn": {"dev"}})}}
+	case "(member=cn=dev,dc=test)", `(|(objectSid=\01\02)(objectSid=\01\03))`:
+		return &ldap.SearchResult{Entries: []*ldap.Entry{ldap.NewEntry("cn=eng,dc=test", map[string][]string{"cn": {"eng"}})}}
+	case "(member=cn=eng,dc=test)", "(&(objectClass=group)(member:1.2.840.113556.1.4.1941:=uid=N,dc=test))":
+		return &ldap.SearchResult{Entries: []*ldap.Entry{ldap.NewEntry("CN=dev,dc=test", map[string][]string{"cn": {"dev"}}), ldap.NewEntry("cn=all,dc=test", map[string][]string{"cn": {"all"}})}}
+	// the directory lookups, A and N are members of dev and X a nested member
+	case "(cn=dev)":
+		return &ldap.SearchResult{Entries: []*ldap.Entry{ldap.NewEntry("cn=dev,dc=test", map[string][]string{"cn": {"dev"}})}}
+	case "(cn=dup)":
+		return &ldap.SearchResult{Entries: []*ldap.Entry{ldap.NewEntry("cn=dup,ou=a,dc=test", nil), ldap.NewEntry("cn=dup,ou=b,dc=test", nil)}}
+	case "(uid=N*)":
+		return &ldap.SearchResult{Entries: []*ldap.Entry{ldap.NewEntry("uid=N,dc=test", map[string][]string{"uid": {"N"}, "cn": {"User N"}})}}
+	case "(&(uid=*)(memberOf=cn=dev,dc=test))":
+		return &ldap.SearchResult{Entries: []*ldap.Entry{ldap.NewEntry("uid=N,dc=test", map[string][]string{"uid": {"N"}, "cn": {"User N"}}), ldap.NewEntry("uid=A,dc=test", map[string][]string{"uid": {"A"}, "cn": {"User A"}, "mail": {"a@test"}})}}
+	case "(&(uid=*)(memberOf:1.2.840.113556.1.4.1941:=cn=dev,dc=test))":
+		return &ldap.SearchResult{Entries: []*ldap.Entry{ldap.NewEntry("uid=N,dc=test", map[string][]string{"uid": {"N"}, "cn": {"User N"}}), ldap.NewEntry("uid=X,dc=test", map[string][]string{"uid": {"X"}, "cn": {"User X"}}), ldap.NewEntry("uid=A,dc=test", map[string][]string{"uid": {"A"}, "cn": {"User A"}, "mail": {"a@test"}})}}
+	case "(member=uid=A,dc=test)":
+		return &ldap.SearchResult{Entries: []*ldap.Entry{ldap.NewEntry("cn=admins,dc=test", map[string][]string{"cn": {"admins"}})}}
+	}
+	return &ldap.SearchResult{}
+}
+
+// The changes of the request can't be read, the failure of the directory is the one set by the test
+func (c *connTest) Modify(r *ldap.ModifyRequest) error {
+	if c.broken {
+		return ldap.NewError(ldap.ErrorNetwork, fmt.Errorf("connection closed"))
+	}
+	c.modified++
+	return c.modifyErr
+}
+
+func (c *connTest) PasswordModify(r *ldap.PasswordModifyRequest) (*ldap.PasswordModifyResult, error) {
+	if c.broken {
+		return nil, ldap.NewError(ldap.ErrorNetwork, fmt.Errorf("connection closed"))
+	}
+	c.modified++
+	if r.OldPassword != c.passwords[r.UserIdentity] {
+		return nil, ldap.NewError(ldap.LDAPResultInvalidCredentials, fmt.Errorf("invalid credentials"))
+	}
+	if r.NewPassword == "weak" {
+		return nil, ldap.NewError(ldap.LDAPResultConstraintViolation, fmt.Errorf("Password fails quality checking policy"))
+	}
+	return &ldap.PasswordModifyResult{}, nil
+}
+
+func (c *connTest) Close() {
+	atomic.AddInt32(&c.closed, 1)
+}
+
+// Returns a dial of connections to the fake server and the number of connections dialed
+func dialTest() (func() (Conn, error), *int32) {
+	var n int32
+	return func() (Conn, error) {
+		atomic.AddInt32(&n, 1)
+		return &connTest{users: map[string]string{"A@test": "PA", "B@test": "PB", "uid=A,dc=test": "PA", "uid=M,ou=a,dc=test": "PM", "cn=svc,dc=test": "PS", "Z@test": "PZ"},
+			passwords: map[string]string{"uid=A,dc=test": "PA", "uid=X,dc=test": "PX"}}, nil
+	}, &n
+}
+
+/* Test for the maximum of open connections */
+func TestPoolMaxOpen(t *testing.T) {
+
+	dial, dialed := dialTest()
+	p := NewPool(dial, nil, 2, 2, time.Minute, 20*time.Millisecond)
+
+	c1, err := p.Get()
+	assert.Nil(t, err)
+	_, err = p.Get()
+	assert.Nil(t, err)
+
+	// every connection is in use
+	_, err = p.Get()
+	assert.Equal(t, ErrPoolTimeout, err)
+
+	// the connection given back is reused
+	p.Put(c1, false)
+	c3, err := p.Get()
+	assert.Nil(t, err)
+	assert.True(t, c1 == c3)
+	assert.Equal(t, int32(2), atomic.LoadInt32(dialed))
+
+	inUse, idle := p.Stats()
+	assert.Equal(t, 2, inUse)
+	assert.Equal(t, 0, idle)
+}
+
+/* Test for the idle connections handed out again */
+func TestPoolIdle(t *testing.T) {
+
+	dial, dialed := dialTest()
+	check := func(c Conn) error {
+		if c.(*connTest).broken {
+			return fmt.Errorf("broken")
+		}
+		return nil
+	}
+	p := NewPool(dial, check, 3, 1, time.Minute, time.Second)
+
+	c1, _ := p.Get()
+	c2, _ := p.Get()
+
+	// only one connection is kept idle
+	p.Put(c1, false)
+	p.Put(c2, false)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&c2.(*connTest).closed))
+
+	// the idle connection that fails the check is discarded
+	c1.(*connTest).broken = true
+	c3, err := p.Get()
+	assert.Nil(t, err)
+	assert.False(t, c1 == c3)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&c1.(*connTest).closed))
+
+	// the broken connections are not kept
+	p.Put(c3, true)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&c3.(*connTest).closed))
+	assert.Equal(t, int32(3), atomic.LoadInt32(dialed))
+
+	// the expired idle connections are discarded
+	p = NewPool(dial, check, 1, 1, time.Millisecond, time.Second)
+	c4, _ := p.Get()
+	p.Put(c4, false)
+	time.Sleep(5 * time.Millisecond)
+	c5, _ := p.Get()
+	assert.False(t, c4 == c5)
+
+	// the pool closed doesn't hand out connections
+	p.Put(c5, false)
+	p.Close()
+	assert.Equal(t, int32(1), atomic.LoadInt32(&c5.(*connTest).closed))
+	_, err = p.Get()
+	assert.Equal(t, ErrPoolClosed, err)
+}
+
+/* Test for the pool used concurrently, run with -race */
+func TestPoolConcurrent(t *testing.T) {
+
+	dial, dialed := dialTest()
+	p := NewPool(dial, nil, 3, 3, time.Minute, 5*time.Second)
+
+	var inUse, maxInUse int32
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			c, err := p.Get()
+			if !assert.Nil(t, err) {
+				return
+			}
+			n := atomic.AddInt32(&inUse, 1)
+			for {
+				m := atomic.LoadInt32(&maxInUse)
+				if n <= m || atomic.CompareAndSwapInt32(&maxInUse, m, n) {
+					break
+				}
+			}
+			time.Sleep(time.Millisecond)
+			atomic.AddInt32(&inUse, -1)
+			p.Put(c, false)
+		}()
+	}
+	wg.Wait()
+
+	assert.True(t, atomic.LoadInt32(&maxInUse) <= 3)
+	assert.True(t, atomic.LoadInt32(dialed) <= 3)
+}
+
+/* Test for the sessions of concurrent requests */
+func TestSessionConcurrent(t *testing.T) {
+
+	dial, _ := dialTest()
+	lc := &Client{Config: &cnfTest}
+	lc.pool = NewPool(dial, nil, 2, 2, time.Minute, 5*time.Second)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+
+			username, password, dn, groups := "A", "PA", "uid=A,dc=test", 1
+			if i%2 == 1 {
+				username, password, dn, groups = "B", "PB", "uid=B,dc=test", 0
+			}
+
+			s, err := lc.Session("")
+			if !assert.Nil(t, err) {
+				return
+			}
+			defer s.Close()
+
+			// each session keeps the bind state of its own user
+			u, err := s.Authenticate(username, password)
+			if !assert.Nil(t, err) {
+				return
+			}
+			assert.Equal(t, dn, u.DN)
+			gr, err := s.GetGroupsOfUser(username)
+			assert.Nil(t, err)
+			assert.Equal(t, groups, len(gr))
+		}(i)
+	}
+	wg.Wait()
+
+	// the wrong password and the groups without login
+	s, _ := lc.Session("")
+	_, err := s.Authenticate("A", "PB")
+	assert.NotNil(t, err)
+	_, err = s.GetGroupsOfUser("A")
+	assert.NotNil(t, err)
+	s.Close()
+
+	// the network errors don't give the connection back
+	s, _ = lc.Session("")
+	c := s.(*Session).conn.(*connTest)
+	c.broken = true
+	_, err = s.Authenticate("A", "PA")
+	assert.NotNil(t, err)
+	s.Close()
+	assert.Equal(t, int32(1), atomic.LoadInt32(&c.closed))
+}
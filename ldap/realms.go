@@ -0,0 +1,135 @@
+package ldap
+
+import (
+	"fmt"
+	cnf "github.com/pintobikez/authentication-service/config/structures"
+	"sort"
+	"strings"
+	"unicode"
+)
+
+// Creates the clients of the other realms, each one with its own pool and servers
+func (lc *Client) addRealms(realms map[string]*cnf.LDAPConfig) {
+	if len(realms) == 0 {
+		return
+	}
+
+	lc.realms = make(map[string]*Client)
+	for name, c := range realms {
+		rc := newClient(c)
+		rc.realm = name
+		lc.realms[strings.ToLower(name)] = rc
+		for _, d := range c.Domains {
+			lc.realms[strings.ToLower(d)] = rc
+		}
+		lc.realmList = append(lc.realmList, rc)
+	}
+	sort.Slice(lc.realmList, func(i, j int) bool { return lc.realmList[i].realm < lc.realmList[j].realm })
+}
+
+// Realm returns the realm of the login and the normalised username in it. The realm is the given one, or the one
+// named by the DOMAIN\user prefix or the user@domain suffix. The logins of other domains are left to the default realm.
+func (lc *Client) Realm(username, realm string) (string, string, error) {
+
+	for _, r := range username {
+		if unicode.IsControl(r) {
+			return "", "", fmt.Errorf("The username has control characters")
+		}
+	}
+	if lc.Config != nil && lc.Config.Username.Trim {
+		username = strings.TrimSpace(username)
+	}
+
+	rc, user := lc, username
+	if i := strings.Index(username, `\`); i > 0 {
+		if r, ok := lc.realms[strings.ToLower(username[:i])]; ok {
+			rc, user = r, username[i+1:]
+		}
+	} else if i := strings.LastIndex(username, "@"); i > 0 {
+		if r, ok := lc.realms[strings.ToLower(username[i+1:])]; ok {
+			rc, user = r, username[:i]
+		}
+	}
+
+	if realm != "" {
+		r, ok := lc.realms[strings.ToLower(realm)]
+		if !ok {
+			return "", "", fmt.Errorf("Unknown realm %s", realm)
+		}
+		// the domain of the username is only removed when it is the same realm
+		if rc != r {
+			rc, user = r, username
+		}
+	}
+
+	user, err := rc.normalize(user)
+	if err != nil {
+		return "", "", err
+	}
+	return rc.realm, user, nil
+}
+
+// RealmName returns the name of the realm named by its name or one of its domains, the default realm has no name
+func (lc *Client) RealmName(realm string) (string, error) {
+	if realm == "" {
+		return "", nil
+	}
+	r, ok := lc.realms[strings.ToLower(realm)]
+	if !ok {
+		return "", fmt.Errorf("Unknown realm %s", realm)
+	}
+	return r.realm, nil
+}
+
+// Qualify returns the username of the sessions, qualified with @realm outside the default realm
+func Qualify(username, realm string) string {
+	if realm == "" {
+		return username
+	}
+	return username + "@" + realm
+}
+
+// Normalises the username with the configuration of the realm
+func (lc *Client) normalize(username string) (string, error) {
+	if lc.Config != nil {
+		n := lc.Config.Username
+		if n.Trim {
+			username = strings.TrimSpace(username)
+		}
+		if i := strings.Index(username, `\`); n.StripDomain && i >= 0 {
+			username = username[i+1:]
+		}
+		if i := strings.LastIndex(username, "@"); n.UPNToSAM && i >= 0 {
+			username = username[:i]
+		}
+		if n.Lowercase {
+			username = strings.ToLower(username)
+		}
+	}
+
+	if username == "" {
+		return "", fmt.Errorf("The username is empty")
+	}
+	return username, nil
+}
+
+// Returns the client of the realm, the default realm is only available when it has servers
+func (lc *Client) realmClient(realm string) (*Client, error) {
+	if realm == "" {
+		if !lc.hasDirectory() {
+			return nil, fmt.Errorf("The login doesn't name a realm")
+		}
+		return lc, nil
+	}
+
+	rc, ok := lc.realms[strings.ToLower(realm)]
+	if !ok {
+		return nil, fmt.Errorf("Unknown realm %s", realm)
+	}
+	return rc, nil
+}
+
+// Tells if the default realm has a directory, the configuration can only have realms
+func (lc *Client) hasDirectory() bool {
+	return len(lc.realms) == 0 || lc.Config.Host != "" || len(lc.Config.Servers) > 0
+}
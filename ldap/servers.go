@@ -0,0 +1,162 @@
+package ldap
+
+import (
+	"fmt"
+	cnf "github.com/pintobikez/authentication-service/config/structures"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	// Servers tried in the order of their priority
+	BalanceFailover = "failover"
+	// Connections shared by the weights of the servers of the same priority
+	BalanceRoundRobin = "roundRobin"
+	// Default seconds a failed server is skipped
+	DefaultBackoff = 5
+	// Longest time a failed server is skipped
+	MaxBackoff = 5 * time.Minute
+)
+
+// ServerStatus is the health of an LDAP server tracked by the client
+type ServerStatus struct {
+	Realm     string
+	Address   string
+	Available bool
+	Failures  int
+	// Why the last connection failed, the certificate errors have their own reasons
+	Reason string
+	Detail string
+}
+
+type server struct {
+	cnf.ServerConfig
+	address string
+	// weight accumulated by the round robin
+	current   int
+	failures  int
+	downUntil time.Time
+	lastErr   error
+}
+
+// servers picks the LDAP server of each new connection and tracks their health
+type servers struct {
+	mu      sync.Mutex
+	list    []*server
+	balance string
+	backoff time.Duration
+	now     func() time.Time
+}
+
+// Creates the servers of the configuration, the host and port are the only server when no list is configured
+func newServers(c *cnf.LDAPConfig) *servers {
+	list := c.Servers
+	if len(list) == 0 {
+		list = []cnf.ServerConfig{{Host: c.Host, Port: c.Port}}
+	}
+
+	s := &servers{balance: c.Balance, backoff: time.Duration(c.Backoff) * time.Second, now: time.Now}
+	if s.backoff <= 0 {
+		s.backoff = DefaultBackoff * time.Second
+	}
+	for _, sc := range list {
+		if sc.ServerName == "" {
+			sc.ServerName = c.ServerName
+		}
+		if sc.Weight <= 0 {
+			sc.Weight = 1
+		}
+		s.list = append(s.list, &server{ServerConfig: sc, address: fmt.Sprintf("%s:%d", sc.Host, sc.Port)})
+	}
+	// the order of the configuration is kept between the servers of the same priority
+	sort.SliceStable(s.list, func(i, j int) bool { return s.list[i].Priority < s.list[j].Priority })
+
+	return s
+}
+
+// Returns the servers in the order they are tried, the servers backing off are tried last
+func (s *servers) order() []*server {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := s.now()
+	var up, down []*server
+	for _, sv := range s.list {
+		if now.Before(sv.downUntil) {
+			down = append(down, sv)
+		} else {
+			up = append(up, sv)
+		}
+	}
+
+	if s.balance == BalanceRoundRobin && len(up) > 0 {
+		// smooth weighted round robin between the servers of the best priority
+		same := up
+		for i, sv := range up {
+			if sv.Priority != up[0].Priority {
+				same = up[:i]
+				break
+			}
+		}
+		total, best := 0, 0
+		for i, sv := range same {
+			sv.current += sv.Weight
+			total += sv.Weight
+			if sv.current > same[best].current {
+				best = i
+			}
+		}
+		same[best].current -= total
+
+		first := same[best]
+		ordered := []*server{first}
+		for _, sv := range up {
+			if sv != first {
+				ordered = append(ordered, sv)
+			}
+		}
+		up = ordered
+	}
+
+	return append(up, down...)
+}
+
+// Skips the server for the backoff, doubled at each failure in a row
+func (s *servers) failed(sv *server, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	sv.failures++
+	sv.lastErr = err
+	d := s.backoff << uint(sv.failures-1)
+	if d > MaxBackoff || d <= 0 {
+		d = MaxBackoff
+	}
+	sv.downUntil = s.now().Add(d)
+}
+
+func (s *servers) succeeded(sv *server) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	sv.failures = 0
+	sv.lastErr = nil
+	sv.downUntil = time.Time{}
+}
+
+// Returns the health of every server
+func (s *servers) status() []ServerStatus {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	st := make([]ServerStatus, len(s.list))
+	for i, sv := range s.list {
+		st[i] = ServerStatus{Address: sv.address, Available: sv.failures == 0, Failures: sv.failures}
+		if sv.lastErr != nil {
+			st[i].Reason = failureReason(sv.lastErr)
+			st[i].Detail = sv.lastErr.Error()
+		}
+	}
+	return st
+}
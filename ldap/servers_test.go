@@ -0,0 +1,131 @@
+package ldap
+
+import (
+	"fmt"
+	cnf "github.com/pintobikez/authentication-service/config/structures"
+	"github.com/stretchr/testify/assert"
+	"net"
+	"testing"
+	"time"
+)
+
+// Returns the addresses of the servers in the order they are tried
+func addresses(list []*server) []string {
+	a := make([]string, len(list))
+	for i, sv := range list {
+		a[i] = sv.address
+	}
+	return a
+}
+
+/* Test for the order of the servers with the failover and round robin policies */
+func TestServersOrder(t *testing.T) {
+
+	c := &cnf.LDAPConfig{Servers: []cnf.ServerConfig{
+		{Host: "dr", Port: 389, Priority: 2},
+		{Host: "dc1", Port: 389, Priority: 1, Weight: 2},
+		{Host: "dc2", Port: 389, Priority: 1},
+	}}
+
+	// the lower priorities first
+	s := newServers(c)
+	for i := 0; i < 3; i++ {
+		assert.Equal(t, []string{"dc1:389", "dc2:389", "dr:389"}, addresses(s.order()))
+	}
+
+	// the servers of the best priority share the connections by their weight
+	c.Balance = BalanceRoundRobin
+	s = newServers(c)
+	var first []string
+	for i := 0; i < 6; i++ {
+		o := addresses(s.order())
+		assert.Equal(t, "dr:389", o[2])
+		first = append(first, o[0])
+	}
+	assert.Equal(t, []string{"dc1:389", "dc2:389", "dc1:389", "dc1:389", "dc2:389", "dc1:389"}, first)
+
+	// the default server is the host and port
+	s = newServers(&cnf.LDAPConfig{Host: "ldap", Port: 636, ServerName: "ldap.company"})
+	assert.Equal(t, []string{"ldap:636"}, addresses(s.order()))
+	assert.Equal(t, "ldap.company", s.list[0].ServerName)
+}
+
+/* Test for the backoff of the failed servers */
+func TestServersBackoff(t *testing.T) {
+
+	now := time.Now()
+	c := &cnf.LDAPConfig{Backoff: 10, Servers: []cnf.ServerConfig{{Host: "dc1", Port: 389}, {Host: "dc2", Port: 389}}}
+	s := newServers(c)
+	s.now = func() time.Time { return now }
+
+	// the failed server is tried last, for twice as long after each failure
+	dc1 := s.list[0]
+	s.failed(dc1, fmt.Errorf("connection refused"))
+	assert.Equal(t, []string{"dc2:389", "dc1:389"}, addresses(s.order()))
+	now = now.Add(11 * time.Second)
+	assert.Equal(t, []string{"dc1:389", "dc2:389"}, addresses(s.order()))
+	s.failed(dc1, fmt.Errorf("connection refused"))
+	now = now.Add(11 * time.Second)
+	assert.Equal(t, []string{"dc2:389", "dc1:389"}, addresses(s.order()))
+
+	assert.Equal(t, []ServerStatus{
+		{Address: "dc1:389", Failures: 2, Reason: ReasonConnection, Detail: "connection refused"},
+		{Address: "dc2:389", Available: true},
+	}, s.status())
+
+	// the backoff is bounded
+	for i := 0; i < 40; i++ {
+		s.failed(dc1, fmt.Errorf("connection refused"))
+	}
+	assert.Equal(t, now.Add(MaxBackoff), dc1.downUntil)
+
+	s.succeeded(dc1)
+	assert.Equal(t, []string{"dc1:389", "dc2:389"}, addresses(s.order()))
+	assert.True(t, s.status()[0].Available)
+}
+
+/* Test for the connection retried against the next server */
+func TestDialFailover(t *testing.T) {
+
+	up, err := net.Listen("tcp", "127.0.0.1:0")
+	if !assert.Nil(t, err) {
+		return
+	}
+	defer up.Close()
+	go func() {
+		for {
+			c, err := up.Accept()
+			if err != nil {
+				return
+			}
+			// the connections are kept open until the listener is closed
+			defer c.Close()
+		}
+	}()
+
+	// a port nobody listens on
+	down, _ := net.Listen("tcp", "127.0.0.1:0")
+	downPort := down.Addr().(*net.TCPAddr).Port
+	down.Close()
+
+	c := &cnf.LDAPConfig{SkipTLS: true, Servers: []cnf.ServerConfig{
+		{Host: "127.0.0.1", Port: downPort},
+		{Host: "127.0.0.1", Port: up.Addr().(*net.TCPAddr).Port},
+	}}
+	lc := New(c)
+	defer lc.Close()
+
+	conn, err := lc.dial()
+	assert.Nil(t, err)
+	conn.Close()
+
+	st := lc.Servers()
+	assert.False(t, st[0].Available)
+	assert.Equal(t, 1, st[0].Failures)
+	assert.True(t, st[1].Available)
+
+	// every server down
+	up.Close()
+	_, err = lc.dial()
+	assert.NotNil(t, err)
+}
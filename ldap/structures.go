@@ -1,9 +1,52 @@
 package ldap
 
+import "gopkg.in/ldap.v2"
+
+// User is the LDAP entry of an authenticated user
+type User struct {
+	// Username of the sessions, qualified with @realm outside the default realm
+	Username string
+	Realm    string
+	DN       string
+	Name     string
+	Email    string
+	// Claims mapped from the attributes of the entry
+	Claims map[string]interface{}
+}
+
+// Group is a group of the directory with the users member of it
+type Group struct {
+	// Name of the group, upper cased as the groups of the users
+	Name    string
+	DN      string
+	Members []*User
+}
+
+// ClientI hands out the sessions of the requests, each one with its own connection of the pool of the realm
 type ClientI interface {
-	Authenticate(username, password string) (string, error)
+	Realm(username, realm string) (string, string, error)
+	RealmName(realm string) (string, error)
+	Session(realm string) (SessionI, error)
+	Health() error
+	Servers() []ServerStatus
+}
+
+// SessionI is the LDAP state of one request, it must be closed to give the connection back to the pool
+type SessionI interface {
+	Authenticate(username, password string) (*User, error)
 	GetGroupsOfUser(username string) (map[string]string, error)
-	Connect() error
+	ChangePassword(username, oldPassword, newPassword string) error
+	FindUser(username string) (*User, error)
+	SearchUsers(prefix string, limit int) ([]*User, bool, error)
+	GroupMembers(name string, limit int) (*Group, bool, error)
+	Close()
+}
+
+// Conn is the connection to the LDAP server kept by the pool, implemented by *ldap.Conn
+type Conn interface {
+	Bind(username, password string) error
+	Search(searchRequest *ldap.SearchRequest) (*ldap.SearchResult, error)
+	Modify(modifyRequest *ldap.ModifyRequest) error
+	PasswordModify(passwordModifyRequest *ldap.PasswordModifyRequest) (*ldap.PasswordModifyResult, error)
 	Close()
-	Health() error
 }
@@ -0,0 +1,137 @@
+package ldap
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+)
+
+const (
+	// The certificate isn't signed by the CA bundle
+	ReasonUnknownAuthority = "unknownAuthority"
+	// The certificate isn't valid for the server name
+	ReasonHostname = "hostnameMismatch"
+	// The certificate is expired or not valid yet
+	ReasonExpired = "certificateExpired"
+	// The certificate is rejected for another reason
+	ReasonCertificate = "invalidCertificate"
+	// The server can't be reached or the TLS handshake failed
+	ReasonConnection = "connection"
+)
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// Returns the TLS configuration of a connection to the server, verifyErr receives the error of the certificate.
+// The ldap library only returns the handshake errors of StartTLS as text, so the certificate is verified
+// by VerifyPeerCertificate as the default verification would, keeping the x509 error.
+func (lc *Client) tlsConfig(sv *server, verifyErr *error) (*tls.Config, error) {
+
+	config := &tls.Config{ServerName: sv.ServerName, MinVersion: tls.VersionTLS12}
+	if config.ServerName == "" {
+		config.ServerName = sv.Host
+	}
+	if v := lc.Config.MinTLSVersion; v != "" {
+		min, ok := tlsVersions[v]
+		if !ok {
+			return nil, fmt.Errorf("Invalid minimum TLS version %s", v)
+		}
+		config.MinVersion = min
+	}
+
+	//IF there is a certificate configured
+	if lc.Config.SSLCert != "" && lc.Config.SSLKey != "" {
+		cert, err := tls.LoadX509KeyPair(lc.Config.SSLCert, lc.Config.SSLKey)
+		if err != nil {
+			return nil, err
+		}
+		config.Certificates = append(config.Certificates, cert)
+	}
+
+	if lc.Config.InsecureSkipVerify {
+		config.InsecureSkipVerify = true
+		return config, nil
+	}
+
+	var roots *x509.CertPool
+	if lc.Config.CACert != "" {
+		b, err := ioutil.ReadFile(lc.Config.CACert)
+		if err != nil {
+			return nil, err
+		}
+		roots = x509.NewCertPool()
+		if !roots.AppendCertsFromPEM(b) {
+			return nil, fmt.Errorf("No certificate found in the CA bundle %s", lc.Config.CACert)
+		}
+	}
+
+	// the default verification is replaced by VerifyPeerCertificate, called with the chain sent by the server
+	serverName := config.ServerName
+	config.InsecureSkipVerify = true
+	config.VerifyPeerCertificate = func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+		if len(rawCerts) == 0 {
+			*verifyErr = fmt.Errorf("The LDAP server sent no certificate")
+			return *verifyErr
+		}
+		certs := make([]*x509.Certificate, 0, len(rawCerts))
+		for _, raw := range rawCerts {
+			c, err := x509.ParseCertificate(raw)
+			if err != nil {
+				*verifyErr = err
+				return err
+			}
+			certs = append(certs, c)
+		}
+		opts := x509.VerifyOptions{DNSName: serverName, Roots: roots, Intermediates: x509.NewCertPool()}
+		for _, c := range certs[1:] {
+			opts.Intermediates.AddCert(c)
+		}
+		_, err := certs[0].Verify(opts)
+		*verifyErr = err
+		return err
+	}
+
+	return config, nil
+}
+
+// Returns why the connection to the server failed, the certificate errors are told apart
+func failureReason(err error) string {
+	var unknown x509.UnknownAuthorityError
+	var hostname x509.HostnameError
+	var invalid x509.CertificateInvalidError
+	switch {
+	case errors.As(err, &unknown):
+		return ReasonUnknownAuthority
+	case errors.As(err, &hostname):
+		return ReasonHostname
+	case errors.As(err, &invalid):
+		if invalid.Reason == x509.Expired {
+			return ReasonExpired
+		}
+		return ReasonCertificate
+	}
+	var cert *certificateError
+	if errors.As(err, &cert) {
+		return ReasonCertificate
+	}
+	return ReasonConnection
+}
+
+// certificateError is the rejected certificate of a server
+type certificateError struct {
+	err error
+}
+
+func (e *certificateError) Error() string {
+	return fmt.Sprintf("Certificate of the LDAP server rejected: %s", e.err)
+}
+
+func (e *certificateError) Unwrap() error {
+	return e.err
+}
@@ -0,0 +1,149 @@
+package ldap
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	cnf "github.com/pintobikez/authentication-service/config/structures"
+	"github.com/stretchr/testify/assert"
+)
+
+// Creates a certificate for localhost signed by the CA, or self signed when the CA is nil
+func certTest(t *testing.T, ca *x509.Certificate, caKey *ecdsa.PrivateKey, notAfter time.Time) (*x509.Certificate, *ecdsa.PrivateKey, tls.Certificate) {
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	tpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: "localhost"},
+		NotBefore:    time.Now().Add(-2 * time.Hour),
+		NotAfter:     notAfter,
+		DNSNames:     []string{"localhost"},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	parent, parentKey := tpl, key
+	if ca == nil {
+		tpl.IsCA, tpl.BasicConstraintsValid = true, true
+		tpl.Subject.CommonName = "Test LDAP CA"
+	} else {
+		parent, parentKey = ca, caKey
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, tpl, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	return cert, key, tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+// Starts an LDAP server answering the LDAPS handshake, or the StartTLS request before the handshake.
+// Returns the listener of the server, closed by the test.
+func serverTest(t *testing.T, cert tls.Certificate, startTLS bool) net.Listener {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := &tls.Config{Certificates: []tls.Certificate{cert}, MaxVersion: tls.VersionTLS12}
+
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				if startTLS {
+					// the extended request of the message ID, answered with success
+					h := make([]byte, 2)
+					if _, err := io.ReadFull(c, h); err != nil {
+						return
+					}
+					req := make([]byte, h[1])
+					if _, err := io.ReadFull(c, req); err != nil {
+						return
+					}
+					c.Write([]byte{0x30, 0x0c, 0x02, 0x01, req[2], 0x78, 0x07, 0x0a, 0x01, 0x00, 0x04, 0x00, 0x04, 0x00})
+				}
+				s := tls.Server(c, config)
+				if s.Handshake() == nil {
+					io.Copy(ioutil.Discard, s)
+				}
+			}()
+		}
+	}()
+
+	return l
+}
+
+/* Test for the verification of the certificates of the servers */
+func TestTLSVerify(t *testing.T) {
+
+	ca, caKey, _ := certTest(t, nil, nil, time.Now().Add(time.Hour))
+	_, _, valid := certTest(t, ca, caKey, time.Now().Add(time.Hour))
+	_, _, expired := certTest(t, ca, caKey, time.Now().Add(-time.Hour))
+
+	f, _ := ioutil.TempFile("", "ldap-ca")
+	defer os.Remove(f.Name())
+	pem.Encode(f, &pem.Block{Type: "CERTIFICATE", Bytes: ca.Raw})
+	f.Close()
+
+	port := func(l net.Listener) int {
+		return l.Addr().(*net.TCPAddr).Port
+	}
+	ldapsServer, startTLSServer, expiredServer := serverTest(t, valid, false), serverTest(t, valid, true), serverTest(t, expired, false)
+	defer ldapsServer.Close()
+	defer startTLSServer.Close()
+	defer expiredServer.Close()
+	ldaps, startTLS, ldapsExpired := port(ldapsServer), port(startTLSServer), port(expiredServer)
+
+	provider := []struct {
+		desc   string
+		config cnf.LDAPConfig
+		port   int
+		reason string
+	}{
+		{"ldaps with the CA", cnf.LDAPConfig{UseSSL: true, CACert: f.Name()}, ldaps, ""},
+		{"starttls with the CA", cnf.LDAPConfig{CACert: f.Name()}, startTLS, ""},
+		{"ldaps with the server name", cnf.LDAPConfig{UseSSL: true, CACert: f.Name(), ServerName: "localhost"}, ldaps, ""},
+		{"ldaps without the CA", cnf.LDAPConfig{UseSSL: true}, ldaps, ReasonUnknownAuthority},
+		{"starttls without the CA", cnf.LDAPConfig{}, startTLS, ReasonUnknownAuthority},
+		{"ldaps with another server name", cnf.LDAPConfig{UseSSL: true, CACert: f.Name(), ServerName: "ldap.company.local"}, ldaps, ReasonHostname},
+		{"starttls with another server name", cnf.LDAPConfig{CACert: f.Name(), ServerName: "ldap.company.local"}, startTLS, ReasonHostname},
+		{"ldaps with the expired certificate", cnf.LDAPConfig{UseSSL: true, CACert: f.Name()}, ldapsExpired, ReasonExpired},
+		{"ldaps insecure", cnf.LDAPConfig{UseSSL: true, InsecureSkipVerify: true}, ldapsExpired, ""},
+		{"ldaps with TLS 1.3", cnf.LDAPConfig{UseSSL: true, CACert: f.Name(), MinTLSVersion: "1.3"}, ldaps, ReasonConnection},
+		{"ldaps with an unknown TLS version", cnf.LDAPConfig{UseSSL: true, CACert: f.Name(), MinTLSVersion: "2.0"}, ldaps, ReasonConnection},
+	}
+
+	for _, test := range provider {
+		c := test.config
+		c.Host, c.Port = "127.0.0.1", test.port
+		lc := New(&c)
+
+		conn, err := lc.dial()
+		st := lc.Servers()[0]
+		if test.reason == "" {
+			assert.Nil(t, err, test.desc)
+			assert.True(t, st.Available, test.desc)
+			conn.Close()
+		} else {
+			assert.NotNil(t, err, test.desc)
+			assert.Equal(t, test.reason, st.Reason, test.desc)
+		}
+		lc.Close()
+	}
+}
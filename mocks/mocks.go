@@ -1,28 +1,48 @@
 package mocks
 
 import (
+	"encoding/json"
 	"fmt"
 	rlib "github.com/garyburd/redigo/redis"
 	cnf "github.com/pintobikez/authentication-service/config/structures"
+	"github.com/pintobikez/authentication-service/ldap"
+	"github.com/pintobikez/authentication-service/redis"
 	. "github.com/pintobikez/authentication-service/secure/structures"
+	"path"
+	"strings"
+	"sync"
 )
 
 // MOCK STRUCTURES DEFINITION
 type (
 	ClientTokenManagerTest struct {
 		Iserror bool
+		// Claims of the validated tokens, by default the ones of the user V in the service V
+		Claims *TokenClaims
 	}
 	ClientLdapTest struct {
 		Iserror bool
 	}
+	ClientLdapSessionTest struct {
+		Realm string
+	}
 	ClientRedisTest struct {
 		Iserror       bool
 		IserrorUser   bool
 		IserrorCreate bool
 		IserrorAPI    bool
+		IserrorDelete bool
+		Store         map[string]string
+		Services      map[string]*redis.Service
+		// guards the Store and the Services of the handlers running concurrently
+		mu sync.Mutex
 	}
 	ConnMock struct {
 	}
+	KeyStoreTest struct {
+		Iserror bool
+		Keys    []*SigningKey
+	}
 )
 
 // MOCK github.com/garyburd/redigo/redis conn structure - START
@@ -52,24 +72,195 @@ func (c *ClientRedisTest) Connect() (rlib.Conn, error) {
 	return new(ConnMock), nil
 }
 func (r *ClientRedisTest) DeleteKey(key string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.Store, key)
 	return nil
 }
+func (c *ClientRedisTest) DeleteKeys(pattern string) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.deleteKeys(pattern)
+}
+func (c *ClientRedisTest) deleteKeys(pattern string) (int, error) {
+	if c.Iserror || c.IserrorDelete {
+		return 0, fmt.Errorf("error deleting keys")
+	}
+	n := 0
+	for k := range c.Store {
+		if ok, _ := path.Match(pattern, k); ok {
+			delete(c.Store, k)
+			n++
+		}
+	}
+	return n, nil
+}
+func (c *ClientRedisTest) DeleteSessions(username string, service string) (int, error) {
+	if service == "" {
+		service = "*"
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	n, err := c.deleteKeys(fmt.Sprintf(c.GetConfig().TokenKey, username, service, "*"))
+	if err != nil {
+		return n, err
+	}
+	_, err = c.deleteKeys(fmt.Sprintf(c.GetConfig().RefreshFamilyKey, username, service, "*"))
+	if service == "*" {
+		delete(c.Store, fmt.Sprintf(c.GetConfig().GroupsKey, username))
+	}
+	return n, err
+}
 func (c *ClientRedisTest) GetConfig() *cnf.RedisConfig {
-	return &cnf.RedisConfig{APIKey: "serviceapikey@@%s", TokenKey: "token@@%s@@%s@@%s"}
+	return &cnf.RedisConfig{
+		APIKey:           "serviceapikey@@%s",
+		TokenKey:         "token@@%s@@%s@@%s",
+		RefreshKey:       "refresh@@%s",
+		RefreshFamilyKey: "refreshfamily@@%s@@%s@@%s",
+		RefreshTTL:       60,
+		Services:         "services",
+		AuthCodeKey:      "authcode@@%s",
+		CodeTTL:          60,
+		GroupsKey:        "groups@@%s",
+		GroupsTTL:        60,
+	}
 }
+func (c *ClientRedisTest) FindTTL(key string) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.Iserror {
+		return 0, fmt.Errorf("error finding key")
+	}
+	if _, ok := c.Store[key]; !ok {
+		return -2, nil
+	}
+	return 60, nil
+}
+
+// The API key of every service is A12345, the other strings are the ones of the store
 func (c *ClientRedisTest) FindString(key string) (string, error) {
 	if c.IserrorAPI {
 		return "", nil
 	}
-	return "A12345", nil
+	if strings.HasPrefix(key, strings.Replace(c.GetConfig().APIKey, "%s", "", 1)) {
+		return "A12345", nil
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.Store[key], nil
 }
 func (c *ClientRedisTest) CreateString(key string, value string) error {
 	return nil
 }
 func (c *ClientRedisTest) CreateKey(key string, s *TokenClaims) error {
+	return c.CreateObject(key, s, 0)
+}
+func (c *ClientRedisTest) ExpireKey(key string, ttl int) (bool, error) {
+	if c.IserrorCreate == true {
+		return false, fmt.Errorf("error in refreshing key")
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	_, ok := c.Store[key]
+	return ok, nil
+}
+func (c *ClientRedisTest) CreateObject(key string, v interface{}, ttl int) error {
 	if c.IserrorCreate == true {
 		return fmt.Errorf("error in creating key")
 	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.Store == nil {
+		c.Store = make(map[string]string)
+	}
+	b, _ := json.Marshal(v)
+	c.Store[key] = string(b)
+	return nil
+}
+func (c *ClientRedisTest) FindObject(key string, v interface{}) (bool, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.findObject(key, v)
+}
+func (c *ClientRedisTest) findObject(key string, v interface{}) (bool, error) {
+	if c.Iserror {
+		return false, fmt.Errorf("error finding key")
+	}
+	b, ok := c.Store[key]
+	if !ok {
+		return false, nil
+	}
+	return true, json.Unmarshal([]byte(b), v)
+}
+func (c *ClientRedisTest) TakeObject(key string, v interface{}) (bool, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	found, err := c.findObject(key, v)
+	delete(c.Store, key)
+	return found, err
+}
+func (c *ClientRedisTest) SwapString(key string, old string, value string, ttl int) (bool, error) {
+	if c.IserrorCreate == true {
+		return false, fmt.Errorf("error in creating key")
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.Store == nil {
+		c.Store = make(map[string]string)
+	}
+	if c.Store[key] != old {
+		return false, nil
+	}
+	c.Store[key] = value
+	return true, nil
+}
+func (c *ClientRedisTest) SwapStringWithObject(key string, old string, value string, objectKey string, v interface{}, ttl int) (bool, error) {
+	if c.IserrorCreate == true {
+		return false, fmt.Errorf("error in creating key")
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.Store == nil {
+		c.Store = make(map[string]string)
+	}
+	if c.Store[key] != old {
+		return false, nil
+	}
+	c.Store[key] = value
+	b, _ := json.Marshal(v)
+	c.Store[objectKey] = string(b)
+	return true, nil
+}
+func (c *ClientRedisTest) FindService(name string) (*redis.Service, error) {
+	if c.Iserror {
+		return nil, fmt.Errorf("error finding service")
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.Services[name], nil
+}
+func (c *ClientRedisTest) FindServices() ([]*redis.Service, error) {
+	if c.Iserror {
+		return nil, fmt.Errorf("error finding services")
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	services := make([]*redis.Service, 0, len(c.Services))
+	for _, s := range c.Services {
+		services = append(services, s)
+	}
+	return services, nil
+}
+func (c *ClientRedisTest) SaveService(s *redis.Service) error {
+	if c.IserrorCreate {
+		return fmt.Errorf("error saving service")
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.Services == nil {
+		c.Services = make(map[string]*redis.Service)
+	}
+	c.Services[s.Name] = s
 	return nil
 }
 func (c *ClientRedisTest) Health() error {
@@ -88,11 +279,23 @@ func (c *ClientTokenManagerTest) CreateToken(tk *TokenClaims, cipher string) (st
 	}
 	return "cryptoText", nil
 }
+func (c *ClientTokenManagerTest) CreateIDToken(tk *IDTokenClaims, cipher string) (string, error) {
+	if c.Iserror {
+		return "", fmt.Errorf("Error creating token")
+	}
+	return "idToken", nil
+}
 func (c *ClientTokenManagerTest) ValidateToken(tokenString string, cipher string) (*TokenClaims, error) {
 	if c.Iserror {
 		return nil, fmt.Errorf("error in token")
 	}
-	return &TokenClaims{Username: "V", Service: "V"}, nil
+	if c.Claims != nil {
+		return c.Claims, nil
+	}
+	return &TokenClaims{Username: "V", Service: "V", Session: "S"}, nil
+}
+func (c *ClientTokenManagerTest) JWKS() *JSONWebKeySet {
+	return &JSONWebKeySet{Keys: []*JSONWebKey{{Kty: "OKP", Crv: "Ed25519", Kid: "mock", X: "mock"}}}
 }
 func (c *ClientTokenManagerTest) Health() error {
 	if c.Iserror {
@@ -104,21 +307,69 @@ func (c *ClientTokenManagerTest) Health() error {
 // MOCK SECURE INTERFACE - END
 
 // MOCK LDAP INTERFACE - START
-func (c *ClientLdapTest) Connect() error {
+// The realm ACME, also named acme.local, is the only one besides the default realm
+func (c *ClientLdapTest) Realm(username, realm string) (string, string, error) {
+	if realm != "" && !strings.EqualFold(realm, "ACME") {
+		return "", "", fmt.Errorf("Unknown realm %s", realm)
+	}
+	if strings.HasPrefix(strings.ToUpper(username), `ACME\`) {
+		return "ACME", username[5:], nil
+	}
+	if strings.HasSuffix(strings.ToLower(username), "@acme.local") {
+		return "ACME", username[:len(username)-11], nil
+	}
+	if realm != "" {
+		return "ACME", username, nil
+	}
+	return "", username, nil
+}
+func (c *ClientLdapTest) RealmName(realm string) (string, error) {
+	switch strings.ToUpper(realm) {
+	case "":
+		return "", nil
+	case "ACME", "ACME.LOCAL":
+		return "ACME", nil
+	}
+	return "", fmt.Errorf("Unknown realm %s", realm)
+}
+func (c *ClientLdapTest) Session(realm string) (ldap.SessionI, error) {
+	if c.Iserror {
+		return nil, fmt.Errorf("Error decrypting")
+	}
+	return &ClientLdapSessionTest{Realm: realm}, nil
+}
+func (c *ClientLdapTest) Health() error {
 	if c.Iserror {
-		return fmt.Errorf("Error decrypting")
+		return fmt.Errorf("Error LDAP Health")
 	}
 	return nil
 }
-func (c *ClientLdapTest) Close() {}
+func (c *ClientLdapTest) Servers() []ldap.ServerStatus {
+	if c.Iserror {
+		return []ldap.ServerStatus{{Address: "dc1:389", Failures: 2, Reason: ldap.ReasonUnknownAuthority, Detail: "Error LDAP Health"}, {Address: "dc2:389", Available: true}}
+	}
+	return []ldap.ServerStatus{{Address: "dc1:389", Available: true}}
+}
+func (c *ClientLdapSessionTest) Close() {}
 
-func (c *ClientLdapTest) Authenticate(username, password string) (string, error) {
+func (c *ClientLdapSessionTest) Authenticate(username, password string) (*ldap.User, error) {
 	if username == "B" {
-		return "", fmt.Errorf("Error Auth")
+		return nil, fmt.Errorf("Error Auth")
+	}
+	// the typed failures of the directory
+	switch username {
+	case "W":
+		return nil, &ldap.AuthError{Code: ldap.CodeInvalidCredentials, Err: fmt.Errorf("data 52e")}
+	case "N":
+		return nil, &ldap.AuthError{Code: ldap.CodeUserNotFound, Err: fmt.Errorf("data 525")}
+	case "L":
+		return nil, &ldap.AuthError{Code: ldap.CodeAccountLocked, Err: fmt.Errorf("data 775")}
+	case "U":
+		return nil, &ldap.AuthError{Code: ldap.CodeDirectoryUnavailable, Err: fmt.Errorf("connection reset")}
 	}
-	return "", nil
+	return &ldap.User{Username: ldap.Qualify(username, c.Realm), Realm: c.Realm, Name: "Name " + username, Email: username + "@company.local", Claims: map[string]interface{}{"department": "IT"}}, nil
 }
-func (c *ClientLdapTest) GetGroupsOfUser(username string) (map[string]string, error) {
+func (c *ClientLdapSessionTest) GetGroupsOfUser(username string) (map[string]string, error) {
 
 	if username == "C" {
 		return nil, fmt.Errorf("Error Auth")
@@ -132,11 +383,71 @@ func (c *ClientLdapTest) GetGroupsOfUser(username string) (map[string]string, er
 
 	return gr, nil
 }
-func (c *ClientLdapTest) Health() error {
-	if c.Iserror {
-		return fmt.Errorf("Error LDAP Health")
+func (c *ClientLdapSessionTest) ChangePassword(username, oldPassword, newPassword string) error {
+	if _, err := c.Authenticate(username, oldPassword); err != nil {
+		return err
+	}
+	// the password policy of the directory refuses the weak passwords
+	if newPassword == "weak" {
+		return &ldap.AuthError{Code: ldap.CodePasswordPolicy, Err: fmt.Errorf("0000052D: Constraint violation")}
 	}
 	return nil
 }
 
+func (c *ClientLdapSessionTest) FindUser(username string) (*ldap.User, error) {
+	switch username {
+	case "Z":
+		return nil, nil
+	case "B":
+		return nil, fmt.Errorf("Error Lookup")
+	}
+	return c.Authenticate(username, "")
+}
+
+// The directory has the users A, AB and AC
+func (c *ClientLdapSessionTest) SearchUsers(prefix string, limit int) ([]*ldap.User, bool, error) {
+	if prefix == "B" {
+		return nil, false, fmt.Errorf("Error Lookup")
+	}
+	users := make([]*ldap.User, 0)
+	for _, u := range []string{"A", "AB", "AC"} {
+		if strings.HasPrefix(u, prefix) {
+			user, _ := c.Authenticate(u, "")
+			users = append(users, user)
+		}
+	}
+	if limit > 0 && len(users) > limit {
+		return users[:limit], true, nil
+	}
+	return users, false, nil
+}
+
+// Every group but Z has the members A and E
+func (c *ClientLdapSessionTest) GroupMembers(name string, limit int) (*ldap.Group, bool, error) {
+	switch name {
+	case "Z":
+		return nil, false, nil
+	case "U":
+		return nil, false, &ldap.AuthError{Code: ldap.CodeDirectoryUnavailable, Err: fmt.Errorf("connection reset")}
+	}
+	a, _ := c.Authenticate("A", "")
+	e, _ := c.Authenticate("E", "")
+	g := &ldap.Group{Name: strings.ToUpper(name), DN: "cn=" + name, Members: []*ldap.User{a, e}}
+	if limit > 0 && limit < 2 {
+		g.Members = g.Members[:limit]
+		return g, true, nil
+	}
+	return g, false, nil
+}
+
 // MOCK LDAP INTERFACE - END
+
+// MOCK KEY STORE INTERFACE - START
+func (c *KeyStoreTest) FindSigningKeys() ([]*SigningKey, error) {
+	if c.Iserror {
+		return nil, fmt.Errorf("Error finding signing keys")
+	}
+	return c.Keys, nil
+}
+
+// MOCK KEY STORE INTERFACE - END
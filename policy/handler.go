@@ -0,0 +1,315 @@
+package policy
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"unicode"
+)
+
+const (
+	KeywordAnd = "AND"
+	KeywordOr  = "OR"
+	KeywordNot = "NOT"
+)
+
+type (
+	// group is met when the user belongs to a group matching the pattern, * and ? are wildcards
+	group struct {
+		pattern string
+		re      *regexp.Regexp
+	}
+	not struct {
+		expr Expr
+	}
+	and struct {
+		exprs []Expr
+	}
+	or struct {
+		exprs []Expr
+	}
+)
+
+// Parse parses a requirement like "FINANCE AND VPN-USERS AND NOT CONTRACTORS".
+// NOT binds tighter than AND, and AND tighter than OR, parentheses group the expressions.
+// The group names with spaces, parentheses or named like a keyword are quoted, like "DOMAIN USERS".
+func Parse(requirement string) (Expr, error) {
+	tokens, err := tokenize(requirement)
+	if err != nil {
+		return nil, err
+	}
+	p := &parser{tokens: tokens}
+	if len(p.tokens) == 0 {
+		return nil, fmt.Errorf("The requirement is empty")
+	}
+
+	e, err := p.or()
+	if err != nil {
+		return nil, err
+	}
+	if t := p.peek(); t != "" {
+		return nil, fmt.Errorf("Unexpected %s in the requirement", t)
+	}
+
+	return e, nil
+}
+
+// Evaluate checks the upper case groups of the user against the requirement, the reason is nil when it is met
+func Evaluate(e Expr, groups map[string]string) *Reason {
+	if ok, unmet := e.Eval(groups); !ok {
+		return &Reason{Requirement: e.String(), Unmet: unmet}
+	}
+	return nil
+}
+
+// Splits the requirement in the keywords, the parentheses and the group patterns.
+// The quoted patterns keep their quotes, so they are never taken for a keyword or a parenthesis.
+func tokenize(requirement string) ([]string, error) {
+	tokens := make([]string, 0)
+	for i := 0; i < len(requirement); {
+		switch c := requirement[i]; {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			i++
+		case c == '(' || c == ')':
+			tokens = append(tokens, requirement[i:i+1])
+			i++
+		case c == '"':
+			j := strings.IndexByte(requirement[i+1:], '"')
+			if j < 0 {
+				return nil, fmt.Errorf("Missing \" in the requirement")
+			}
+			tokens = append(tokens, requirement[i:i+j+2])
+			i += j + 2
+		default:
+			j := strings.IndexAny(requirement[i:], " \t\n\r()\"")
+			if j < 0 {
+				j = len(requirement) - i
+			}
+			tokens = append(tokens, requirement[i:i+j])
+			i += j
+		}
+	}
+	return tokens, nil
+}
+
+type parser struct {
+	tokens []string
+	pos    int
+}
+
+// Returns the next token without consuming it, empty at the end
+func (p *parser) peek() string {
+	if p.pos < len(p.tokens) {
+		return p.tokens[p.pos]
+	}
+	return ""
+}
+
+// Consumes the next token when it is the keyword
+func (p *parser) accept(keyword string) bool {
+	if strings.EqualFold(p.peek(), keyword) {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+func (p *parser) or() (Expr, error) {
+	e, err := p.and()
+	if err != nil {
+		return nil, err
+	}
+	exprs := []Expr{e}
+	for p.accept(KeywordOr) {
+		if e, err = p.and(); err != nil {
+			return nil, err
+		}
+		exprs = append(exprs, e)
+	}
+
+	if len(exprs) == 1 {
+		return exprs[0], nil
+	}
+	return &or{exprs}, nil
+}
+
+func (p *parser) and() (Expr, error) {
+	e, err := p.not()
+	if err != nil {
+		return nil, err
+	}
+	exprs := []Expr{e}
+	for p.accept(KeywordAnd) {
+		if e, err = p.not(); err != nil {
+			return nil, err
+		}
+		exprs = append(exprs, e)
+	}
+
+	if len(exprs) == 1 {
+		return exprs[0], nil
+	}
+	return &and{exprs}, nil
+}
+
+func (p *parser) not() (Expr, error) {
+	if p.accept(KeywordNot) {
+		e, err := p.not()
+		if err != nil {
+			return nil, err
+		}
+		return &not{e}, nil
+	}
+	return p.operand()
+}
+
+func (p *parser) operand() (Expr, error) {
+	t := p.peek()
+	switch {
+	case t == "":
+		return nil, fmt.Errorf("Unexpected end of the requirement")
+	case t == "(":
+		p.pos++
+		e, err := p.or()
+		if err != nil {
+			return nil, err
+		}
+		if !p.accept(")") {
+			return nil, fmt.Errorf("Missing ) in the requirement")
+		}
+		return e, nil
+	case t == ")" || strings.EqualFold(t, KeywordAnd) || strings.EqualFold(t, KeywordOr):
+		return nil, fmt.Errorf("Unexpected %s in the requirement", t)
+	}
+
+	p.pos++
+	pattern := strings.ToUpper(t)
+	if len(pattern) > 1 && pattern[0] == '"' {
+		pattern = pattern[1 : len(pattern)-1]
+		if pattern == "" {
+			return nil, fmt.Errorf("Empty group in the requirement")
+		}
+	}
+	re, err := compile(pattern)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid group pattern %s", t)
+	}
+	return &group{pattern, re}, nil
+}
+
+// Compiles the pattern of the group names, * matches any characters, ? one character and [...] one of them.
+// Unlike the file paths, the / of the group names is matched by the wildcards.
+func compile(pattern string) (*regexp.Regexp, error) {
+	if !strings.ContainsAny(pattern, "*?[") {
+		return nil, nil
+	}
+
+	var b strings.Builder
+	b.WriteString("^(?s:")
+	for i := 0; i < len(pattern); i++ {
+		switch c := pattern[i]; c {
+		case '*':
+			b.WriteString(".*")
+		case '?':
+			b.WriteString(".")
+		case '[':
+			j := strings.IndexByte(pattern[i+1:], ']')
+			if j <= 0 {
+				return nil, fmt.Errorf("Missing ] in the pattern %s", pattern)
+			}
+			class := pattern[i+1 : i+1+j]
+			b.WriteString("[")
+			if class[0] == '^' {
+				b.WriteString("^")
+				class = class[1:]
+			}
+			// the ranges are kept, the other characters are literal
+			b.WriteString(strings.NewReplacer(`\`, `\\`, "[", `\[`, "^", `\^`).Replace(class))
+			b.WriteString("]")
+			i += j + 1
+		default:
+			b.WriteString(regexp.QuoteMeta(pattern[i : i+1]))
+		}
+	}
+	b.WriteString(")$")
+	return regexp.Compile(b.String())
+}
+
+func (g *group) Eval(groups map[string]string) (bool, []string) {
+	if _, ok := groups[g.pattern]; ok {
+		return true, nil
+	}
+	if g.re != nil {
+		for gr := range groups {
+			if g.re.MatchString(gr) {
+				return true, nil
+			}
+		}
+	}
+	return false, []string{g.String()}
+}
+
+// The names that can't be read back as a group are quoted
+func (g *group) String() string {
+	if strings.ContainsAny(g.pattern, "()") || strings.IndexFunc(g.pattern, unicode.IsSpace) >= 0 ||
+		g.pattern == KeywordAnd || g.pattern == KeywordOr || g.pattern == KeywordNot {
+		return `"` + g.pattern + `"`
+	}
+	return g.pattern
+}
+
+func (n *not) Eval(groups map[string]string) (bool, []string) {
+	if ok, _ := n.expr.Eval(groups); ok {
+		return false, []string{n.String()}
+	}
+	return true, nil
+}
+
+func (n *not) String() string {
+	switch n.expr.(type) {
+	case *group, *not:
+		return KeywordNot + " " + n.expr.String()
+	}
+	return KeywordNot + " (" + n.expr.String() + ")"
+}
+
+// Every unmet operand is reported
+func (a *and) Eval(groups map[string]string) (bool, []string) {
+	var unmet []string
+	for _, e := range a.exprs {
+		if ok, u := e.Eval(groups); !ok {
+			unmet = append(unmet, u...)
+		}
+	}
+	return len(unmet) == 0, unmet
+}
+
+func (a *and) String() string {
+	s := make([]string, len(a.exprs))
+	for i, e := range a.exprs {
+		if _, ok := e.(*or); ok {
+			s[i] = "(" + e.String() + ")"
+		} else {
+			s[i] = e.String()
+		}
+	}
+	return strings.Join(s, " "+KeywordAnd+" ")
+}
+
+// None of the operands is met, the whole expression is reported
+func (o *or) Eval(groups map[string]string) (bool, []string) {
+	for _, e := range o.exprs {
+		if ok, _ := e.Eval(groups); ok {
+			return true, nil
+		}
+	}
+	return false, []string{o.String()}
+}
+
+func (o *or) String() string {
+	s := make([]string, len(o.exprs))
+	for i, e := range o.exprs {
+		s[i] = e.String()
+	}
+	return strings.Join(s, " "+KeywordOr+" ")
+}
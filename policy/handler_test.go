@@ -0,0 +1,97 @@
+package policy
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+/*
+Provider struct for Parse method
+*/
+type providerParse struct {
+	requirement string
+	iserro      bool
+	expr        string
+}
+
+var testProviderParse = []providerParse{
+	{"", true, ""},                                  // empty
+	{"FINANCE AND", true, ""},                       // missing operand
+	{"(FINANCE OR VPN", true, ""},                   // missing parenthesis
+	{"FINANCE VPN", true, ""},                       // missing operator
+	{"OR FINANCE", true, ""},                        // unexpected operator
+	{"APP-[", true, ""},                             // invalid pattern
+	{"finance", false, "FINANCE"},                   // OK group
+	{"a and b or not c", false, "A AND B OR NOT C"}, // OK precedence
+	{"A AND (B OR C)", false, "A AND (B OR C)"},     // OK parentheses
+	{"NOT (A OR B)", false, "NOT (A OR B)"},         // OK not of expression
+	{"APP-* AND NOT NOT X", false, "APP-* AND NOT NOT X"},
+	{`"Domain Users" AND NOT "Guests (ext)"`, false, `"DOMAIN USERS" AND NOT "GUESTS (EXT)"`}, // OK quoted groups
+	{`"and" OR "Or"`, false, `"AND" OR "OR"`},                                                 // OK groups named like keywords
+	{`"Domain Users`, true, ""},                                                               // missing quote
+	{`""`, true, ""},                                                                          // empty quoted group
+	{`"A"B`, true, ""},                                                                        // missing operator after the quote
+}
+
+/* Test for Parse method */
+func TestParse(t *testing.T) {
+
+	for _, pair := range testProviderParse {
+
+		e, err := Parse(pair.requirement)
+		// Assertions
+		assert.Equal(t, pair.iserro, (err != nil), pair.requirement)
+		if err == nil {
+			assert.Equal(t, pair.expr, e.String())
+		}
+	}
+}
+
+/*
+Provider struct for Evaluate method
+*/
+type providerEvaluate struct {
+	requirement string
+	groups      []string
+	unmet       []string
+}
+
+var testProviderEvaluate = []providerEvaluate{
+	{"FINANCE AND VPN-USERS AND NOT CONTRACTORS", []string{"FINANCE", "VPN-USERS"}, nil},                                        // OK
+	{"FINANCE AND VPN-USERS AND NOT CONTRACTORS", []string{"FINANCE", "CONTRACTORS"}, []string{"VPN-USERS", "NOT CONTRACTORS"}}, // every unmet part
+	{"FINANCE OR IT-OPS", []string{"SALES"}, []string{"FINANCE OR IT-OPS"}},                                                     // none of the groups
+	{"FINANCE OR IT-OPS", []string{"IT-OPS"}, nil},                                                                              // OK any of the groups
+	{"app-*", []string{"APP-ADMINS"}, nil},                                                                                      // OK wildcard
+	{"APP-?", []string{"APP-AB"}, []string{"APP-?"}},                                                                            // wildcard of one character
+	{"NOT (APP-* OR EXT-*)", []string{"EXT-PARTNERS"}, []string{"NOT (APP-* OR EXT-*)"}},                                        // excluded by pattern
+	{`"Domain Users" AND "VPN *"`, []string{"DOMAIN USERS", "VPN FULL"}, nil},                                                   // OK quoted groups
+	{`"Domain Users"`, []string{"DOMAIN", "USERS"}, []string{`"DOMAIN USERS"`}},                                                 // quoted group is one name
+	{"IT*", []string{"IT/OPS"}, nil},                                                                                            // OK wildcard matches /
+	{"IT-?PS", []string{"IT/OPS"}, []string{"IT-?PS"}},                                                                          // wildcard of one character
+	{"APP-[AB]*", []string{"APP-BI"}, nil},                                                                                      // OK class of characters
+	{"APP-[^AB]*", []string{"APP-BI"}, []string{"APP-[^AB]*"}},                                                                  // negated class of characters
+	{"A.*", []string{"AXB"}, []string{"A.*"}},                                                                                   // dot is no wildcard
+}
+
+/* Test for Evaluate method */
+func TestEvaluate(t *testing.T) {
+
+	for _, pair := range testProviderEvaluate {
+
+		e, err := Parse(pair.requirement)
+		assert.Nil(t, err)
+
+		groups := make(map[string]string)
+		for _, g := range pair.groups {
+			groups[g] = g
+		}
+
+		r := Evaluate(e, groups)
+		// Assertions
+		if pair.unmet == nil {
+			assert.Nil(t, r, pair.requirement)
+		} else {
+			assert.Equal(t, &Reason{Requirement: e.String(), Unmet: pair.unmet}, r)
+		}
+	}
+}
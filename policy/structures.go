@@ -0,0 +1,14 @@
+package policy
+
+// Expr is a requirement on the LDAP groups of a user
+type Expr interface {
+	// Eval checks the upper case groups of the user, returns the unmet parts of the requirement
+	Eval(groups map[string]string) (bool, []string)
+	String() string
+}
+
+// Reason tells why the groups of a user don't meet the requirement
+type Reason struct {
+	Requirement string   `json:"requirement"`
+	Unmet       []string `json:"unmet"`
+}
@@ -6,6 +6,7 @@ import (
 	"github.com/garyburd/redigo/redis"
 	cnf "github.com/pintobikez/authentication-service/config/structures"
 	sec "github.com/pintobikez/authentication-service/secure/structures"
+	"strings"
 )
 
 type Client struct {
@@ -46,6 +47,98 @@ func (r *Client) DeleteKey(key string) error {
 	return nil
 }
 
+// Number of keys inspected by each SCAN iteration
+const scanCount = 500
+
+// Escapes the glob special characters so the value is matched literally
+var patternEscaper = strings.NewReplacer(`\`, `\\`, "*", `\*`, "?", `\?`, "[", `\[`, "]", `\]`)
+
+// EscapePattern escapes the value to be used inside a SCAN pattern
+func EscapePattern(value string) string {
+	return patternEscaper.Replace(value)
+}
+
+// DeleteKeys deletes the keys matching the pattern, iterating with SCAN so Redis is never blocked
+func (r *Client) DeleteKeys(pattern string) (int, error) {
+
+	c, err := r.Connect()
+	// Error connecting to redis
+	if err != nil {
+		return 0, err
+	}
+	defer c.Close()
+
+	deleted := 0
+	cursor := 0
+	for {
+		values, err := redis.Values(c.Do("SCAN", cursor, "MATCH", pattern, "COUNT", scanCount))
+		if err != nil {
+			return deleted, err
+		}
+
+		var keys []string
+		if _, err := redis.Scan(values, &cursor, &keys); err != nil {
+			return deleted, err
+		}
+
+		if len(keys) > 0 {
+			n, err := redis.Int(c.Do("DEL", redis.Args{}.AddFlat(keys)...))
+			if err != nil {
+				return deleted, err
+			}
+			deleted += n
+		}
+
+		if cursor == 0 {
+			return deleted, nil
+		}
+	}
+}
+
+// DeleteSessions deletes the sessions and refresh tokens of the user, of every service if
+// none is given, and returns the number of sessions deleted
+func (r *Client) DeleteSessions(username string, service string) (int, error) {
+
+	s := "*"
+	if service != "" {
+		s = EscapePattern(service)
+	}
+	u := EscapePattern(username)
+
+	n, err := r.DeleteKeys(fmt.Sprintf(r.Config.TokenKey, u, s, "*"))
+	if err != nil {
+		return n, err
+	}
+
+	if r.Config.RefreshFamilyKey != "" {
+		if _, err := r.DeleteKeys(fmt.Sprintf(r.Config.RefreshFamilyKey, u, s, "*")); err != nil {
+			return n, err
+		}
+	}
+
+	// without sessions left the cached groups can't be exchanged for new ones
+	if service == "" && r.Config.GroupsKey != "" {
+		if err := r.DeleteKey(fmt.Sprintf(r.Config.GroupsKey, username)); err != nil {
+			return n, err
+		}
+	}
+
+	return n, nil
+}
+
+// ExpireKey refreshes the TTL of the key, returns false if the key doesn't exist
+func (r *Client) ExpireKey(key string, ttl int) (bool, error) {
+
+	c, err := r.Connect()
+	// Error connecting to redis
+	if err != nil {
+		return false, err
+	}
+	defer c.Close()
+
+	return redis.Bool(c.Do("EXPIRE", key, ttl))
+}
+
 // CreateKey creates a key on Redis with the given TokenClaim
 func (r *Client) CreateKey(key string, s *sec.TokenClaims) error {
 
@@ -77,6 +170,164 @@ func (r *Client) CreateKey(key string, s *sec.TokenClaims) error {
 	return nil
 }
 
+// CreateObject saves the JSON of the given value on Redis, expiring after ttl seconds
+func (r *Client) CreateObject(key string, v interface{}, ttl int) error {
+
+	c, err := r.Connect()
+	// Error connecting to redis
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	// Format to JSON
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	// Save KEY to Redis with its TTL
+	_, err = c.Do("SET", key, b, "EX", ttl)
+	return err
+}
+
+// FindObject loads the JSON saved on the key into v, returns false if the key doesn't exist
+func (r *Client) FindObject(key string, v interface{}) (bool, error) {
+
+	c, err := r.Connect()
+	// Error connecting to redis
+	if err != nil {
+		return false, err
+	}
+	defer c.Close()
+
+	reply, err := redis.Bytes(c.Do("GET", key))
+	if err == redis.ErrNil {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	if err := json.Unmarshal(reply, v); err != nil {
+		return false, err
+	}
+
+	return true, nil
+}
+
+// TakeObject loads the JSON saved on the key into v and deletes the key in the same transaction,
+// so only one caller can take it. Returns false if the key doesn't exist
+func (r *Client) TakeObject(key string, v interface{}) (bool, error) {
+
+	c, err := r.Connect()
+	// Error connecting to redis
+	if err != nil {
+		return false, err
+	}
+	defer c.Close()
+
+	c.Send("MULTI")
+	c.Send("GET", key)
+	c.Send("DEL", key)
+	values, err := redis.Values(c.Do("EXEC"))
+	if err != nil {
+		return false, err
+	}
+
+	reply, err := redis.Bytes(values[0], nil)
+	if err == redis.ErrNil {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	if err := json.Unmarshal(reply, v); err != nil {
+		return false, err
+	}
+
+	return true, nil
+}
+
+// Sets the key to the new value if its current value is the old one
+var swapScript = redis.NewScript(1, `
+if redis.call("GET", KEYS[1]) == ARGV[1] then
+	return redis.call("SET", KEYS[1], ARGV[2], "EX", ARGV[3])
+end
+return false`)
+
+// SwapString atomically replaces the value of the key if it still holds the old value.
+// With an empty old value the key is only created if it doesn't exist.
+func (r *Client) SwapString(key string, old string, value string, ttl int) (bool, error) {
+
+	c, err := r.Connect()
+	// Error connecting to redis
+	if err != nil {
+		return false, err
+	}
+	defer c.Close()
+
+	var reply interface{}
+	if old == "" {
+		reply, err = c.Do("SET", key, value, "EX", ttl, "NX")
+	} else {
+		reply, err = swapScript.Do(c, key, old, value, ttl)
+	}
+	if err != nil {
+		return false, err
+	}
+
+	return reply != nil, nil
+}
+
+// Sets the key to the new value if its current value is the old one, and saves the object on the second key
+var swapObjectScript = redis.NewScript(2, `
+if redis.call("GET", KEYS[1]) == ARGV[1] then
+	redis.call("SET", KEYS[1], ARGV[2], "EX", ARGV[3])
+	return redis.call("SET", KEYS[2], ARGV[4], "EX", ARGV[3])
+end
+return false`)
+
+// SwapStringWithObject atomically replaces the value of the key if it still holds the old value,
+// and in the same script saves the JSON of v on the object key. Nothing is written when the key changed.
+func (r *Client) SwapStringWithObject(key string, old string, value string, objectKey string, v interface{}, ttl int) (bool, error) {
+
+	c, err := r.Connect()
+	// Error connecting to redis
+	if err != nil {
+		return false, err
+	}
+	defer c.Close()
+
+	// Format to JSON
+	b, err := json.Marshal(v)
+	if err != nil {
+		return false, err
+	}
+
+	reply, err := swapObjectScript.Do(c, key, objectKey, old, value, ttl, b)
+	if err != nil {
+		return false, err
+	}
+
+	return reply != nil, nil
+}
+
+// FindTTL returns the seconds until the key expires, -2 if the key doesn't exist
+// and -1 if it never expires
+func (r *Client) FindTTL(key string) (int, error) {
+
+	c, err := r.Connect()
+	// Error connecting to redis
+	if err != nil {
+		return 0, err
+	}
+	defer c.Close()
+
+	return redis.Int(c.Do("TTL", key))
+}
+
 func (r *Client) FindString(key string) (string, error) {
 
 	c, err := r.Connect()
@@ -120,6 +371,162 @@ func (r *Client) CreateString(key string, value string) error {
 	return nil
 }
 
+// FindSigningKeys retrieves the keys of the signing key ring
+func (r *Client) FindSigningKeys() ([]*sec.SigningKey, error) {
+
+	c, err := r.Connect()
+	// Error connecting to redis
+	if err != nil {
+		return nil, err
+	}
+	defer c.Close()
+
+	values, err := redis.StringMap(c.Do("HGETALL", r.Config.KeyRing))
+	if err != nil {
+		return nil, err
+	}
+
+	keys := make([]*sec.SigningKey, 0, len(values))
+	for _, v := range values {
+		k := new(sec.SigningKey)
+		if err := json.Unmarshal([]byte(v), k); err != nil {
+			return nil, err
+		}
+		keys = append(keys, k)
+	}
+
+	return keys, nil
+}
+
+// SaveSigningKey adds or replaces a key in the signing key ring
+func (r *Client) SaveSigningKey(k *sec.SigningKey) error {
+
+	c, err := r.Connect()
+	// Error connecting to redis
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	// Format to JSON
+	b, err := json.Marshal(k)
+	if err != nil {
+		return err
+	}
+
+	_, err = c.Do("HSET", r.Config.KeyRing, k.ID, b)
+	return err
+}
+
+// DeleteSigningKey removes a key from the signing key ring
+func (r *Client) DeleteSigningKey(kid string) error {
+
+	c, err := r.Connect()
+	// Error connecting to redis
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	_, err = c.Do("HDEL", r.Config.KeyRing, kid)
+	return err
+}
+
+// FindService retrieves the registration of the service, nil if it has none
+func (r *Client) FindService(name string) (*Service, error) {
+
+	if r.Config.Services == "" {
+		return nil, nil
+	}
+
+	c, err := r.Connect()
+	// Error connecting to redis
+	if err != nil {
+		return nil, err
+	}
+	defer c.Close()
+
+	reply, err := redis.Bytes(c.Do("HGET", r.Config.Services, name))
+	if err == redis.ErrNil {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	s := new(Service)
+	if err := json.Unmarshal(reply, s); err != nil {
+		return nil, err
+	}
+
+	return s, nil
+}
+
+// FindServices retrieves the registrations of every service
+func (r *Client) FindServices() ([]*Service, error) {
+
+	if r.Config.Services == "" {
+		return nil, nil
+	}
+
+	c, err := r.Connect()
+	// Error connecting to redis
+	if err != nil {
+		return nil, err
+	}
+	defer c.Close()
+
+	values, err := redis.StringMap(c.Do("HGETALL", r.Config.Services))
+	if err != nil {
+		return nil, err
+	}
+
+	services := make([]*Service, 0, len(values))
+	for _, v := range values {
+		s := new(Service)
+		if err := json.Unmarshal([]byte(v), s); err != nil {
+			return nil, err
+		}
+		services = append(services, s)
+	}
+
+	return services, nil
+}
+
+// SaveService adds or replaces the registration of a service
+func (r *Client) SaveService(s *Service) error {
+
+	c, err := r.Connect()
+	// Error connecting to redis
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	// Format to JSON
+	b, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+
+	_, err = c.Do("HSET", r.Config.Services, s.Name, b)
+	return err
+}
+
+// DeleteService removes the registration of a service
+func (r *Client) DeleteService(name string) error {
+
+	c, err := r.Connect()
+	// Error connecting to redis
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	_, err = c.Do("HDEL", r.Config.Services, name)
+	return err
+}
+
 // Health Endpoint of the Client
 func (r *Client) Health() error {
 
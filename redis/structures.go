@@ -4,18 +4,102 @@ import (
 	"github.com/garyburd/redigo/redis"
 	cnf "github.com/pintobikez/authentication-service/config/structures"
 	sec "github.com/pintobikez/authentication-service/secure/structures"
+	"sort"
+	"strings"
 )
 
 type ApiKey struct {
 	Key string
 }
 
+// Service is the registration of a service calling the Authentication Service
+type Service struct {
+	Name string `json:"name"`
+	// The browser sessions of the service are kept in cookies
+	Cookie bool `json:"cookie,omitempty"`
+	// Browser origins allowed to send requests with credentials
+	Origins []string `json:"origins,omitempty"`
+	// Scopes the service can be granted with the client credentials
+	Scopes []string `json:"scopes,omitempty"`
+	// Redirect URIs allowed in the authorization code flow
+	RedirectURIs []string `json:"redirectUris,omitempty"`
+	// Groups checked when the user logs in without sending the groups
+	Groups []string `json:"groups,omitempty"`
+	// Roles of the service and the LDAP groups granting each of them
+	Roles map[string][]string `json:"roles,omitempty"`
+	// Requirement on the LDAP groups the users must meet, like "FINANCE AND NOT CONTRACTORS"
+	Require string `json:"require,omitempty"`
+	// The service can look up the users and the groups of the directory
+	Directory bool `json:"directory,omitempty"`
+}
+
+// ChecksGroups tells if the service registers the groups checked at the login, directly, by its roles or its requirement
+func (s *Service) ChecksGroups() bool {
+	return len(s.Groups) > 0 || len(s.Roles) > 0 || s.Require != ""
+}
+
+// RoleGroups returns every LDAP group granting a role
+func (s *Service) RoleGroups() []string {
+	groups := make([]string, 0)
+	for _, gr := range s.Roles {
+		groups = append(groups, gr...)
+	}
+	return groups
+}
+
+// RolesOf returns the sorted roles granted by the upper case LDAP groups of the user
+func (s *Service) RolesOf(groups map[string]string) []string {
+	roles := make([]string, 0)
+	for role, gr := range s.Roles {
+		for _, g := range gr {
+			if _, ok := groups[strings.ToUpper(g)]; ok {
+				roles = append(roles, role)
+				break
+			}
+		}
+	}
+	sort.Strings(roles)
+	return roles
+}
+
+// AllowsOrigin checks if the browser origin is registered by the service
+func (s *Service) AllowsOrigin(origin string) bool {
+	for _, o := range s.Origins {
+		if o == origin {
+			return true
+		}
+	}
+	return false
+}
+
+// AllowsRedirect checks if the redirect URI is registered by the service, it must match exactly
+func (s *Service) AllowsRedirect(uri string) bool {
+	for _, u := range s.RedirectURIs {
+		if u == uri {
+			return true
+		}
+	}
+	return false
+}
+
 type ClientI interface {
 	Connect() (redis.Conn, error)
 	CreateString(key string, value string) error
 	CreateKey(key string, s *sec.TokenClaims) error
+	CreateObject(key string, v interface{}, ttl int) error
 	DeleteKey(key string) error
+	DeleteKeys(pattern string) (int, error)
+	DeleteSessions(username string, service string) (int, error)
+	ExpireKey(key string, ttl int) (bool, error)
 	FindString(key string) (string, error)
+	FindTTL(key string) (int, error)
+	FindObject(key string, v interface{}) (bool, error)
+	TakeObject(key string, v interface{}) (bool, error)
+	SwapString(key string, old string, value string, ttl int) (bool, error)
+	SwapStringWithObject(key string, old string, value string, objectKey string, v interface{}, ttl int) (bool, error)
+	FindService(name string) (*Service, error)
+	FindServices() ([]*Service, error)
+	SaveService(s *Service) error
 	GetConfig() *cnf.RedisConfig
 	Health() error
 }
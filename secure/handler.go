@@ -1,32 +1,130 @@
 package secure
 
 import (
-	cnf "github.com/pintobikez/authentication-service/config/structures"
-	strut "github.com/pintobikez/authentication-service/secure/structures"
+	"crypto"
 	"errors"
 	"github.com/dgrijalva/jwt-go"
+	cnf "github.com/pintobikez/authentication-service/config/structures"
+	strut "github.com/pintobikez/authentication-service/secure/structures"
+	"sync"
 	"time"
 )
 
 var (
-	ErrorSigningMethod = errors.New("Unexpected siging method")
-	ErrorTokenObject   = errors.New("Invalid token content")
-	ErrorConfigFile    = errors.New("Security Config file not loaded")
-	ErrorConfigValues  = errors.New("Security Config contains errors")
+	ErrorSigningMethod     = errors.New("Unexpected siging method")
+	ErrorTokenObject       = errors.New("Invalid token content")
+	ErrorConfigFile        = errors.New("Security Config file not loaded")
+	ErrorConfigValues      = errors.New("Security Config contains errors")
+	ErrorPrivateKeyMissing = errors.New("Security Config algorithm requires a private key")
+)
+
+const (
+	HeaderKeyID = "kid"
+	// Default interval in seconds to reload the key ring from the store
+	DefaultKeyRefresh = 60
 )
 
 type TokenManager struct {
 	Config *cnf.SecurityConfig
+	// Store shared by every replica holding the signing key ring
+	Store strut.KeyStoreI
+
+	mu       sync.Mutex
+	static   *ringKey
+	ring     *KeyRing
+	loadedAt time.Time
+	storeErr error
+}
+
+// New creates a TokenManager and loads the private key configured to sign tokens
+func New(c *cnf.SecurityConfig) (*TokenManager, error) {
+	s := &TokenManager{Config: c}
+
+	if c.PrivateKey == "" {
+		if s.algorithm() != jwt.SigningMethodHS256.Alg() {
+			return nil, ErrorPrivateKeyMissing
+		}
+		return s, nil
+	}
+
+	key, err := loadPrivateKey(c.PrivateKey)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.setSigningKey(key); err != nil {
+		return nil, err
+	}
+
+	return s, nil
+}
+
+// Sets the private key of the configuration used to sign the tokens
+func (s *TokenManager) setSigningKey(key crypto.Signer) error {
+	method, err := signingMethod(s.Config.Algorithm, key)
+	if err != nil {
+		return err
+	}
+	jwk, err := publicJWK(method, key.Public())
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.static = &ringKey{id: jwk.Kid, method: method, signer: key, jwk: jwk}
+	s.ring = nil
+
+	return nil
 }
 
 // Generates a JWT token
 func (s *TokenManager) CreateToken(tk *strut.TokenClaims, cipher string) (string, error) {
 
+	now := time.Now()
+	s.setStandardClaims(&tk.StandardClaims, now)
+	if tk.Subject == "" {
+		tk.Subject = tk.Username
+	}
+
+	return s.sign(tk, cipher, now)
+}
+
+// CreateIDToken generates the OpenID Connect id_token of the user
+func (s *TokenManager) CreateIDToken(tk *strut.IDTokenClaims, cipher string) (string, error) {
+
+	now := time.Now()
+	s.setStandardClaims(&tk.StandardClaims, now)
+
+	return s.sign(tk, cipher, now)
+}
+
+// Sets the issuer and the validity of the claims
+func (s *TokenManager) setStandardClaims(c *jwt.StandardClaims, now time.Time) {
 	// Add the time of expire time for the token
-	tk.ExpiresAt = time.Now().Add(time.Duration(s.Config.TTL) * time.Minute).Unix()
+	c.ExpiresAt = now.Add(time.Duration(s.Config.TTL) * time.Minute).Unix()
+	c.IssuedAt = now.Unix()
+	if c.Issuer == "" {
+		c.Issuer = s.Config.Issuer
+	}
+}
+
+// Signs the claims with the signing key of the ring
+func (s *TokenManager) sign(claims jwt.Claims, cipher string, now time.Time) (string, error) {
 
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, tk)
-	tokenString, err := token.SignedString([]byte(cipher))
+	// Without a private key the token is signed with the service API key
+	k := s.keyRing().signing(now)
+	if k == nil {
+		if s.algorithm() != jwt.SigningMethodHS256.Alg() {
+			return "", ErrorPrivateKeyMissing
+		}
+		token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
+		return token.SignedString([]byte(cipher))
+	}
+
+	token := jwt.NewWithClaims(k.method, claims)
+	token.Header[HeaderKeyID] = k.id
+	tokenString, err := token.SignedString(k.signingKey())
 	if err != nil {
 		return "", err
 	}
@@ -35,13 +133,34 @@ func (s *TokenManager) CreateToken(tk *strut.TokenClaims, cipher string) (string
 }
 
 func (s *TokenManager) ValidateToken(tokenString string, cipher string) (*strut.TokenClaims, error) {
+	ring := s.keyRing()
+
+	// Only the algorithms in the allow-list are accepted
+	p := &jwt.Parser{ValidMethods: s.algorithms()}
+
 	// Return a Token using the tokenString
-	token, err := jwt.ParseWithClaims(tokenString, &strut.TokenClaims{}, func(token *jwt.Token) (interface{}, error) {
-		// Make sure token's signature wasn't changed
-		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
+	token, err := p.ParseWithClaims(tokenString, &strut.TokenClaims{}, func(token *jwt.Token) (interface{}, error) {
+		// Tokens signed by the key ring carry the id of the key
+		if kid, ok := token.Header[HeaderKeyID].(string); ok && kid != "" {
+			k := ring.verification(kid, time.Now())
+			if k == nil {
+				return nil, ErrorKeyNotFound
+			}
+			// Make sure token's signature wasn't changed
+			if token.Method.Alg() != k.method.Alg() {
+				return nil, ErrorSigningMethod
+			}
+			return k.verificationKey(), nil
+		}
+
+		// Tokens signed with the service API key
+		if _, ok := token.Method.(*jwt.SigningMethodHMAC); ok {
+			return []byte(cipher), nil
+		}
+		if s.static == nil || token.Method.Alg() != s.static.method.Alg() {
 			return nil, ErrorSigningMethod
 		}
-		return []byte(cipher), nil
+		return s.static.verificationKey(), nil
 	})
 	if err != nil {
 		return nil, err
@@ -54,6 +173,11 @@ func (s *TokenManager) ValidateToken(tokenString string, cipher string) (*strut.
 	return nil, ErrorTokenObject
 }
 
+// JWKS returns the public keys that can be used to verify the tokens
+func (s *TokenManager) JWKS() *strut.JSONWebKeySet {
+	return &strut.JSONWebKeySet{Keys: s.keyRing().public(time.Now())}
+}
+
 // Health Endpoint of the Client
 func (s *TokenManager) Health() error {
 	if s.Config == nil {
@@ -62,5 +186,82 @@ func (s *TokenManager) Health() error {
 	if s.Config.TTL <= 0 || s.Config.CipherKey == "" {
 		return ErrorConfigValues
 	}
-	return nil
+	if s.keyRing().signing(time.Now()) == nil && s.algorithm() != jwt.SigningMethodHS256.Alg() {
+		return ErrorPrivateKeyMissing
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.storeErr
+}
+
+// Returns the key ring, reloading it from the store when the refresh interval has passed.
+// If the store fails the previously loaded keys are kept.
+func (s *TokenManager) keyRing() *KeyRing {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.ring != nil && (s.Store == nil || time.Since(s.loadedAt) < s.keyRefresh()) {
+		return s.ring
+	}
+
+	s.loadedAt = time.Now()
+
+	var keys []*ringKey
+	if s.Store != nil {
+		stored, err := s.Store.FindSigningKeys()
+		if err == nil {
+			var ring *KeyRing
+			if ring, err = NewKeyRing(stored, s.Config.CipherKey); err == nil {
+				keys = ring.keys
+			}
+		}
+		s.storeErr = err
+
+		// keep the previous keys when the store is not available
+		if err != nil && s.ring != nil {
+			return s.ring
+		}
+	}
+
+	// the key of the configuration is the oldest one of the ring
+	if s.static != nil {
+		keys = append(keys, s.static)
+	}
+	s.ring = &KeyRing{keys: keys}
+
+	return s.ring
+}
+
+// Returns the interval to reload the key ring from the store
+func (s *TokenManager) keyRefresh() time.Duration {
+	if s.Config.KeyRefresh > 0 {
+		return time.Duration(s.Config.KeyRefresh) * time.Second
+	}
+	return DefaultKeyRefresh * time.Second
+}
+
+// Returns the algorithm used to sign the tokens, HS256 by default
+func (s *TokenManager) algorithm() string {
+	if s.Config.Algorithm == "" {
+		return jwt.SigningMethodHS256.Alg()
+	}
+	return s.Config.Algorithm
+}
+
+// Returns the algorithms accepted when validating a token, by default the signing ones
+func (s *TokenManager) algorithms() []string {
+	if len(s.Config.Algorithms) > 0 {
+		return s.Config.Algorithms
+	}
+
+	algs := []string{s.algorithm()}
+	if s.static != nil {
+		algs[0] = s.static.method.Alg()
+	}
+	for _, k := range s.keyRing().keys {
+		algs = append(algs, k.method.Alg())
+	}
+	return algs
 }
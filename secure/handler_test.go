@@ -1,6 +1,15 @@
 package secure
 
 import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"github.com/dgrijalva/jwt-go"
 	strut "github.com/pintobikez/authentication-service/config/structures"
 	. "github.com/pintobikez/authentication-service/secure/structures"
 	// "fmt"
@@ -29,7 +38,7 @@ func TestCreateToken(t *testing.T) {
 
 	for _, pair := range testProviderCreateToken {
 
-		s := &TokenManager{&strut.SecurityConfig{CipherKey: pair.cipher, TTL: pair.ttl}}
+		s := &TokenManager{Config: &strut.SecurityConfig{CipherKey: pair.cipher, TTL: pair.ttl}}
 		tk := new(TokenClaims)
 		_, err := s.CreateToken(tk, pair.cipher)
 		// Assertions
@@ -37,6 +46,33 @@ func TestCreateToken(t *testing.T) {
 	}
 }
 
+/* Test for CreateIDToken method */
+func TestCreateIDToken(t *testing.T) {
+
+	s := &TokenManager{Config: &strut.SecurityConfig{CipherKey: "A", TTL: 10, Issuer: "https://auth.company.local"}}
+	tk := &IDTokenClaims{Name: "Name", Email: "user@company.local", Nonce: "N"}
+	tk.Subject = "user"
+	tk.Audience = "service"
+	res, err := s.CreateIDToken(tk, "secret")
+	assert.Nil(t, err)
+
+	val := new(IDTokenClaims)
+	_, err = jwt.ParseWithClaims(res, val, func(token *jwt.Token) (interface{}, error) {
+		return []byte("secret"), nil
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, "https://auth.company.local", val.Issuer)
+	assert.Equal(t, "service", val.Audience)
+	assert.Equal(t, "N", val.Nonce)
+	assert.Equal(t, int64(600), val.ExpiresAt-val.IssuedAt)
+
+	// the access tokens carry the issuer too
+	at := new(TokenClaims)
+	_, err = s.CreateToken(at, "secret")
+	assert.Nil(t, err)
+	assert.Equal(t, "https://auth.company.local", at.Issuer)
+}
+
 /*
 Provider struct for ValidateToken method
 */
@@ -58,7 +94,7 @@ func TestValidateToken(t *testing.T) {
 
 	for _, pair := range testProviderValidateToken {
 
-		s := &TokenManager{&strut.SecurityConfig{CipherKey: pair.cipher, TTL: pair.ttl}}
+		s := &TokenManager{Config: &strut.SecurityConfig{CipherKey: pair.cipher, TTL: pair.ttl}}
 		tk := new(TokenClaims)
 		tk.Username = "teste"
 		res, _ := s.CreateToken(tk, pair.cipher)
@@ -77,6 +113,139 @@ func TestValidateToken(t *testing.T) {
 	}
 }
 
+/* Test for the claims mapped from the LDAP attributes */
+func TestMappedClaims(t *testing.T) {
+
+	s := &TokenManager{Config: &strut.SecurityConfig{TTL: 10}}
+	tk := &TokenClaims{Username: "teste", Claims: map[string]interface{}{
+		"department": "IT",
+		"memberOf":   []string{"A", "B"},
+		"username":   "other",
+	}}
+	res, err := s.CreateToken(tk, "secret")
+	assert.Nil(t, err)
+
+	// the mapped claims are at the top level of the token
+	raw := jwt.MapClaims{}
+	_, _, err = new(jwt.Parser).ParseUnverified(res, raw)
+	assert.Nil(t, err)
+	assert.Equal(t, "IT", raw["department"])
+	assert.Equal(t, "teste", raw["username"])
+	assert.Nil(t, raw["claims"])
+
+	val, err := s.ValidateToken(res, "secret")
+	assert.Nil(t, err)
+	assert.Equal(t, "teste", val.Username)
+	assert.Equal(t, map[string]interface{}{"department": "IT", "memberOf": []interface{}{"A", "B"}}, val.Claims)
+	assert.Equal(t, int64(600), val.ExpiresAt-val.IssuedAt)
+}
+
+/*
+Provider struct for asymmetric signing
+*/
+type providerAsymmetricToken struct {
+	key        func() crypto.Signer
+	algorithm  string
+	algorithms []string
+	kty        string
+	iserro     bool
+}
+
+var testProviderAsymmetricToken = []providerAsymmetricToken{
+	{rsaKey, "", nil, "RSA", false},                            // OK RS256
+	{ecdsaKey, "", nil, "EC", false},                           // OK ES256
+	{ed25519Key, "", nil, "OKP", false},                        // OK EdDSA
+	{rsaKey, "RS512", nil, "RSA", false},                       // OK explicit algorithm
+	{rsaKey, "", []string{"HS256"}, "RSA", true},               // algorithm not allowed
+	{ed25519Key, "", []string{"HS256", "EdDSA"}, "OKP", false}, // algorithm allowed
+}
+
+func rsaKey() crypto.Signer {
+	k, _ := rsa.GenerateKey(rand.Reader, 2048)
+	return k
+}
+
+func ecdsaKey() crypto.Signer {
+	k, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	return k
+}
+
+func ed25519Key() crypto.Signer {
+	_, k, _ := ed25519.GenerateKey(rand.Reader)
+	return k
+}
+
+/* Test for CreateToken and ValidateToken methods with a private key */
+func TestAsymmetricToken(t *testing.T) {
+
+	for _, pair := range testProviderAsymmetricToken {
+
+		s := &TokenManager{Config: &strut.SecurityConfig{TTL: 10, Algorithm: pair.algorithm, Algorithms: pair.algorithms}}
+		err := s.setSigningKey(pair.key())
+		assert.Nil(t, err)
+
+		tk := new(TokenClaims)
+		tk.Username = "teste"
+		res, err := s.CreateToken(tk, "")
+		assert.Nil(t, err)
+
+		val, err := s.ValidateToken(res, "")
+		// Assertions
+		assert.Equal(t, pair.iserro, (err != nil))
+		if err == nil {
+			assert.Equal(t, "teste", val.Username)
+		}
+
+		jwks := s.JWKS()
+		assert.Equal(t, 1, len(jwks.Keys))
+		assert.Equal(t, pair.kty, jwks.Keys[0].Kty)
+		assert.NotEmpty(t, jwks.Keys[0].Kid)
+	}
+}
+
+/* Test for ValidateToken method rejecting HS256 tokens signed with the public key */
+func TestValidateTokenKeyConfusion(t *testing.T) {
+
+	s := &TokenManager{Config: &strut.SecurityConfig{TTL: 10, Algorithms: []string{"HS256", "RS256"}}}
+	_ = s.setSigningKey(rsaKey())
+
+	h := &TokenManager{Config: &strut.SecurityConfig{TTL: 10}}
+	tk := new(TokenClaims)
+	res, _ := h.CreateToken(tk, s.static.jwk.N)
+
+	_, err := s.ValidateToken(res, "servicekey")
+	assert.NotNil(t, err)
+}
+
+/* Test for parsePrivateKey method */
+func TestParsePrivateKey(t *testing.T) {
+
+	for _, f := range []func() crypto.Signer{rsaKey, ecdsaKey, ed25519Key} {
+		b, _ := x509.MarshalPKCS8PrivateKey(f())
+		k, err := parsePrivateKey(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: b}))
+		assert.Nil(t, err)
+		assert.NotNil(t, k)
+	}
+
+	_, err := parsePrivateKey([]byte("invalid"))
+	assert.Equal(t, ErrorPrivateKeyFormat, err)
+
+	// key doesn't match the algorithm
+	_, err = signingMethod("ES256", rsaKey())
+	assert.Equal(t, ErrorKeyAlgorithm, err)
+}
+
+/* Test for New method */
+func TestNew(t *testing.T) {
+
+	_, err := New(&strut.SecurityConfig{TTL: 10, Algorithm: "RS256"})
+	assert.Equal(t, ErrorPrivateKeyMissing, err)
+
+	s, err := New(&strut.SecurityConfig{TTL: 10})
+	assert.Nil(t, err)
+	assert.Equal(t, 0, len(s.JWKS().Keys))
+}
+
 /*
 Provider struct for Health method
 */
@@ -104,7 +273,7 @@ func TestHealth(t *testing.T) {
 		if pair.configok {
 			conf = &strut.SecurityConfig{CipherKey: pair.cipher, TTL: pair.ttl}
 		}
-		s := &TokenManager{conf}
+		s := &TokenManager{Config: conf}
 		err := s.Health()
 
 		// Assertions
@@ -0,0 +1,301 @@
+package secure
+
+import (
+	"crypto"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"github.com/dgrijalva/jwt-go"
+	strut "github.com/pintobikez/authentication-service/secure/structures"
+	"sort"
+	"time"
+)
+
+var (
+	ErrorKeyNotFound = errors.New("Signing key not found or retired")
+	ErrorKeySecret   = errors.New("HMAC signing key secret is empty")
+	ErrorKeySealed   = errors.New("Signing key can't be decrypted with the cipher key")
+)
+
+// A key of the ring ready to sign or verify tokens
+type ringKey struct {
+	id          string
+	method      jwt.SigningMethod
+	signer      crypto.Signer
+	secret      []byte
+	jwk         *strut.JSONWebKey
+	activatesAt time.Time
+	retiresAt   time.Time
+}
+
+// Returns the key used to sign a token
+func (k *ringKey) signingKey() interface{} {
+	if k.signer != nil {
+		return k.signer
+	}
+	return k.secret
+}
+
+// Returns the key used to verify the signature of a token
+func (k *ringKey) verificationKey() interface{} {
+	if k.signer != nil {
+		return k.signer.Public()
+	}
+	return k.secret
+}
+
+// Checks if the key can still be used to verify tokens
+func (k *ringKey) retired(now time.Time) bool {
+	return !k.retiresAt.IsZero() && !now.Before(k.retiresAt)
+}
+
+// KeyRing holds the signing keys, each one with a validity window.
+// The most recently activated key signs the tokens, while the older keys keep
+// verifying the tokens they signed until they are retired.
+type KeyRing struct {
+	keys []*ringKey
+}
+
+// NewKeyRing builds a KeyRing from the stored signing keys, the sealed ones are decrypted with the cipher key
+func NewKeyRing(keys []*strut.SigningKey, cipherKey string) (*KeyRing, error) {
+	r := &KeyRing{keys: make([]*ringKey, 0, len(keys))}
+
+	for _, sk := range keys {
+		k, err := parseSigningKey(sk, cipherKey)
+		if err != nil {
+			return nil, fmt.Errorf("Signing key %s: %s", sk.ID, err.Error())
+		}
+		r.keys = append(r.keys, k)
+	}
+
+	// Most recently activated keys first
+	sort.SliceStable(r.keys, func(i, j int) bool {
+		return r.keys[i].activatesAt.After(r.keys[j].activatesAt)
+	})
+
+	return r, nil
+}
+
+// Returns the key to sign new tokens, nil if the ring has no active key
+func (r *KeyRing) signing(now time.Time) *ringKey {
+	for _, k := range r.keys {
+		if !k.activatesAt.After(now) && !k.retired(now) {
+			return k
+		}
+	}
+	return nil
+}
+
+// Returns the key with the given id if it wasn't retired yet
+func (r *KeyRing) verification(kid string, now time.Time) *ringKey {
+	for _, k := range r.keys {
+		if k.id == kid && !k.retired(now) {
+			return k
+		}
+	}
+	return nil
+}
+
+// Returns the public keys that are not retired, including the ones not yet
+// activated, so that consumers can cache them before the first token is signed
+func (r *KeyRing) public(now time.Time) []*strut.JSONWebKey {
+	keys := make([]*strut.JSONWebKey, 0)
+	for _, k := range r.keys {
+		if k.jwk != nil && !k.retired(now) {
+			keys = append(keys, k.jwk)
+		}
+	}
+	return keys
+}
+
+// Converts a stored signing key into a ring key
+func parseSigningKey(sk *strut.SigningKey, cipherKey string) (*ringKey, error) {
+	k := &ringKey{id: sk.ID, activatesAt: time.Unix(sk.ActivatesAt, 0)}
+	if sk.RetiresAt > 0 {
+		k.retiresAt = time.Unix(sk.RetiresAt, 0)
+	}
+
+	key, err := openSigningKey(sk, cipherKey)
+	if err != nil {
+		return nil, err
+	}
+
+	method := jwt.GetSigningMethod(sk.Algorithm)
+	if method == nil {
+		return nil, fmt.Errorf("Unsupported signing algorithm %s", sk.Algorithm)
+	}
+
+	if _, ok := method.(*jwt.SigningMethodHMAC); ok {
+		secret, err := base64.StdEncoding.DecodeString(key)
+		if err != nil {
+			return nil, err
+		}
+		if len(secret) == 0 {
+			return nil, ErrorKeySecret
+		}
+		k.method = method
+		k.secret = secret
+		return k, nil
+	}
+
+	signer, err := parsePrivateKey([]byte(key))
+	if err != nil {
+		return nil, err
+	}
+	if k.method, err = signingMethod(sk.Algorithm, signer); err != nil {
+		return nil, err
+	}
+	if k.jwk, err = publicJWK(k.method, signer.Public()); err != nil {
+		return nil, err
+	}
+	k.signer = signer
+	k.jwk.Kid = sk.ID
+
+	return k, nil
+}
+
+// NewSigningKey creates a signing key for the ring, if no PEM private key is given a
+// new key (or HMAC secret) is generated for the algorithm
+func NewSigningKey(alg string, privateKey []byte, activatesAt time.Time) (*strut.SigningKey, error) {
+	method := jwt.GetSigningMethod(alg)
+	if method == nil {
+		return nil, fmt.Errorf("Unsupported signing algorithm %s", alg)
+	}
+
+	sk := &strut.SigningKey{Algorithm: alg, ActivatesAt: activatesAt.Unix()}
+
+	if _, ok := method.(*jwt.SigningMethodHMAC); ok {
+		secret := privateKey
+		if len(secret) == 0 {
+			secret = make([]byte, 64)
+			if _, err := rand.Read(secret); err != nil {
+				return nil, err
+			}
+		}
+		id := make([]byte, 8)
+		if _, err := rand.Read(id); err != nil {
+			return nil, err
+		}
+		sk.Key = base64.StdEncoding.EncodeToString(secret)
+		sk.ID = hex.EncodeToString(id)
+		return sk, nil
+	}
+
+	if len(privateKey) == 0 {
+		signer, err := generatePrivateKey(method)
+		if err != nil {
+			return nil, err
+		}
+		b, err := x509.MarshalPKCS8PrivateKey(signer)
+		if err != nil {
+			return nil, err
+		}
+		privateKey = pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: b})
+	}
+
+	signer, err := parsePrivateKey(privateKey)
+	if err != nil {
+		return nil, err
+	}
+	if method, err = signingMethod(alg, signer); err != nil {
+		return nil, err
+	}
+	jwk, err := publicJWK(method, signer.Public())
+	if err != nil {
+		return nil, err
+	}
+
+	sk.Key = string(privateKey)
+	sk.ID = jwk.Kid
+
+	return sk, nil
+}
+
+// SealSigningKey encrypts the private key (or HMAC secret) of a signing key with the cipher key,
+// so that the key ring in redis doesn't hold the keys in clear
+func SealSigningKey(sk *strut.SigningKey, cipherKey string) error {
+	if sk.Sealed {
+		return nil
+	}
+
+	aead, err := keyCipher(cipherKey)
+	if err != nil {
+		return err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return err
+	}
+
+	// the id is authenticated too, the sealed key can't be moved to another entry
+	sk.Key = base64.StdEncoding.EncodeToString(aead.Seal(nonce, nonce, []byte(sk.Key), []byte(sk.ID)))
+	sk.Sealed = true
+
+	return nil
+}
+
+// Returns the key of a stored signing key, decrypted with the cipher key when it is sealed
+func openSigningKey(sk *strut.SigningKey, cipherKey string) (string, error) {
+	if !sk.Sealed {
+		return sk.Key, nil
+	}
+
+	aead, err := keyCipher(cipherKey)
+	if err != nil {
+		return "", err
+	}
+	b, err := base64.StdEncoding.DecodeString(sk.Key)
+	if err != nil || len(b) < aead.NonceSize() {
+		return "", ErrorKeySealed
+	}
+	key, err := aead.Open(nil, b[:aead.NonceSize()], b[aead.NonceSize():], []byte(sk.ID))
+	if err != nil {
+		return "", ErrorKeySealed
+	}
+
+	return string(key), nil
+}
+
+// Returns the AES-GCM cipher of the keys of the ring, its 256 bits key is derived from the cipher key
+func keyCipher(cipherKey string) (cipher.AEAD, error) {
+	if cipherKey == "" {
+		return nil, ErrorConfigValues
+	}
+	key := sha256.Sum256([]byte(cipherKey))
+	block, err := aes.NewCipher(key[:])
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// Generates a private key suitable for the signing method
+func generatePrivateKey(method jwt.SigningMethod) (crypto.Signer, error) {
+	switch m := method.(type) {
+	case *jwt.SigningMethodRSA:
+		return rsa.GenerateKey(rand.Reader, 2048)
+	case *jwt.SigningMethodECDSA:
+		switch m.CurveBits {
+		case 384:
+			return ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+		case 521:
+			return ecdsa.GenerateKey(elliptic.P521(), rand.Reader)
+		}
+		return ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	case *SigningMethodEd25519:
+		_, k, err := ed25519.GenerateKey(rand.Reader)
+		return k, err
+	}
+	return nil, fmt.Errorf("Unsupported signing algorithm %s", method.Alg())
+}
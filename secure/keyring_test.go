@@ -0,0 +1,145 @@
+package secure
+
+import (
+	"github.com/dgrijalva/jwt-go"
+	strut "github.com/pintobikez/authentication-service/config/structures"
+	"github.com/pintobikez/authentication-service/mocks"
+	. "github.com/pintobikez/authentication-service/secure/structures"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+/*
+Provider struct for the key ring rotation
+*/
+type providerKeyRing struct {
+	algorithm string
+	activates time.Duration
+	retires   time.Duration
+	signs     bool
+	validates bool
+	published bool
+}
+
+var testProviderKeyRing = []providerKeyRing{
+	{"RS256", -time.Hour, 0, true, true, true},                 // active key
+	{"ES256", time.Hour, 0, false, false, true},                // pending key is published
+	{"EdDSA", -time.Hour, time.Hour, true, true, true},         // retiring key still signs while it is the newest
+	{"RS256", -2 * time.Hour, -time.Hour, false, false, false}, // retired key
+	{"HS256", -time.Hour, 0, true, true, false},                // HMAC key is not published
+}
+
+/* Test for the key ring signing and validation windows */
+func TestKeyRing(t *testing.T) {
+
+	for _, pair := range testProviderKeyRing {
+
+		k, err := NewSigningKey(pair.algorithm, nil, time.Now().Add(pair.activates))
+		assert.Nil(t, err)
+		if pair.retires != 0 {
+			k.RetiresAt = time.Now().Add(pair.retires).Unix()
+		}
+
+		store := &mocks.KeyStoreTest{Keys: []*SigningKey{k}}
+		s := &TokenManager{Config: &strut.SecurityConfig{CipherKey: "A", TTL: 10}, Store: store}
+
+		tk := &TokenClaims{Username: "teste"}
+		res, err := s.CreateToken(tk, "servicekey")
+		assert.Nil(t, err)
+
+		token, _, _ := new(jwt.Parser).ParseUnverified(res, &TokenClaims{})
+		assert.Equal(t, pair.signs, token.Header[HeaderKeyID] == k.ID)
+
+		if pair.signs {
+			_, err = s.ValidateToken(res, "servicekey")
+			assert.Equal(t, pair.validates, err == nil)
+		}
+
+		assert.Equal(t, pair.published, len(s.JWKS().Keys) == 1)
+	}
+}
+
+/* Test for the rotation from an old to a new key */
+func TestKeyRingRotation(t *testing.T) {
+
+	old, _ := NewSigningKey("ES256", nil, time.Now().Add(-time.Hour))
+	store := &mocks.KeyStoreTest{Keys: []*SigningKey{old}}
+	s := &TokenManager{Config: &strut.SecurityConfig{CipherKey: "A", TTL: 10, KeyRefresh: 1}, Store: store}
+
+	oldToken, _ := s.CreateToken(&TokenClaims{Username: "teste"}, "")
+
+	// a new key is added and the old one is retiring
+	next, _ := NewSigningKey("RS256", nil, time.Now().Add(-time.Second))
+	old.RetiresAt = time.Now().Add(time.Hour).Unix()
+	store.Keys = []*SigningKey{old, next}
+	s.loadedAt = time.Time{}
+
+	newToken, _ := s.CreateToken(&TokenClaims{Username: "teste"}, "")
+	token, _, _ := new(jwt.Parser).ParseUnverified(newToken, &TokenClaims{})
+	assert.Equal(t, next.ID, token.Header[HeaderKeyID])
+
+	// both tokens are valid
+	_, err := s.ValidateToken(oldToken, "")
+	assert.Nil(t, err)
+	_, err = s.ValidateToken(newToken, "")
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(s.JWKS().Keys))
+
+	// the old key is retired
+	old.RetiresAt = time.Now().Add(-time.Second).Unix()
+	s.loadedAt = time.Time{}
+	_, err = s.ValidateToken(oldToken, "")
+	assert.NotNil(t, err)
+	_, err = s.ValidateToken(newToken, "")
+	assert.Nil(t, err)
+
+	// store unavailable keeps the loaded keys
+	store.Iserror = true
+	s.loadedAt = time.Time{}
+	_, err = s.ValidateToken(newToken, "")
+	assert.Nil(t, err)
+	assert.NotNil(t, s.Health())
+}
+
+/* Test for the keys of the ring sealed with the cipher key */
+func TestKeyRingSealed(t *testing.T) {
+
+	for _, alg := range []string{"RS256", "EdDSA", "HS256"} {
+		k, _ := NewSigningKey(alg, nil, time.Now().Add(-time.Hour))
+		key := k.Key
+		assert.Nil(t, SealSigningKey(k, "A"))
+		assert.True(t, k.Sealed)
+		assert.NotContains(t, k.Key, "PRIVATE KEY", alg)
+		assert.NotEqual(t, key, k.Key, alg)
+
+		// sealing twice keeps the key
+		sealed := k.Key
+		assert.Nil(t, SealSigningKey(k, "A"))
+		assert.Equal(t, sealed, k.Key)
+
+		store := &mocks.KeyStoreTest{Keys: []*SigningKey{k}}
+		s := &TokenManager{Config: &strut.SecurityConfig{CipherKey: "A", TTL: 10}, Store: store}
+		res, err := s.CreateToken(&TokenClaims{Username: "teste"}, "servicekey")
+		assert.Nil(t, err)
+		token, _, _ := new(jwt.Parser).ParseUnverified(res, &TokenClaims{})
+		assert.Equal(t, k.ID, token.Header[HeaderKeyID], alg)
+		_, err = s.ValidateToken(res, "servicekey")
+		assert.Nil(t, err, alg)
+
+		// another cipher key can't decrypt the key
+		_, err = NewKeyRing([]*SigningKey{k}, "B")
+		assert.NotNil(t, err, alg)
+
+		// the sealed key is bound to its id
+		moved := *k
+		moved.ID = "other"
+		_, err = NewKeyRing([]*SigningKey{&moved}, "A")
+		assert.NotNil(t, err, alg)
+	}
+
+	// the cipher key is required
+	k, _ := NewSigningKey("ES256", nil, time.Now())
+	assert.Equal(t, ErrorConfigValues, SealSigningKey(k, ""))
+	assert.False(t, k.Sealed)
+}
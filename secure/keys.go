@@ -0,0 +1,170 @@
+package secure
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"github.com/dgrijalva/jwt-go"
+	strut "github.com/pintobikez/authentication-service/secure/structures"
+	"io/ioutil"
+	"math/big"
+)
+
+var (
+	ErrorPrivateKeyFormat = errors.New("Private key must be a PEM encoded RSA, ECDSA or Ed25519 key")
+	ErrorKeyAlgorithm     = errors.New("Private key doesn't match the configured algorithm")
+)
+
+// Loads a PEM encoded private key from the given file
+func loadPrivateKey(filename string) (crypto.Signer, error) {
+	b, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	return parsePrivateKey(b)
+}
+
+// Parses a PEM encoded PKCS#8, PKCS#1 or SEC 1 private key
+func parsePrivateKey(b []byte) (crypto.Signer, error) {
+	block, _ := pem.Decode(b)
+	if block == nil {
+		return nil, ErrorPrivateKeyFormat
+	}
+
+	if k, err := x509.ParsePKCS8PrivateKey(block.Bytes); err == nil {
+		if signer, ok := k.(crypto.Signer); ok {
+			return signer, nil
+		}
+		return nil, ErrorPrivateKeyFormat
+	}
+	if k, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+		return k, nil
+	}
+	if k, err := x509.ParseECPrivateKey(block.Bytes); err == nil {
+		return k, nil
+	}
+
+	return nil, ErrorPrivateKeyFormat
+}
+
+// Returns the signing method for the key, if no algorithm is given it is inferred from the key type
+func signingMethod(alg string, key crypto.Signer) (jwt.SigningMethod, error) {
+	if alg == "" {
+		switch k := key.(type) {
+		case *rsa.PrivateKey:
+			alg = jwt.SigningMethodRS256.Alg()
+		case *ecdsa.PrivateKey:
+			switch k.Curve {
+			case elliptic.P384():
+				alg = jwt.SigningMethodES384.Alg()
+			case elliptic.P521():
+				alg = jwt.SigningMethodES512.Alg()
+			default:
+				alg = jwt.SigningMethodES256.Alg()
+			}
+		case ed25519.PrivateKey:
+			alg = SigningMethodEdDSA.Alg()
+		}
+	}
+
+	method := jwt.GetSigningMethod(alg)
+	if method == nil {
+		return nil, fmt.Errorf("Unsupported signing algorithm %s", alg)
+	}
+
+	// Make sure the key can be used with the signing method
+	switch method.(type) {
+	case *jwt.SigningMethodRSA:
+		if _, ok := key.(*rsa.PrivateKey); ok {
+			return method, nil
+		}
+	case *jwt.SigningMethodECDSA:
+		if k, ok := key.(*ecdsa.PrivateKey); ok && k.Curve.Params().BitSize == method.(*jwt.SigningMethodECDSA).CurveBits {
+			return method, nil
+		}
+	case *SigningMethodEd25519:
+		if _, ok := key.(ed25519.PrivateKey); ok {
+			return method, nil
+		}
+	}
+
+	return nil, ErrorKeyAlgorithm
+}
+
+// Builds the JSON Web Key of the public part of the key
+func publicJWK(method jwt.SigningMethod, key crypto.PublicKey) (*strut.JSONWebKey, error) {
+	jwk := &strut.JSONWebKey{Use: "sig", Alg: method.Alg()}
+
+	switch k := key.(type) {
+	case *rsa.PublicKey:
+		jwk.Kty = "RSA"
+		jwk.N = encodeBigInt(k.N, 0)
+		jwk.E = encodeBigInt(big.NewInt(int64(k.E)), 0)
+	case *ecdsa.PublicKey:
+		size := (k.Curve.Params().BitSize + 7) / 8
+		jwk.Kty = "EC"
+		jwk.Crv = k.Curve.Params().Name
+		jwk.X = encodeBigInt(k.X, size)
+		jwk.Y = encodeBigInt(k.Y, size)
+	case ed25519.PublicKey:
+		jwk.Kty = "OKP"
+		jwk.Crv = "Ed25519"
+		jwk.X = base64.RawURLEncoding.EncodeToString(k)
+	default:
+		return nil, ErrorPrivateKeyFormat
+	}
+
+	jwk.Kid = thumbprint(jwk)
+
+	return jwk, nil
+}
+
+// Computes the RFC 7638 thumbprint of the key, used as key id
+func thumbprint(jwk *strut.JSONWebKey) string {
+	var members interface{}
+
+	// the required members must be in lexicographic order
+	switch jwk.Kty {
+	case "RSA":
+		members = struct {
+			E   string `json:"e"`
+			Kty string `json:"kty"`
+			N   string `json:"n"`
+		}{jwk.E, jwk.Kty, jwk.N}
+	case "EC":
+		members = struct {
+			Crv string `json:"crv"`
+			Kty string `json:"kty"`
+			X   string `json:"x"`
+			Y   string `json:"y"`
+		}{jwk.Crv, jwk.Kty, jwk.X, jwk.Y}
+	default:
+		members = struct {
+			Crv string `json:"crv"`
+			Kty string `json:"kty"`
+			X   string `json:"x"`
+		}{jwk.Crv, jwk.Kty, jwk.X}
+	}
+
+	b, _ := json.Marshal(members)
+	sum := sha256.Sum256(b)
+
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+func encodeBigInt(i *big.Int, size int) string {
+	b := i.Bytes()
+	if len(b) < size {
+		b = append(make([]byte, size-len(b)), b...)
+	}
+	return base64.RawURLEncoding.EncodeToString(b)
+}
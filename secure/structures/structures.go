@@ -1,17 +1,171 @@
 package structures
 
-import "github.com/dgrijalva/jwt-go"
+import (
+	"encoding/json"
+	"github.com/dgrijalva/jwt-go"
+)
 
 type TokenManagerI interface {
 	CreateToken(tk *TokenClaims, cipher string) (string, error)
 	ValidateToken(token string, cipher string) (*TokenClaims, error)
+	CreateIDToken(tk *IDTokenClaims, cipher string) (string, error)
+	JWKS() *JSONWebKeySet
 	Health() error
 }
 
+// KeyStoreI is the storage of the signing key ring shared by all the replicas
+type KeyStoreI interface {
+	FindSigningKeys() ([]*SigningKey, error)
+}
+
 type TokenClaims struct {
 	Username string   `json:"username"`
 	Service  string   `json:"service"`
 	Name     string   `json:"name"`
+	Email    string   `json:"email,omitempty"`
 	Groups   []string `json:"groups"`
+	Roles    []string `json:"roles,omitempty"`
+	Session  string   `json:"sid,omitempty"`
+	Scope    string   `json:"scope,omitempty"`
+	Act      *Actor   `json:"act,omitempty"`
+	Realm    string   `json:"realm,omitempty"`
+	// Claims mapped from the LDAP attributes, at the top level of the token
+	Claims map[string]interface{} `json:"-"`
 	jwt.StandardClaims
 }
+
+// Names of the claims of TokenClaims, the mapped claims can't replace them
+var reservedClaims = []string{"username", "service", "name", "email", "groups", "roles", "sid", "scope", "act", "realm", "aud", "exp", "jti", "iat", "iss", "nbf", "sub"}
+
+// tokenClaims is TokenClaims without its JSON methods
+type tokenClaims TokenClaims
+
+// MarshalJSON adds the mapped claims next to the claims of the token
+func (tk *TokenClaims) MarshalJSON() ([]byte, error) {
+	b, err := json.Marshal((*tokenClaims)(tk))
+	if err != nil || len(tk.Claims) == 0 {
+		return b, err
+	}
+
+	m := make(map[string]interface{}, len(tk.Claims))
+	for k, v := range tk.Claims {
+		m[k] = v
+	}
+	// the claims of the token win over the mapped ones
+	if err := json.Unmarshal(b, &m); err != nil {
+		return nil, err
+	}
+
+	return json.Marshal(m)
+}
+
+// UnmarshalJSON keeps the claims that are not of TokenClaims as the mapped claims
+func (tk *TokenClaims) UnmarshalJSON(b []byte) error {
+	if err := json.Unmarshal(b, (*tokenClaims)(tk)); err != nil {
+		return err
+	}
+
+	m := make(map[string]interface{})
+	if err := json.Unmarshal(b, &m); err != nil {
+		return err
+	}
+	for _, k := range reservedClaims {
+		delete(m, k)
+	}
+	if len(m) > 0 {
+		tk.Claims = m
+	}
+
+	return nil
+}
+
+// Actor is the service, and the session of the user in it, a token was exchanged from as described in RFC 8693.
+// A token exchanged again keeps the previous actors in Act.
+type Actor struct {
+	Subject string `json:"sub"`
+	Session string `json:"sid,omitempty"`
+	Act     *Actor `json:"act,omitempty"`
+}
+
+// UserEntry is the LDAP entry of a user cached at the login, with every group of the user.
+// It authorizes the token exchange without the password of the user.
+type UserEntry struct {
+	Username string                 `json:"username"`
+	Realm    string                 `json:"realm,omitempty"`
+	Name     string                 `json:"name"`
+	Email    string                 `json:"email,omitempty"`
+	Groups   []string               `json:"groups"`
+	Claims   map[string]interface{} `json:"claims,omitempty"`
+}
+
+// IDTokenClaims are the claims of the OpenID Connect id_token, the audience is the service
+type IDTokenClaims struct {
+	Name              string   `json:"name,omitempty"`
+	PreferredUsername string   `json:"preferred_username,omitempty"`
+	Email             string   `json:"email,omitempty"`
+	Groups            []string `json:"groups,omitempty"`
+	Nonce             string   `json:"nonce,omitempty"`
+	jwt.StandardClaims
+}
+
+// RefreshToken is the stored state of a refresh token.
+// Every token of the same login shares the Family, once rotated the token can't be used again.
+type RefreshToken struct {
+	Family   string                 `json:"family"`
+	Username string                 `json:"username"`
+	Service  string                 `json:"service"`
+	Name     string                 `json:"name"`
+	Email    string                 `json:"email,omitempty"`
+	Groups   []string               `json:"groups"`
+	Roles    []string               `json:"roles,omitempty"`
+	Act      *Actor                 `json:"act,omitempty"`
+	Realm    string                 `json:"realm,omitempty"`
+	Claims   map[string]interface{} `json:"claims,omitempty"`
+	Rotated  bool                   `json:"rotated"`
+}
+
+// AuthorizationCode is the stored state of an authorization code, it can only be exchanged once
+// by the service with the redirect URI and the PKCE verifier, or the API key, of the authorization request
+type AuthorizationCode struct {
+	Service       string                 `json:"service"`
+	RedirectURI   string                 `json:"redirectUri"`
+	CodeChallenge string                 `json:"codeChallenge,omitempty"`
+	Scope         string                 `json:"scope,omitempty"`
+	Nonce         string                 `json:"nonce,omitempty"`
+	Username      string                 `json:"username"`
+	Name          string                 `json:"name"`
+	Email         string                 `json:"email,omitempty"`
+	Groups        []string               `json:"groups"`
+	Roles         []string               `json:"roles,omitempty"`
+	Realm         string                 `json:"realm,omitempty"`
+	Claims        map[string]interface{} `json:"claims,omitempty"`
+}
+
+// JSONWebKey is the public part of a signing key as described in RFC 7517
+type JSONWebKey struct {
+	Kty string `json:"kty"`
+	Use string `json:"use,omitempty"`
+	Kid string `json:"kid,omitempty"`
+	Alg string `json:"alg,omitempty"`
+	Crv string `json:"crv,omitempty"`
+	N   string `json:"n,omitempty"`
+	E   string `json:"e,omitempty"`
+	X   string `json:"x,omitempty"`
+	Y   string `json:"y,omitempty"`
+}
+
+type JSONWebKeySet struct {
+	Keys []*JSONWebKey `json:"keys"`
+}
+
+// SigningKey is a key of the signing key ring as stored.
+// Key holds the PEM private key, or the base64 secret of the HMAC keys.
+// Sealed keys hold it encrypted with the cipher key of the security configuration.
+type SigningKey struct {
+	ID          string `json:"kid"`
+	Algorithm   string `json:"alg"`
+	Key         string `json:"key"`
+	Sealed      bool   `json:"sealed,omitempty"`
+	ActivatesAt int64  `json:"activatesAt"`
+	RetiresAt   int64  `json:"retiresAt,omitempty"`
+}